@@ -1,14 +1,43 @@
 package chunk
 
 import (
+	"math"
+
 	"golox-lang/lib/chunk/opcode"
 	"golox-lang/lib/value"
+	"golox-lang/lib/value/valuetype"
 )
 
 type Chunk struct {
-	code      []byte
-	lines     []int
+	code []byte
+	// positions maps the code back to the source, as runs of bytes compiled
+	// from the same place.
+	positions []positionRun
 	constants value.ValueArray
+	// constantIndex maps the constants that can be shared to their index,
+	// so that AddConstant stores each of them once.
+	constantIndex map[constantKey]int
+}
+
+// constantKey identifies a nil, boolean, number or string constant by its
+// content. Numbers are keyed by their bits, keeping 0 and -0 apart.
+type constantKey struct {
+	Type   valuetype.ValueType
+	Bits   uint64
+	String string
+}
+
+// Position is the place in the source that code was compiled from. Column
+// counts characters from 1, or is 0 when only the line is known.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// positionRun covers Count consecutive bytes of code from one Position.
+type positionRun struct {
+	Position
+	Count int
 }
 
 func New() *Chunk {
@@ -19,8 +48,36 @@ func (chunk *Chunk) GetCode() []byte {
 	return chunk.code
 }
 
-func (chunk *Chunk) GetLines() []int {
-	return chunk.lines
+// GetPosition returns the line and column that the byte at offset was
+// compiled from.
+func (chunk *Chunk) GetPosition(offset int) (int, int) {
+	for _, run := range chunk.positions {
+		if offset < run.Count {
+			return run.Line, run.Column
+		}
+		offset -= run.Count
+	}
+	return 0, 0
+}
+
+// positionCount returns the number of bytes the position table covers.
+func (chunk *Chunk) positionCount() int {
+	count := 0
+	for _, run := range chunk.positions {
+		count += run.Count
+	}
+	return count
+}
+
+// expandPositions returns the position of every byte of code.
+func (chunk *Chunk) expandPositions() []Position {
+	positions := make([]Position, 0, len(chunk.code))
+	for _, run := range chunk.positions {
+		for i := 0; i < run.Count; i++ {
+			positions = append(positions, run.Position)
+		}
+	}
+	return positions
 }
 
 func (chunk *Chunk) GetConstants() value.ValueArray {
@@ -28,31 +85,83 @@ func (chunk *Chunk) GetConstants() value.ValueArray {
 }
 
 func (chunk *Chunk) WriteChunk(b byte, line int) {
+	chunk.WriteChunkAt(b, Position{Line: line})
+}
+
+// WriteChunkAt appends b, compiled from position, to the code.
+func (chunk *Chunk) WriteChunkAt(b byte, position Position) {
 	chunk.code = append(chunk.code, b)
-	chunk.lines = append(chunk.lines, line)
+
+	if last := len(chunk.positions) - 1; last >= 0 && chunk.positions[last].Position == position {
+		chunk.positions[last].Count++
+	} else {
+		chunk.positions = append(chunk.positions, positionRun{Position: position, Count: 1})
+	}
 }
 
 func (chunk *Chunk) WriteConstant(value value.Value, line int) {
+	chunk.WriteConstantAt(value, Position{Line: line})
+}
+
+// WriteConstantAt adds value to the constants and appends the instruction
+// that pushes it, compiled from position.
+func (chunk *Chunk) WriteConstantAt(value value.Value, position Position) {
 	index := chunk.AddConstant(value)
 
 	if index < 256 {
-		chunk.WriteChunk(byte(opcode.OP_CONSTANT), line)
-		chunk.WriteChunk(byte(index), line)
+		chunk.WriteChunkAt(byte(opcode.OP_CONSTANT), position)
+		chunk.WriteChunkAt(byte(index), position)
 	} else {
-		chunk.WriteChunk(byte(opcode.OP_CONSTANT_LONG), line)
-		chunk.WriteChunk(byte(index&0xff), line)
-		chunk.WriteChunk(byte((index>>8)&0xff), line)
-		chunk.WriteChunk(byte((index>>16)&0xff), line)
+		chunk.WriteChunkAt(byte(opcode.OP_CONSTANT_LONG), position)
+		chunk.WriteChunkAt(byte(index&0xff), position)
+		chunk.WriteChunkAt(byte((index>>8)&0xff), position)
+		chunk.WriteChunkAt(byte((index>>16)&0xff), position)
 	}
 }
 
 func (chunk *Chunk) FreeChunk() {
 	chunk.code = make([]byte, 0)
-	chunk.lines = make([]int, 0)
+	chunk.positions = nil
 	chunk.constants.FreeValueArray()
+	chunk.constantIndex = nil
 }
 
+// AddConstant adds value to the constant table and returns its index. A nil,
+// boolean, number or string equal to one already in the table reuses its slot.
 func (chunk *Chunk) AddConstant(value value.Value) int {
+	key, shareable := keyOf(value)
+	if shareable {
+		if index, present := chunk.constantIndex[key]; present {
+			return index
+		}
+	}
+
 	chunk.constants.WriteValueArray(value)
-	return len(chunk.constants.Values) - 1
+	index := len(chunk.constants.Values) - 1
+
+	if shareable {
+		if chunk.constantIndex == nil {
+			chunk.constantIndex = make(map[constantKey]int)
+		}
+		chunk.constantIndex[key] = index
+	}
+	return index
+}
+
+func keyOf(val value.Value) (constantKey, bool) {
+	switch {
+	case val.IsNil():
+		return constantKey{Type: valuetype.VAL_NIL}, true
+	case val.IsBool():
+		key := constantKey{Type: valuetype.VAL_BOOL}
+		if val.AsBool() {
+			key.Bits = 1
+		}
+		return key, true
+	case val.IsNumber():
+		return constantKey{Type: valuetype.VAL_NUMBER, Bits: math.Float64bits(val.AsNumber())}, true
+	case val.IsString():
+		return constantKey{Type: valuetype.VAL_OBJ, String: val.AsGoString()}, true
+	}
+	return constantKey{}, false
 }
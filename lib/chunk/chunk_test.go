@@ -1,6 +1,8 @@
 package chunk
 
 import (
+	"math"
+
 	"golox-lang/lib/chunk/opcode"
 	"golox-lang/lib/value"
 	"golox-lang/lib/value/valuetype"
@@ -13,7 +15,8 @@ func TestWriteChunk(t *testing.T) {
 	var line = 1
 	chunkCreated.WriteChunk(byteToAppend, line)
 
-	if bA, lA := chunkCreated.GetCode()[len(chunkCreated.GetCode())-1], chunkCreated.GetLines()[len(chunkCreated.GetLines())-1]; bA != byteToAppend || lA != line {
+	lA, _ := chunkCreated.GetPosition(len(chunkCreated.GetCode()) - 1)
+	if bA := chunkCreated.GetCode()[len(chunkCreated.GetCode())-1]; bA != byteToAppend || lA != line {
 		t.Errorf("chunk.WriteChunk(%v, %v) failed, expected to append %v to Code, and %v to Line, got %v, %v respectively",
 			byteToAppend, line, byteToAppend, line, bA, lA)
 	}
@@ -42,3 +45,158 @@ func TestWriteConstant(t *testing.T) {
 		}
 	})
 }
+
+func TestAddConstant(t *testing.T) {
+	chunkCreated := New()
+
+	first := chunkCreated.AddConstant(value.NewObjString("name"))
+	if second := chunkCreated.AddConstant(value.NewObjString("name")); second != first {
+		t.Errorf("chunk.AddConstant(...) failed, expected equal strings to share index %v, got %v", first, second)
+	}
+	if one := chunkCreated.AddConstant(value.NumberValue(1)); one != chunkCreated.AddConstant(value.NumberValue(1)) {
+		t.Errorf("chunk.AddConstant(...) failed, expected equal numbers to share an index")
+	}
+	if zero := chunkCreated.AddConstant(value.NumberValue(0)); zero == chunkCreated.AddConstant(value.NumberValue(math.Copysign(0, -1))) {
+		t.Errorf("chunk.AddConstant(...) failed, expected 0 and -0 to have different indices")
+	}
+	function := value.NewObjFunction(value.NewFunction(New()))
+	if chunkCreated.AddConstant(function) == chunkCreated.AddConstant(function) {
+		t.Errorf("chunk.AddConstant(...) failed, expected functions to never share an index")
+	}
+	if count := len(chunkCreated.GetConstants().Values); count != 6 {
+		t.Errorf("chunk.AddConstant(...) failed, expected 6 constants, got %v", count)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	chunkCreated := New()
+	chunkCreated.WriteChunkAt(byte(opcode.OP_NIL), Position{Line: 1, Column: 5})
+	chunkCreated.WriteChunkAt(byte(opcode.OP_NIL), Position{Line: 1, Column: 5})
+	chunkCreated.WriteConstantAt(value.NumberValue(1), Position{Line: 2, Column: 3})
+	chunkCreated.WriteChunk(byte(opcode.OP_RETURN), 4)
+
+	expected := []Position{{1, 5}, {1, 5}, {2, 3}, {2, 3}, {4, 0}}
+	for offset, want := range expected {
+		if line, column := chunkCreated.GetPosition(offset); line != want.Line || column != want.Column {
+			t.Errorf("chunk.GetPosition(%v) failed, expected %v:%v, got %v:%v", offset, want.Line, want.Column, line, column)
+		}
+	}
+	if runs := len(chunkCreated.positions); runs != 3 {
+		t.Errorf("chunk.WriteChunkAt(...) failed, expected 3 position runs, got %v", runs)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	inner := New()
+	inner.WriteConstant(value.NewObjString("inner"), 2)
+	inner.WriteChunk(byte(opcode.OP_RETURN), 2)
+	innerFunction := value.NewFunction(inner)
+	innerFunction.Name = value.NewObjString("f").AsString()
+	innerFunction.Arity = 2
+	innerFunction.UpvalueCount = 1
+
+	script := New()
+	script.WriteConstant(value.New(valuetype.VAL_NUMBER, 1.5), 1)
+	script.WriteConstant(value.NewObjFunction(innerFunction), 1)
+	script.WriteChunk(byte(opcode.OP_RETURN), 3)
+
+	scriptFunction := value.NewFunction(script)
+	scriptFunction.GlobalNames = []string{"a", "b"}
+
+	data, err := Marshal(scriptFunction)
+	if err != nil {
+		t.Fatalf("chunk.Marshal(...) failed, expected no error, got %v", err)
+	}
+
+	function, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("chunk.Unmarshal(...) failed, expected no error, got %v", err)
+	}
+
+	loaded := function.Chunk.(*Chunk)
+	if line, _ := loaded.GetPosition(len(loaded.GetCode()) - 1); string(loaded.GetCode()) != string(script.GetCode()) || line != 3 {
+		t.Errorf("chunk.Unmarshal(...) failed, expected the code and lines to round trip")
+	}
+	if len(function.GlobalNames) != 2 || function.GlobalNames[1] != "b" {
+		t.Errorf("chunk.Unmarshal(...) failed, expected global names [a b], got %v", function.GlobalNames)
+	}
+	if constant := loaded.GetConstants().Values[0]; constant.AsNumber() != 1.5 {
+		t.Errorf("chunk.Unmarshal(...) failed, expected constant 1.5, got %v", constant)
+	}
+
+	loadedInner := loaded.GetConstants().Values[1].AsFunction()
+	if loadedInner.Name.String != "f" || loadedInner.Arity != 2 || loadedInner.UpvalueCount != 1 {
+		t.Errorf("chunk.Unmarshal(...) failed, expected nested function f/2 with 1 upvalue, got %v", loadedInner)
+	}
+	if constant := loadedInner.Chunk.GetConstants().Values[0]; constant.AsGoString() != "inner" {
+		t.Errorf("chunk.Unmarshal(...) failed, expected nested constant inner, got %v", constant)
+	}
+
+	// every truncation of a valid file must be rejected rather than panic
+	for i := 0; i < len(data); i++ {
+		if _, err := Unmarshal(data[:i]); err == nil {
+			t.Errorf("chunk.Unmarshal(...) failed, expected an error for a file truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	op := func(code opcode.OpCode) byte { return byte(code) }
+
+	tests := []struct {
+		name  string
+		code  []byte
+		valid bool
+	}{
+		{"return nil", []byte{op(opcode.OP_NIL), op(opcode.OP_RETURN)}, true},
+		{"conditional", []byte{
+			op(opcode.OP_TRUE), op(opcode.OP_JUMP_IF_FALSE), 0, 4,
+			op(opcode.OP_POP), op(opcode.OP_JUMP), 0, 1,
+			op(opcode.OP_POP), op(opcode.OP_NIL), op(opcode.OP_RETURN),
+		}, true},
+		{"catch", []byte{
+			op(opcode.OP_SETUP_CATCH), 0, 5,
+			op(opcode.OP_POP_HANDLER), op(opcode.OP_NIL), op(opcode.OP_JUMP), 0, 0,
+			op(opcode.OP_RETURN),
+		}, true},
+		{"unknown opcode", []byte{255}, false},
+		{"truncated operand", []byte{op(opcode.OP_CONSTANT)}, false},
+		{"constant out of range", []byte{op(opcode.OP_CONSTANT), 9, op(opcode.OP_RETURN)}, false},
+		{"global out of range", []byte{op(opcode.OP_GET_GLOBAL), 0, op(opcode.OP_RETURN)}, false},
+		{"local out of range", []byte{op(opcode.OP_GET_LOCAL), 1, op(opcode.OP_RETURN)}, false},
+		{"upvalue out of range", []byte{op(opcode.OP_GET_UPVALUE), 0, op(opcode.OP_RETURN)}, false},
+		{"jump inside instruction", []byte{op(opcode.OP_JUMP), 0, 1, op(opcode.OP_CONSTANT), 0, op(opcode.OP_RETURN)}, false},
+		{"jump outside code", []byte{op(opcode.OP_LOOP), 0, 9, op(opcode.OP_RETURN)}, false},
+		{"stack underflow", []byte{op(opcode.OP_POP), op(opcode.OP_POP), op(opcode.OP_RETURN)}, false},
+		{"inconsistent depth", []byte{
+			op(opcode.OP_TRUE), op(opcode.OP_JUMP_IF_FALSE), 0, 1,
+			op(opcode.OP_NIL), op(opcode.OP_RETURN),
+		}, false},
+		{"unbalanced handler", []byte{op(opcode.OP_POP_HANDLER), op(opcode.OP_NIL), op(opcode.OP_RETURN)}, false},
+		{"falls off the end", []byte{op(opcode.OP_NIL)}, false},
+		{"empty", []byte{}, false},
+		// the kinds of values are checked by the VM as it runs instead
+		{"import from a non-module", []byte{op(opcode.OP_NIL), op(opcode.OP_IMPORT_FROM), 1, op(opcode.OP_RETURN)}, true},
+		{"method on a non-class", []byte{op(opcode.OP_NIL), op(opcode.OP_NIL), op(opcode.OP_METHOD), 1, op(opcode.OP_RETURN)}, true},
+		{"super of a non-class", []byte{op(opcode.OP_NIL), op(opcode.OP_NIL), op(opcode.OP_GET_SUPER), 1, op(opcode.OP_RETURN)}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkCreated := New()
+			chunkCreated.AddConstant(value.New(valuetype.VAL_NUMBER, 1.0))
+			chunkCreated.AddConstant(value.NewObjString("name"))
+			for _, b := range test.code {
+				chunkCreated.WriteChunk(b, 1)
+			}
+
+			err := Verify(value.NewFunction(chunkCreated))
+			if test.valid && err != nil {
+				t.Errorf("chunk.Verify(...) failed, expected no error, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("chunk.Verify(...) failed, expected an error")
+			}
+		})
+	}
+}
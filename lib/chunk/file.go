@@ -0,0 +1,310 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golox-lang/lib/value"
+	"math"
+)
+
+// A compiled file starts with FILE_MAGIC and FILE_VERSION, followed by the
+// names of the script's global slots and the script function. Functions are
+// written as their name, arity, upvalue count, code, position table and
+// constants, with nested functions inline in the constants. The position
+// table is a list of (line, column, byte count) runs. Integers are unsigned
+// varints and numbers little-endian IEEE 754.
+const (
+	FILE_MAGIC   string = "LOXC"
+	FILE_VERSION uint16 = 5
+)
+
+// Tags for the kinds of constant a chunk can hold.
+const (
+	CONSTANT_NIL byte = iota
+	CONSTANT_BOOL
+	CONSTANT_NUMBER
+	CONSTANT_STRING
+	CONSTANT_FUNCTION
+)
+
+// IsCompiled reports whether data looks like a compiled file.
+func IsCompiled(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(FILE_MAGIC))
+}
+
+// Marshal encodes a compiled script function in the compiled file format.
+func Marshal(function *value.ObjFunction) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString(FILE_MAGIC)
+
+	var version [2]byte
+	binary.LittleEndian.PutUint16(version[:], FILE_VERSION)
+	buffer.Write(version[:])
+
+	writeUvarint(&buffer, uint64(len(function.GlobalNames)))
+	for _, name := range function.GlobalNames {
+		writeString(&buffer, name)
+	}
+
+	if err := writeFunction(&buffer, function); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal decodes a script function from the compiled file format and
+// verifies its bytecode, so the result is safe to run.
+func Unmarshal(data []byte) (*value.ObjFunction, error) {
+	if !IsCompiled(data) || len(data) < len(FILE_MAGIC)+2 {
+		return nil, fmt.Errorf("Not a compiled file.")
+	}
+
+	version := binary.LittleEndian.Uint16(data[len(FILE_MAGIC):])
+	if version != FILE_VERSION {
+		return nil, fmt.Errorf("Unsupported compiled file version %d, expect %d.", version, FILE_VERSION)
+	}
+
+	reader := &fileReader{data: data, offset: len(FILE_MAGIC) + 2}
+	globalNames := make([]string, reader.readLength())
+	for i := range globalNames {
+		globalNames[i] = reader.readString()
+	}
+	function := reader.readFunction()
+	function.GlobalNames = globalNames
+	if reader.err == nil && reader.offset != len(data) {
+		reader.fail("Unexpected data after the script function.")
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if err := Verify(function); err != nil {
+		return nil, err
+	}
+	return function, nil
+}
+
+func writeUvarint(buffer *bytes.Buffer, x uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], x)
+	buffer.Write(encoded[:n])
+}
+
+func writeString(buffer *bytes.Buffer, s string) {
+	writeUvarint(buffer, uint64(len(s)))
+	buffer.WriteString(s)
+}
+
+func writeFunction(buffer *bytes.Buffer, function *value.ObjFunction) error {
+	chunk, ok := function.Chunk.(*Chunk)
+	if !ok {
+		return fmt.Errorf("Can't write a function without a chunk.")
+	}
+
+	if function.Name == nil {
+		buffer.WriteByte(0)
+	} else {
+		buffer.WriteByte(1)
+		writeString(buffer, function.Name.String)
+	}
+	writeUvarint(buffer, uint64(function.Arity))
+	writeUvarint(buffer, uint64(function.UpvalueCount))
+
+	writeUvarint(buffer, uint64(len(chunk.code)))
+	buffer.Write(chunk.code)
+
+	writeUvarint(buffer, uint64(len(chunk.positions)))
+	for _, run := range chunk.positions {
+		writeUvarint(buffer, uint64(run.Line))
+		writeUvarint(buffer, uint64(run.Column))
+		writeUvarint(buffer, uint64(run.Count))
+	}
+
+	writeUvarint(buffer, uint64(len(chunk.constants.Values)))
+	for _, constant := range chunk.constants.Values {
+		if err := writeConstant(buffer, constant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeConstant(buffer *bytes.Buffer, constant value.Value) error {
+	switch {
+	case constant.IsNil():
+		buffer.WriteByte(CONSTANT_NIL)
+
+	case constant.IsBool():
+		buffer.WriteByte(CONSTANT_BOOL)
+		if constant.AsBool() {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+
+	case constant.IsNumber():
+		buffer.WriteByte(CONSTANT_NUMBER)
+		var bits [8]byte
+		binary.LittleEndian.PutUint64(bits[:], math.Float64bits(constant.AsNumber()))
+		buffer.Write(bits[:])
+
+	case constant.IsString():
+		buffer.WriteByte(CONSTANT_STRING)
+		writeString(buffer, constant.AsGoString())
+
+	case constant.IsFunction():
+		buffer.WriteByte(CONSTANT_FUNCTION)
+		return writeFunction(buffer, constant.AsFunction())
+
+	default:
+		return fmt.Errorf("Can't write constant %s.", constant.String())
+	}
+	return nil
+}
+
+// fileReader decodes a compiled file. The first error stops all further
+// reads, so callers only need to check err once they are done.
+type fileReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (reader *fileReader) fail(format string, args ...interface{}) {
+	if reader.err == nil {
+		reader.err = fmt.Errorf("Malformed compiled file at byte %d: %s", reader.offset, fmt.Sprintf(format, args...))
+	}
+}
+
+func (reader *fileReader) readByte() byte {
+	if reader.err != nil {
+		return 0
+	}
+	if reader.offset >= len(reader.data) {
+		reader.fail("Unexpected end of file.")
+		return 0
+	}
+
+	b := reader.data[reader.offset]
+	reader.offset++
+	return b
+}
+
+func (reader *fileReader) readBytes(n int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if n > len(reader.data)-reader.offset {
+		reader.fail("Unexpected end of file.")
+		return nil
+	}
+
+	result := reader.data[reader.offset : reader.offset+n]
+	reader.offset += n
+	return result
+}
+
+func (reader *fileReader) readUvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+
+	x, n := binary.Uvarint(reader.data[reader.offset:])
+	if n <= 0 {
+		reader.fail("Invalid integer.")
+		return 0
+	}
+	reader.offset += n
+	return x
+}
+
+// readLength reads a count of items that each take at least one byte, so
+// that a corrupt count can't make the reader allocate more than the file.
+func (reader *fileReader) readLength() int {
+	length := reader.readUvarint()
+	if length > uint64(len(reader.data)-reader.offset) {
+		reader.fail("Length %d is larger than the file.", length)
+		return 0
+	}
+	return int(length)
+}
+
+func (reader *fileReader) readString() string {
+	return string(reader.readBytes(reader.readLength()))
+}
+
+func (reader *fileReader) readFunction() *value.ObjFunction {
+	chunk := New()
+	function := value.NewFunction(chunk)
+
+	switch reader.readByte() {
+	case 0:
+	case 1:
+		function.Name = value.NewObjString(reader.readString()).AsString()
+	default:
+		reader.fail("Invalid function name flag.")
+	}
+	arity := reader.readUvarint()
+	upvalueCount := reader.readUvarint()
+	if arity > 255 || upvalueCount > 256 {
+		reader.fail("Function has too many parameters or upvalues.")
+	}
+	function.Arity = int(arity)
+	function.UpvalueCount = int(upvalueCount)
+
+	code := reader.readBytes(reader.readLength())
+	chunk.code = append([]byte(nil), code...)
+
+	covered := 0
+	chunk.positions = make([]positionRun, reader.readLength())
+	for i := range chunk.positions {
+		run := &chunk.positions[i]
+		run.Line = int(reader.readUvarint())
+		run.Column = int(reader.readUvarint())
+		count := reader.readUvarint()
+		if count > uint64(len(chunk.code)-covered) {
+			reader.fail("Position table covers more than the code.")
+			return function
+		}
+		run.Count = int(count)
+		covered += run.Count
+	}
+	if reader.err == nil && covered != len(chunk.code) {
+		reader.fail("Expect positions for %d bytes but got %d.", len(chunk.code), covered)
+	}
+
+	constantCount := reader.readLength()
+	for i := 0; i < constantCount && reader.err == nil; i++ {
+		// Appended as they are, since deduplicating would move the
+		// indices the code refers to.
+		chunk.constants.WriteValueArray(reader.readConstant())
+	}
+	return function
+}
+
+func (reader *fileReader) readConstant() value.Value {
+	switch tag := reader.readByte(); tag {
+	case CONSTANT_NIL:
+		return value.NilValue()
+
+	case CONSTANT_BOOL:
+		return value.BoolValue(reader.readByte() != 0)
+
+	case CONSTANT_NUMBER:
+		bits := reader.readBytes(8)
+		if bits == nil {
+			return value.NilValue()
+		}
+		return value.NumberValue(math.Float64frombits(binary.LittleEndian.Uint64(bits)))
+
+	case CONSTANT_STRING:
+		return value.NewObjString(reader.readString())
+
+	case CONSTANT_FUNCTION:
+		return value.NewObjFunction(reader.readFunction())
+
+	default:
+		reader.fail("Unknown constant tag %d.", tag)
+		return value.NilValue()
+	}
+}
@@ -0,0 +1,87 @@
+package chunk
+
+import "golox-lang/lib/chunk/opcode"
+
+// longForms maps instructions with a 1 byte operand to the variant taking a
+// 3 byte operand, for when the index doesn't fit in a byte.
+var longForms = map[opcode.OpCode]opcode.OpCode{
+	opcode.OP_CONSTANT:      opcode.OP_CONSTANT_LONG,
+	opcode.OP_GET_LOCAL:     opcode.OP_GET_LOCAL_LONG,
+	opcode.OP_SET_LOCAL:     opcode.OP_SET_LOCAL_LONG,
+	opcode.OP_GET_GLOBAL:    opcode.OP_GET_GLOBAL_LONG,
+	opcode.OP_DEFINE_GLOBAL: opcode.OP_DEFINE_GLOBAL_LONG,
+	opcode.OP_SET_GLOBAL:    opcode.OP_SET_GLOBAL_LONG,
+	opcode.OP_GET_PROPERTY:  opcode.OP_GET_PROPERTY_LONG,
+	opcode.OP_SET_PROPERTY:  opcode.OP_SET_PROPERTY_LONG,
+	opcode.OP_CLOSURE:       opcode.OP_CLOSURE_LONG,
+	opcode.OP_CLASS:         opcode.OP_CLASS_LONG,
+	opcode.OP_METHOD:        opcode.OP_METHOD_LONG,
+	opcode.OP_IMPORT:        opcode.OP_IMPORT_LONG,
+	opcode.OP_IMPORT_FROM:   opcode.OP_IMPORT_FROM_LONG,
+}
+
+// shortForms is the inverse of longForms.
+var shortForms = make(map[opcode.OpCode]opcode.OpCode)
+
+func init() {
+	for short, long := range longForms {
+		shortForms[long] = short
+	}
+}
+
+// operandLength returns how many operand bytes follow an instruction, not
+// counting the upvalue pairs after a closure. It reports false for an
+// unknown opcode.
+func operandLength(instruction opcode.OpCode) (int, bool) {
+	switch instruction {
+	case opcode.OP_NIL, opcode.OP_TRUE, opcode.OP_FALSE, opcode.OP_POP,
+		opcode.OP_EQUAL, opcode.OP_GET_INDEX, opcode.OP_SET_INDEX,
+		opcode.OP_GREATER, opcode.OP_LESS, opcode.OP_ADD, opcode.OP_SUBTRACT,
+		opcode.OP_MULTIPLY, opcode.OP_DIVIDE, opcode.OP_MODULO, opcode.OP_POWER,
+		opcode.OP_NOT, opcode.OP_NEGATE, opcode.OP_PRINT,
+		opcode.OP_THROW, opcode.OP_POP_HANDLER, opcode.OP_END_FINALLY,
+		opcode.OP_CLOSE_UPVALUE, opcode.OP_RETURN, opcode.OP_INHERIT:
+		return 0, true
+
+	case opcode.OP_GET_UPVALUE, opcode.OP_SET_UPVALUE, opcode.OP_GET_SUPER,
+		opcode.OP_BUILD_LIST, opcode.OP_BUILD_MAP, opcode.OP_INTERPOLATE, opcode.OP_CALL:
+		return 1, true
+
+	case opcode.OP_JUMP, opcode.OP_JUMP_IF_FALSE, opcode.OP_LOOP,
+		opcode.OP_SETUP_CATCH, opcode.OP_SETUP_FINALLY:
+		return 2, true
+	}
+
+	if _, ok := longForms[instruction]; ok {
+		return 1, true
+	}
+	if _, ok := shortForms[instruction]; ok {
+		return 3, true
+	}
+	return 0, false
+}
+
+func isClosure(instruction opcode.OpCode) bool {
+	return instruction == opcode.OP_CLOSURE || instruction == opcode.OP_CLOSURE_LONG
+}
+
+func isJump(instruction opcode.OpCode) bool {
+	switch instruction {
+	case opcode.OP_JUMP, opcode.OP_JUMP_IF_FALSE, opcode.OP_LOOP,
+		opcode.OP_SETUP_CATCH, opcode.OP_SETUP_FINALLY:
+		return true
+	}
+	return false
+}
+
+// hasConstantOperand reports whether the operand of a short form instruction
+// indexes the constant table.
+func hasConstantOperand(instruction opcode.OpCode) bool {
+	switch instruction {
+	case opcode.OP_CONSTANT, opcode.OP_GET_PROPERTY, opcode.OP_SET_PROPERTY,
+		opcode.OP_GET_SUPER, opcode.OP_CLOSURE, opcode.OP_CLASS, opcode.OP_METHOD,
+		opcode.OP_IMPORT, opcode.OP_IMPORT_FROM:
+		return true
+	}
+	return false
+}
@@ -19,28 +19,50 @@ const (
 	OP_DEFINE_GLOBAL_LONG
 	OP_SET_GLOBAL
 	OP_SET_GLOBAL_LONG
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
 	OP_EQUAL
 	OP_GET_PROPERTY
 	OP_GET_PROPERTY_LONG
 	OP_SET_PROPERTY
 	OP_SET_PROPERTY_LONG
 	OP_GET_SUPER
+	OP_BUILD_LIST
+	OP_BUILD_MAP
+	OP_INTERPOLATE
+	OP_GET_INDEX
+	OP_SET_INDEX
 	OP_GREATER
 	OP_LESS
 	OP_ADD
+	OP_SUBTRACT
 	OP_MULTIPLY
 	OP_DIVIDE
+	OP_MODULO
+	OP_POWER
 	OP_NOT
 	OP_NEGATE
 	OP_PRINT
 	OP_JUMP
 	OP_JUMP_IF_FALSE
 	OP_LOOP
+	OP_THROW
+	OP_SETUP_CATCH
+	OP_SETUP_FINALLY
+	OP_POP_HANDLER
+	OP_END_FINALLY
 	OP_CALL
+	OP_CLOSURE
+	OP_CLOSURE_LONG
+	OP_CLOSE_UPVALUE
 	OP_RETURN
 	OP_CLASS
 	OP_CLASS_LONG
 	OP_INHERIT
 	OP_METHOD
 	OP_METHOD_LONG
+	OP_IMPORT
+	OP_IMPORT_LONG
+	OP_IMPORT_FROM
+	OP_IMPORT_FROM_LONG
 )
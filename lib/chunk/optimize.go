@@ -0,0 +1,478 @@
+package chunk
+
+import (
+	"golox-lang/lib/chunk/opcode"
+	"golox-lang/lib/value"
+	"math"
+)
+
+// MAX_OPTIMIZER_PASSES bounds how often the optimizer goes over a function.
+// Each pass can open up more work for the next, but code settles quickly.
+const MAX_OPTIMIZER_PASSES int = 16
+
+// instruction is a decoded instruction. Instructions with a long form are
+// kept in their short form and the operand decides which one is written.
+type instruction struct {
+	op opcode.OpCode
+	// operand is the constant index, slot or count of the instruction.
+	operand int
+	// target is the index of the instruction a jump goes to.
+	target int
+	// upvalues are the isLocal and index pairs following a closure.
+	upvalues []byte
+	position Position
+	removed  bool
+}
+
+// optimizerSteps run in order on each pass.
+var optimizerSteps = []func(*optimizer) bool{
+	(*optimizer).foldConstants,
+	(*optimizer).threadJumps,
+	(*optimizer).removeUnusedPushes,
+	(*optimizer).removeUnreachable,
+}
+
+type optimizer struct {
+	instructions []instruction
+	constants    []value.Value
+	// labels marks the instructions a jump or handler can go to.
+	labels []bool
+}
+
+// Optimize rewrites the code of a function the compiler has just produced.
+// It folds operations on literals, shortens chains of jumps, drops values
+// that are pushed only to be popped and removes code that can't be reached.
+// Functions in the constants are left alone, the compiler optimizes each
+// one as it finishes it.
+func Optimize(function *value.ObjFunction) {
+	chunk, ok := function.Chunk.(*Chunk)
+	if !ok || len(chunk.code) == 0 {
+		return
+	}
+
+	optimizer := &optimizer{constants: append([]value.Value(nil), chunk.constants.Values...)}
+	optimizer.decode(chunk)
+
+	for pass := 0; pass < MAX_OPTIMIZER_PASSES; pass++ {
+		changed := false
+		for _, step := range optimizerSteps {
+			// Each step moves jumps or removes instructions, so the labels
+			// are found again before the next one.
+			optimizer.findLabels()
+			changed = step(optimizer) || changed
+		}
+		optimizer.compact()
+		if !changed {
+			break
+		}
+	}
+
+	if optimized, ok := optimizer.encode(); ok {
+		function.Chunk = optimized
+	}
+}
+
+func (optimizer *optimizer) decode(chunk *Chunk) {
+	code := chunk.code
+	positions := chunk.expandPositions()
+	indices := make(map[int]int)
+	var jumps []int
+
+	for offset := 0; offset < len(code); {
+		indices[offset] = len(optimizer.instructions)
+		op := opcode.OpCode(code[offset])
+		length, _ := operandLength(op)
+		current := instruction{op: op, position: positions[offset]}
+
+		switch {
+		case length == 1:
+			current.operand = int(code[offset+1])
+		case length == 3:
+			current.operand = int(code[offset+1]) | int(code[offset+2])<<8 | int(code[offset+3])<<16
+			current.op = shortForms[op]
+		case isJump(op):
+			jump := int(code[offset+1])<<8 | int(code[offset+2])
+			if op == opcode.OP_LOOP {
+				current.target = offset + 3 - jump
+			} else {
+				current.target = offset + 3 + jump
+			}
+			jumps = append(jumps, len(optimizer.instructions))
+		}
+
+		offset += 1 + length
+		if isClosure(op) {
+			upvalueCount := optimizer.constants[current.operand].AsFunction().UpvalueCount
+			current.upvalues = append([]byte(nil), code[offset:offset+2*upvalueCount]...)
+			offset += 2 * upvalueCount
+		}
+		optimizer.instructions = append(optimizer.instructions, current)
+	}
+
+	// Jump targets are byte offsets until every instruction has been seen.
+	for _, i := range jumps {
+		optimizer.instructions[i].target = indices[optimizer.instructions[i].target]
+	}
+}
+
+// findLabels marks where each jump lands. A jump to a removed instruction
+// lands on the next one that is left.
+func (optimizer *optimizer) findLabels() {
+	optimizer.labels = make([]bool, len(optimizer.instructions))
+	for _, current := range optimizer.instructions {
+		if !current.removed && isJump(current.op) {
+			target := current.target
+			if optimizer.instructions[target].removed {
+				target = optimizer.next(target)
+			}
+			if target >= 0 {
+				optimizer.labels[target] = true
+			}
+		}
+	}
+}
+
+// next returns the index of the first instruction after i that hasn't been
+// removed, or -1 if there is none.
+func (optimizer *optimizer) next(i int) int {
+	for i++; i < len(optimizer.instructions); i++ {
+		if !optimizer.instructions[i].removed {
+			return i
+		}
+	}
+	return -1
+}
+
+// literal returns the value an instruction pushes when it only pushes a
+// constant value.
+func (optimizer *optimizer) literal(current instruction) (value.Value, bool) {
+	switch current.op {
+	case opcode.OP_CONSTANT:
+		constant := optimizer.constants[current.operand]
+		return constant, constant.IsNumber() || constant.IsString()
+	case opcode.OP_NIL:
+		return value.NilValue(), true
+	case opcode.OP_TRUE:
+		return value.BoolValue(true), true
+	case opcode.OP_FALSE:
+		return value.BoolValue(false), true
+	}
+	return value.Value{}, false
+}
+
+// push replaces the instruction at i with one that pushes val.
+func (optimizer *optimizer) push(i int, val value.Value) {
+	current := &optimizer.instructions[i]
+	switch {
+	case val.IsBool() && val.AsBool():
+		current.op = opcode.OP_TRUE
+	case val.IsBool():
+		current.op = opcode.OP_FALSE
+	case val.IsNil():
+		current.op = opcode.OP_NIL
+	default:
+		current.op = opcode.OP_CONSTANT
+		current.operand = len(optimizer.constants)
+		optimizer.constants = append(optimizer.constants, val)
+	}
+}
+
+// foldConstants evaluates unary and binary operators whose operands are
+// literals. Operations that would fail at runtime are left for the VM to
+// report.
+func (optimizer *optimizer) foldConstants() bool {
+	changed := false
+	for i := range optimizer.instructions {
+		if optimizer.instructions[i].removed {
+			continue
+		}
+		a, ok := optimizer.literal(optimizer.instructions[i])
+		if !ok {
+			continue
+		}
+
+		j := optimizer.next(i)
+		if j < 0 || optimizer.labels[j] {
+			continue
+		}
+		if result, ok := foldUnary(optimizer.instructions[j].op, a); ok {
+			optimizer.instructions[j].removed = true
+			optimizer.instructions[i].position = optimizer.instructions[j].position
+			optimizer.push(i, result)
+			changed = true
+			continue
+		}
+
+		b, ok := optimizer.literal(optimizer.instructions[j])
+		if !ok {
+			continue
+		}
+		k := optimizer.next(j)
+		if k < 0 || optimizer.labels[k] {
+			continue
+		}
+		if result, ok := foldBinary(optimizer.instructions[k].op, a, b); ok {
+			optimizer.instructions[j].removed = true
+			optimizer.instructions[k].removed = true
+			optimizer.instructions[i].position = optimizer.instructions[k].position
+			optimizer.push(i, result)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func isFalsey(val value.Value) bool {
+	return val.IsNil() || (val.IsBool() && !val.AsBool())
+}
+
+func foldUnary(op opcode.OpCode, a value.Value) (value.Value, bool) {
+	switch op {
+	case opcode.OP_NOT:
+		return value.BoolValue(isFalsey(a)), true
+	case opcode.OP_NEGATE:
+		if a.IsNumber() {
+			return value.NumberValue(-a.AsNumber()), true
+		}
+	}
+	return value.Value{}, false
+}
+
+func foldBinary(op opcode.OpCode, a value.Value, b value.Value) (value.Value, bool) {
+	if op == opcode.OP_EQUAL {
+		return value.BoolValue(value.ValuesEqual(a, b)), true
+	}
+	if op == opcode.OP_ADD && a.IsString() && b.IsString() {
+		return value.NewObjString(a.AsGoString() + b.AsGoString()), true
+	}
+	if !a.IsNumber() || !b.IsNumber() {
+		return value.Value{}, false
+	}
+
+	x, y := a.AsNumber(), b.AsNumber()
+	switch op {
+	case opcode.OP_ADD:
+		return value.NumberValue(x + y), true
+	case opcode.OP_SUBTRACT:
+		return value.NumberValue(x - y), true
+	case opcode.OP_MULTIPLY:
+		return value.NumberValue(x * y), true
+	case opcode.OP_DIVIDE:
+		return value.NumberValue(x / y), true
+	case opcode.OP_MODULO:
+		return value.NumberValue(math.Mod(x, y)), true
+	case opcode.OP_POWER:
+		return value.NumberValue(math.Pow(x, y)), true
+	case opcode.OP_GREATER:
+		return value.BoolValue(x > y), true
+	case opcode.OP_LESS:
+		return value.BoolValue(x < y), true
+	}
+	return value.Value{}, false
+}
+
+// threadJumps points jumps that land on another jump straight at its target,
+// resolves conditional jumps on literals and removes jumps to the next
+// instruction.
+func (optimizer *optimizer) threadJumps() bool {
+	changed := false
+	for i := range optimizer.instructions {
+		current := &optimizer.instructions[i]
+		if current.removed {
+			continue
+		}
+
+		switch current.op {
+		case opcode.OP_JUMP, opcode.OP_LOOP:
+			// A chain of jumps can loop forever, so it is only followed as far
+			// as it has instructions.
+			for steps := 0; steps < len(optimizer.instructions); steps++ {
+				target := optimizer.instructions[current.target]
+				if (target.op != opcode.OP_JUMP && target.op != opcode.OP_LOOP) || target.target == current.target {
+					break
+				}
+				current.target = target.target
+				changed = true
+			}
+
+		case opcode.OP_JUMP_IF_FALSE:
+			// The condition is still on the stack when the jump lands, so a
+			// second test of it goes the same way. Conditional jumps only go
+			// forward.
+			for steps := 0; steps < len(optimizer.instructions); steps++ {
+				target := optimizer.instructions[current.target]
+				if (target.op != opcode.OP_JUMP && target.op != opcode.OP_JUMP_IF_FALSE) || target.target <= i {
+					break
+				}
+				current.target = target.target
+				changed = true
+			}
+
+			previous := i - 1
+			for previous >= 0 && optimizer.instructions[previous].removed {
+				previous--
+			}
+			if previous >= 0 && !optimizer.labels[i] {
+				if condition, ok := optimizer.literal(optimizer.instructions[previous]); ok {
+					if isFalsey(condition) {
+						current.op = opcode.OP_JUMP
+					} else {
+						current.removed = true
+					}
+					changed = true
+					continue
+				}
+			}
+		}
+
+		if current.op == opcode.OP_JUMP && current.target == optimizer.next(i) {
+			current.removed = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeUnusedPushes drops an instruction that only pushes a value when the
+// next instruction pops it again.
+func (optimizer *optimizer) removeUnusedPushes() bool {
+	changed := false
+	for i := range optimizer.instructions {
+		switch optimizer.instructions[i].op {
+		case opcode.OP_CONSTANT, opcode.OP_NIL, opcode.OP_TRUE, opcode.OP_FALSE,
+			opcode.OP_GET_LOCAL, opcode.OP_GET_UPVALUE:
+		default:
+			continue
+		}
+		if optimizer.instructions[i].removed {
+			continue
+		}
+
+		j := optimizer.next(i)
+		if j >= 0 && optimizer.instructions[j].op == opcode.OP_POP && !optimizer.labels[j] {
+			optimizer.instructions[i].removed = true
+			optimizer.instructions[j].removed = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// removeUnreachable removes the instructions after a return, throw or jump
+// up to the next one that a jump goes to.
+func (optimizer *optimizer) removeUnreachable() bool {
+	changed := false
+	reachable := true
+	for i := range optimizer.instructions {
+		current := &optimizer.instructions[i]
+		if optimizer.labels[i] {
+			reachable = true
+		}
+		if current.removed {
+			continue
+		}
+		if !reachable {
+			current.removed = true
+			changed = true
+			continue
+		}
+
+		switch current.op {
+		case opcode.OP_RETURN, opcode.OP_THROW, opcode.OP_JUMP, opcode.OP_LOOP:
+			reachable = false
+		}
+	}
+	return changed
+}
+
+// compact deletes removed instructions. A jump to a removed instruction goes
+// to the next one that is left instead.
+func (optimizer *optimizer) compact() {
+	indices := make([]int, len(optimizer.instructions)+1)
+	live := optimizer.instructions[:0]
+	for i, current := range optimizer.instructions {
+		indices[i] = len(live)
+		if !current.removed {
+			live = append(live, current)
+		}
+	}
+	indices[len(optimizer.instructions)] = len(live)
+
+	for i := range live {
+		if isJump(live[i].op) {
+			live[i].target = indices[live[i].target]
+		}
+	}
+	optimizer.instructions = live
+}
+
+// encode writes the instructions to a new chunk, keeping only the constants
+// they use. It fails if a jump no longer fits in its operand, in which case
+// the original code is kept.
+func (optimizer *optimizer) encode() (*Chunk, bool) {
+	chunk := New()
+
+	constants := make(map[int]int)
+	for i := range optimizer.instructions {
+		if hasConstantOperand(optimizer.instructions[i].op) {
+			constants[optimizer.instructions[i].operand] = 0
+		}
+	}
+	for i, constant := range optimizer.constants {
+		if _, used := constants[i]; used {
+			constants[i] = chunk.AddConstant(constant)
+		}
+	}
+
+	offsets := make([]int, len(optimizer.instructions)+1)
+	for i := range optimizer.instructions {
+		current := &optimizer.instructions[i]
+		if hasConstantOperand(current.op) {
+			current.operand = constants[current.operand]
+		}
+		if long, ok := longForms[current.op]; ok && current.operand > 255 {
+			current.op = long
+		}
+
+		length, _ := operandLength(current.op)
+		offsets[i+1] = offsets[i] + 1 + length + len(current.upvalues)
+	}
+
+	for i, current := range optimizer.instructions {
+		op := current.op
+		length, _ := operandLength(op)
+
+		if isJump(op) {
+			jump := offsets[current.target] - offsets[i+1]
+			if op == opcode.OP_JUMP && jump < 0 {
+				op = opcode.OP_LOOP
+			}
+			if op == opcode.OP_LOOP && jump >= 0 {
+				op = opcode.OP_JUMP
+			}
+			if op == opcode.OP_LOOP {
+				jump = -jump
+			}
+			if jump < 0 || jump > math.MaxUint16 {
+				return nil, false
+			}
+			chunk.WriteChunkAt(byte(op), current.position)
+			chunk.WriteChunkAt(byte(jump>>8), current.position)
+			chunk.WriteChunkAt(byte(jump), current.position)
+			continue
+		}
+
+		chunk.WriteChunkAt(byte(op), current.position)
+		if length == 1 {
+			chunk.WriteChunkAt(byte(current.operand), current.position)
+		} else if length == 3 {
+			chunk.WriteChunkAt(byte(current.operand), current.position)
+			chunk.WriteChunkAt(byte(current.operand>>8), current.position)
+			chunk.WriteChunkAt(byte(current.operand>>16), current.position)
+		}
+		for _, b := range current.upvalues {
+			chunk.WriteChunkAt(b, current.position)
+		}
+	}
+	return chunk, true
+}
@@ -0,0 +1,428 @@
+package chunk
+
+import (
+	"fmt"
+	"golox-lang/lib/chunk/opcode"
+	"golox-lang/lib/value"
+)
+
+// VerifyError describes the first problem Verify found in a function.
+type VerifyError struct {
+	Function string
+	Offset   int
+	Message  string
+}
+
+func (err *VerifyError) Error() string {
+	return fmt.Sprintf("Invalid bytecode in %s at offset %d: %s", err.Function, err.Offset, err.Message)
+}
+
+// Verify checks that a function and every function in its constants can be
+// run without the VM reading outside its code, constants, stack or upvalues.
+// Every opcode must be known with all of its operands present, indices must
+// be in range, including global slots against the script's GlobalNames,
+// jumps must land on an instruction and the stack depth at each instruction
+// must be the same along every path that reaches it. The kinds of the values
+// on the stack are not tracked: the VM checks those as it runs, raising a
+// runtime error for a value of the wrong kind.
+//
+// The compiler only produces valid code, so this is needed for functions
+// that come from elsewhere, such as a compiled file.
+func Verify(function *value.ObjFunction) error {
+	return verifyFunction(function, len(function.GlobalNames))
+}
+
+// frameState is what the verifier knows about a frame before an instruction
+// runs: how many values the frame has on the stack and how many exception
+// handlers it has set up.
+type frameState struct {
+	stack    int
+	handlers int
+}
+
+type verifier struct {
+	function  *value.ObjFunction
+	code      []byte
+	constants []value.Value
+	// globals is the number of global slots of the script.
+	globals int
+
+	// starts marks the offsets where an instruction begins.
+	starts []bool
+	// states holds the state on entry to each reached instruction.
+	states   []frameState
+	reached  []bool
+	worklist []int
+}
+
+func verifyFunction(function *value.ObjFunction, globals int) error {
+	chunk, ok := function.Chunk.(*Chunk)
+	if !ok {
+		return &VerifyError{Function: functionName(function), Message: "Function has no chunk."}
+	}
+
+	verifier := &verifier{
+		function:  function,
+		code:      chunk.code,
+		constants: chunk.constants.Values,
+		globals:   globals,
+		starts:    make([]bool, len(chunk.code)),
+		states:    make([]frameState, len(chunk.code)),
+		reached:   make([]bool, len(chunk.code)),
+	}
+
+	if len(chunk.code) == 0 {
+		return verifier.error(0, "Function has no code.")
+	}
+	if count := chunk.positionCount(); count != len(chunk.code) {
+		return verifier.error(0, "Expect positions for %d bytes but got %d.", len(chunk.code), count)
+	}
+	if err := verifier.decode(); err != nil {
+		return err
+	}
+	if err := verifier.flow(); err != nil {
+		return err
+	}
+
+	for _, constant := range verifier.constants {
+		if constant.IsFunction() {
+			if err := verifyFunction(constant.AsFunction(), globals); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func functionName(function *value.ObjFunction) string {
+	if function.Name == nil {
+		return "<script>"
+	}
+	return function.Name.String
+}
+
+func (verifier *verifier) error(offset int, format string, args ...interface{}) error {
+	return &VerifyError{
+		Function: functionName(verifier.function),
+		Offset:   offset,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// decode walks the code from the start, checking that every opcode is known
+// and its operands fit, and records where each instruction starts.
+func (verifier *verifier) decode() error {
+	for offset := 0; offset < len(verifier.code); {
+		length, err := verifier.instructionLength(offset)
+		if err != nil {
+			return err
+		}
+		if length > len(verifier.code)-offset {
+			return verifier.error(offset, "Operands run past the end of the code.")
+		}
+
+		verifier.starts[offset] = true
+		offset += length
+	}
+	return nil
+}
+
+// instructionLength returns the size of the instruction at offset, including
+// its opcode.
+func (verifier *verifier) instructionLength(offset int) (int, error) {
+	instruction := opcode.OpCode(verifier.code[offset])
+	operandLength, known := operandLength(instruction)
+	if !known {
+		return 0, verifier.error(offset, "Unknown opcode %d.", instruction)
+	}
+	if !isClosure(instruction) {
+		return 1 + operandLength, nil
+	}
+
+	// The upvalue pairs that follow depend on the function being closed
+	// over, so its constant has to be checked before the length is known.
+	if operandLength >= len(verifier.code)-offset {
+		return 0, verifier.error(offset, "Operands run past the end of the code.")
+	}
+
+	constant, err := verifier.constant(offset, operandLength)
+	if err != nil {
+		return 0, err
+	}
+	if !constant.IsFunction() {
+		return 0, verifier.error(offset, "Expect a function constant but got %s.", constant.String())
+	}
+	return 1 + operandLength + 2*constant.AsFunction().UpvalueCount, nil
+}
+
+// operand reads the 1 or 3 byte operand following the opcode at offset.
+func (verifier *verifier) operand(offset int, operandLength int) int {
+	if operandLength == 1 {
+		return int(verifier.code[offset+1])
+	}
+	return int(verifier.code[offset+1]) |
+		int(verifier.code[offset+2])<<8 |
+		int(verifier.code[offset+3])<<16
+}
+
+func (verifier *verifier) constant(offset int, operandLength int) (value.Value, error) {
+	index := verifier.operand(offset, operandLength)
+	if index >= len(verifier.constants) {
+		return value.Value{}, verifier.error(offset, "Constant index %d is out of range.", index)
+	}
+	return verifier.constants[index], nil
+}
+
+func (verifier *verifier) stringConstant(offset int, operandLength int) error {
+	constant, err := verifier.constant(offset, operandLength)
+	if err != nil {
+		return err
+	}
+	if !constant.IsString() {
+		return verifier.error(offset, "Expect a string constant but got %s.", constant.String())
+	}
+	return nil
+}
+
+func (verifier *verifier) global(offset int, operandLength int) error {
+	if slot := verifier.operand(offset, operandLength); slot >= verifier.globals {
+		return verifier.error(offset, "Global slot %d is out of range.", slot)
+	}
+	return nil
+}
+
+func (verifier *verifier) jumpTarget(offset int) int {
+	jump := int(verifier.code[offset+1])<<8 | int(verifier.code[offset+2])
+	if opcode.OpCode(verifier.code[offset]) == opcode.OP_LOOP {
+		return offset + 3 - jump
+	}
+	return offset + 3 + jump
+}
+
+// enter records that control can reach target with state, queueing the
+// target the first time it is reached.
+func (verifier *verifier) enter(from int, target int, state frameState) error {
+	if target < 0 || target >= len(verifier.code) {
+		if target == len(verifier.code) {
+			return verifier.error(from, "Execution runs past the end of the code.")
+		}
+		return verifier.error(from, "Jump target %d is outside the code.", target)
+	}
+	if !verifier.starts[target] {
+		return verifier.error(from, "Jump target %d is inside an instruction.", target)
+	}
+
+	if verifier.reached[target] {
+		if verifier.states[target] != state {
+			return verifier.error(target, "Inconsistent stack depth: %d and %d.", verifier.states[target].stack, state.stack)
+		}
+		return nil
+	}
+
+	verifier.reached[target] = true
+	verifier.states[target] = state
+	verifier.worklist = append(verifier.worklist, target)
+	return nil
+}
+
+// flow follows every path through the code from its start, tracking the
+// stack depth and checking each instruction against it.
+func (verifier *verifier) flow() error {
+	// Slot zero holds the callee, followed by the arguments.
+	if err := verifier.enter(0, 0, frameState{stack: verifier.function.Arity + 1}); err != nil {
+		return err
+	}
+
+	for len(verifier.worklist) > 0 {
+		offset := verifier.worklist[len(verifier.worklist)-1]
+		verifier.worklist = verifier.worklist[:len(verifier.worklist)-1]
+
+		if err := verifier.step(offset, verifier.states[offset]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// step checks the instruction at offset and passes the resulting state on to
+// each instruction that can run after it.
+func (verifier *verifier) step(offset int, state frameState) error {
+	instruction := opcode.OpCode(verifier.code[offset])
+	length, _ := verifier.instructionLength(offset)
+	next := offset + length
+
+	pops, pushes := 0, 0
+	switch instruction {
+	case opcode.OP_CONSTANT, opcode.OP_CONSTANT_LONG:
+		if _, err := verifier.constant(offset, length-1); err != nil {
+			return err
+		}
+		pushes = 1
+
+	case opcode.OP_NIL, opcode.OP_TRUE, opcode.OP_FALSE:
+		pushes = 1
+
+	case opcode.OP_POP, opcode.OP_PRINT, opcode.OP_CLOSE_UPVALUE:
+		pops = 1
+
+	case opcode.OP_GET_LOCAL, opcode.OP_GET_LOCAL_LONG, opcode.OP_SET_LOCAL, opcode.OP_SET_LOCAL_LONG:
+		if slot := verifier.operand(offset, length-1); slot >= state.stack {
+			return verifier.error(offset, "Local slot %d is out of range.", slot)
+		}
+		if instruction == opcode.OP_GET_LOCAL || instruction == opcode.OP_GET_LOCAL_LONG {
+			pushes = 1
+		} else {
+			pops, pushes = 1, 1
+		}
+
+	case opcode.OP_GET_GLOBAL, opcode.OP_GET_GLOBAL_LONG:
+		if err := verifier.global(offset, length-1); err != nil {
+			return err
+		}
+		pushes = 1
+
+	case opcode.OP_DEFINE_GLOBAL, opcode.OP_DEFINE_GLOBAL_LONG:
+		if err := verifier.global(offset, length-1); err != nil {
+			return err
+		}
+		pops = 1
+
+	case opcode.OP_SET_GLOBAL, opcode.OP_SET_GLOBAL_LONG:
+		if err := verifier.global(offset, length-1); err != nil {
+			return err
+		}
+		pops, pushes = 1, 1
+
+	case opcode.OP_GET_PROPERTY, opcode.OP_GET_PROPERTY_LONG,
+		opcode.OP_IMPORT_FROM, opcode.OP_IMPORT_FROM_LONG:
+		if err := verifier.stringConstant(offset, length-1); err != nil {
+			return err
+		}
+		pops, pushes = 1, 1
+
+	case opcode.OP_SET_PROPERTY, opcode.OP_SET_PROPERTY_LONG:
+		if err := verifier.stringConstant(offset, length-1); err != nil {
+			return err
+		}
+		pops, pushes = 2, 1
+
+	case opcode.OP_GET_SUPER:
+		if err := verifier.stringConstant(offset, length-1); err != nil {
+			return err
+		}
+		pops, pushes = 2, 1
+
+	case opcode.OP_GET_UPVALUE, opcode.OP_SET_UPVALUE:
+		if index := verifier.operand(offset, 1); index >= verifier.function.UpvalueCount {
+			return verifier.error(offset, "Upvalue index %d is out of range.", index)
+		}
+		if instruction == opcode.OP_GET_UPVALUE {
+			pushes = 1
+		} else {
+			pops, pushes = 1, 1
+		}
+
+	case opcode.OP_BUILD_LIST, opcode.OP_INTERPOLATE:
+		pops, pushes = verifier.operand(offset, 1), 1
+
+	case opcode.OP_BUILD_MAP:
+		pops, pushes = 2*verifier.operand(offset, 1), 1
+
+	case opcode.OP_EQUAL, opcode.OP_GREATER, opcode.OP_LESS, opcode.OP_ADD,
+		opcode.OP_SUBTRACT, opcode.OP_MULTIPLY, opcode.OP_DIVIDE, opcode.OP_MODULO,
+		opcode.OP_POWER, opcode.OP_GET_INDEX:
+		pops, pushes = 2, 1
+
+	case opcode.OP_SET_INDEX:
+		pops, pushes = 3, 1
+
+	case opcode.OP_NOT, opcode.OP_NEGATE:
+		pops, pushes = 1, 1
+
+	case opcode.OP_JUMP, opcode.OP_LOOP:
+		return verifier.enter(offset, verifier.jumpTarget(offset), state)
+
+	case opcode.OP_JUMP_IF_FALSE:
+		// The condition stays on the stack along both paths.
+		if state.stack < 1 {
+			return verifier.error(offset, "Stack underflow.")
+		}
+		if err := verifier.enter(offset, verifier.jumpTarget(offset), state); err != nil {
+			return err
+		}
+		return verifier.enter(offset, next, state)
+
+	case opcode.OP_SETUP_CATCH, opcode.OP_SETUP_FINALLY:
+		// The handler runs with the stack cut back to its depth here and
+		// either the exception or a completion pushed on top.
+		handler := state
+		if instruction == opcode.OP_SETUP_CATCH {
+			handler.stack++
+		} else {
+			handler.stack += 2
+		}
+		if err := verifier.enter(offset, verifier.jumpTarget(offset), handler); err != nil {
+			return err
+		}
+		state.handlers++
+		return verifier.enter(offset, next, state)
+
+	case opcode.OP_POP_HANDLER:
+		if state.handlers < 1 {
+			return verifier.error(offset, "No exception handler to pop.")
+		}
+		state.handlers--
+		return verifier.enter(offset, next, state)
+
+	case opcode.OP_END_FINALLY:
+		pops = 2
+
+	case opcode.OP_THROW, opcode.OP_RETURN:
+		if state.stack < 1 {
+			return verifier.error(offset, "Stack underflow.")
+		}
+		return nil
+
+	case opcode.OP_CALL:
+		pops, pushes = verifier.operand(offset, 1)+1, 1
+
+	case opcode.OP_CLOSURE, opcode.OP_CLOSURE_LONG:
+		operandLength := 1
+		if instruction == opcode.OP_CLOSURE_LONG {
+			operandLength = 3
+		}
+		for i := offset + 1 + operandLength; i < next; i += 2 {
+			isLocal, index := verifier.code[i], int(verifier.code[i+1])
+			switch {
+			case isLocal > 1:
+				return verifier.error(offset, "Invalid upvalue kind %d.", isLocal)
+			case isLocal == 1 && index >= state.stack:
+				return verifier.error(offset, "Captured local slot %d is out of range.", index)
+			case isLocal == 0 && index >= verifier.function.UpvalueCount:
+				return verifier.error(offset, "Captured upvalue index %d is out of range.", index)
+			}
+		}
+		pushes = 1
+
+	case opcode.OP_CLASS, opcode.OP_CLASS_LONG, opcode.OP_IMPORT, opcode.OP_IMPORT_LONG:
+		if err := verifier.stringConstant(offset, length-1); err != nil {
+			return err
+		}
+		pushes = 1
+
+	case opcode.OP_INHERIT:
+		pops, pushes = 2, 1
+
+	case opcode.OP_METHOD, opcode.OP_METHOD_LONG:
+		if err := verifier.stringConstant(offset, length-1); err != nil {
+			return err
+		}
+		pops, pushes = 2, 1
+	}
+
+	if state.stack < pops {
+		return verifier.error(offset, "Stack underflow.")
+	}
+	state.stack += pushes - pops
+	return verifier.enter(offset, next, state)
+}
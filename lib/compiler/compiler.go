@@ -7,13 +7,16 @@ import (
 	"golox-lang/lib/compiler/precedence"
 	"golox-lang/lib/config"
 	"golox-lang/lib/debug"
+	"golox-lang/lib/diagnostic"
 	"golox-lang/lib/scanner"
 	"golox-lang/lib/scanner/token"
 	"golox-lang/lib/scanner/token/tokentype"
 	"golox-lang/lib/value"
-	"golox-lang/lib/value/valuetype"
+	"io"
+	"math"
 	"os"
 	"strconv"
+	"unicode/utf8"
 )
 
 type Parser struct {
@@ -23,8 +26,61 @@ type Parser struct {
 	PanicMode       bool
 	CurrentCompiler *Compiler
 	CurrentClass    *ClassCompiler
-
-	scanner *scanner.Scanner
+	Errors          []CompileError
+
+	scanner     *scanner.Scanner
+	source      *value.Source
+	errorWriter io.Writer
+	debugWriter io.Writer
+	diagnostics diagnostic.Sink
+	noOptimize  bool
+
+	// globals maps the name of each global the script refers to to its
+	// index in globalNames.
+	globals     map[string]int
+	globalNames []string
+}
+
+type Options struct {
+	// ErrorWriter receives compile errors as they are reported, it may be
+	// nil when the caller only wants the returned errors.
+	ErrorWriter io.Writer
+	// DebugWriter receives the disassembly printed when DEBUG_PRINT_CODE is
+	// on, it defaults to os.Stdout.
+	DebugWriter io.Writer
+	// Diagnostics, when set, is sent every compile error.
+	Diagnostics diagnostic.Sink
+	// NoOptimize turns off chunk.Optimize, so the bytecode follows the
+	// source one to one when debugging the compiler.
+	NoOptimize bool
+	// Path is the file the source was read from, used in error messages.
+	Path string
+}
+
+type CompileError struct {
+	Path    string
+	Line    int
+	Column  int
+	Where   string
+	Message string
+	// Excerpt quotes the source line with the offending token underlined.
+	Excerpt string
+}
+
+func (err CompileError) Error() string {
+	return err.Diagnostic().String()
+}
+
+func (err CompileError) Diagnostic() diagnostic.Diagnostic {
+	return diagnostic.Diagnostic{
+		Kind:    diagnostic.COMPILE_ERROR,
+		Message: err.Message,
+		Path:    err.Path,
+		Line:    err.Line,
+		Column:  err.Column,
+		Where:   err.Where,
+		Excerpt: err.Excerpt,
+	}
 }
 
 type Compiler struct {
@@ -33,6 +89,7 @@ type Compiler struct {
 	funcType  FunctionType
 
 	Locals     []Local
+	Upvalues   []Upvalue
 	ScopeDepth int
 }
 
@@ -42,8 +99,14 @@ type ClassCompiler struct {
 }
 
 type Local struct {
-	Name  token.Token
-	depth int
+	Name       token.Token
+	depth      int
+	IsCaptured bool
+}
+
+type Upvalue struct {
+	Index   byte
+	IsLocal bool
 }
 
 type FunctionType byte
@@ -70,6 +133,8 @@ func New(scanner *scanner.Scanner) *Parser {
 	parser.HadError = false
 	parser.PanicMode = false
 	parser.scanner = scanner
+	parser.source = &value.Source{Text: scanner.Source}
+	parser.globals = make(map[string]int)
 
 	return parser
 }
@@ -78,11 +143,15 @@ func init() {
 	rules = make(map[tokentype.TokenType]ParseRule)
 	rules[tokentype.TOKEN_LEFT_PAREN] = ParseRule{(*Parser).grouping, (*Parser).call, precedence.PREC_CALL}
 	rules[tokentype.TOKEN_RIGHT_PAREN] = ParseRule{nil, nil, precedence.PREC_NONE}
-	rules[tokentype.TOKEN_LEFT_BRACE] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_LEFT_BRACE] = ParseRule{(*Parser).map_, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_RIGHT_BRACE] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_LEFT_BRACKET] = ParseRule{(*Parser).list, (*Parser).subscript, precedence.PREC_CALL}
+	rules[tokentype.TOKEN_RIGHT_BRACKET] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_COLON] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_COMMA] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_DOT] = ParseRule{nil, (*Parser).dot, precedence.PREC_CALL}
 	rules[tokentype.TOKEN_MINUS] = ParseRule{(*Parser).unary, (*Parser).binary, precedence.PREC_TERM}
+	rules[tokentype.TOKEN_PERCENT] = ParseRule{nil, (*Parser).binary, precedence.PREC_FACTOR}
 	rules[tokentype.TOKEN_PLUS] = ParseRule{nil, (*Parser).binary, precedence.PREC_TERM}
 	rules[tokentype.TOKEN_SEMICOLON] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_SLASH] = ParseRule{nil, (*Parser).binary, precedence.PREC_FACTOR}
@@ -95,23 +164,32 @@ func init() {
 	rules[tokentype.TOKEN_GREATER_EQUAL] = ParseRule{nil, (*Parser).binary, precedence.PREC_COMPARISON}
 	rules[tokentype.TOKEN_LESS] = ParseRule{nil, (*Parser).binary, precedence.PREC_COMPARISON}
 	rules[tokentype.TOKEN_LESS_EQUAL] = ParseRule{nil, (*Parser).binary, precedence.PREC_COMPARISON}
+	rules[tokentype.TOKEN_STAR_STAR] = ParseRule{nil, (*Parser).binary, precedence.PREC_POWER}
 	rules[tokentype.TOKEN_IDENTIFIER] = ParseRule{(*Parser).variable, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_STRING] = ParseRule{(*Parser).string_, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_INTERPOLATION] = ParseRule{(*Parser).interpolation, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_NUMBER] = ParseRule{(*Parser).number, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_AND] = ParseRule{nil, (*Parser).and_, precedence.PREC_AND}
+	rules[tokentype.TOKEN_AS] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_CATCH] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_CLASS] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_ELSE] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_FALSE] = ParseRule{(*Parser).literal, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_FINALLY] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_FOR] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_FROM] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_FUN] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_IF] = ParseRule{nil, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_IMPORT] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_NIL] = ParseRule{(*Parser).literal, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_OR] = ParseRule{nil, (*Parser).or, precedence.PREC_OR}
 	rules[tokentype.TOKEN_PRINT] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_RETURN] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_SUPER] = ParseRule{(*Parser).super, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_THIS] = ParseRule{(*Parser).this, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_THROW] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_TRUE] = ParseRule{(*Parser).literal, nil, precedence.PREC_NONE}
+	rules[tokentype.TOKEN_TRY] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_VAR] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_WHILE] = ParseRule{nil, nil, precedence.PREC_NONE}
 	rules[tokentype.TOKEN_ERROR] = ParseRule{nil, nil, precedence.PREC_NONE}
@@ -119,9 +197,22 @@ func init() {
 }
 
 func Compile(source string) *value.ObjFunction {
+	function, _ := CompileWithOptions(source, Options{ErrorWriter: os.Stderr})
+	return function
+}
+
+func CompileWithOptions(source string, options Options) (*value.ObjFunction, []CompileError) {
 	scanner := scanner.New(source)
 
 	parser := New(scanner)
+	parser.source.Path = options.Path
+	parser.errorWriter = options.ErrorWriter
+	parser.debugWriter = options.DebugWriter
+	if parser.debugWriter == nil {
+		parser.debugWriter = os.Stdout
+	}
+	parser.diagnostics = options.Diagnostics
+	parser.noOptimize = options.NoOptimize
 	parser.initCompiler(TYPE_SCRIPT)
 
 	parser.advance()
@@ -131,20 +222,23 @@ func Compile(source string) *value.ObjFunction {
 	}
 
 	function := parser.endCompiler()
+	function.GlobalNames = parser.globalNames
 
 	if parser.HadError {
-		return nil
+		return nil, parser.Errors
 	}
-	return function
+	return function, nil
 }
 
 func (parser *Parser) initCompiler(funcType FunctionType) *Compiler {
 	compiler := new(Compiler)
 	compiler.enclosing = parser.CurrentCompiler
 	compiler.function = value.NewFunction(chunk.New())
+	compiler.function.Source = parser.source
 	compiler.funcType = funcType
 	compiler.ScopeDepth = 0
 	compiler.Locals = make([]Local, 0)
+	compiler.Upvalues = make([]Upvalue, 0)
 
 	parser.CurrentCompiler = compiler
 
@@ -199,7 +293,19 @@ func (parser *Parser) match(tokenType tokentype.TokenType) bool {
 }
 
 func (parser *Parser) emitByte(b byte) {
-	parser.currentChunk().WriteChunk(b, parser.Previous.Line)
+	parser.emitAt(&parser.Previous, b)
+}
+
+// emitAt emits bytes as compiled from tkn, which is where runtime errors in
+// them are reported.
+func (parser *Parser) emitAt(tkn *token.Token, bytes ...byte) {
+	for _, b := range bytes {
+		parser.currentChunk().WriteChunkAt(b, positionOf(tkn))
+	}
+}
+
+func positionOf(tkn *token.Token) chunk.Position {
+	return chunk.Position{Line: tkn.Line, Column: tkn.Column}
 }
 
 func (parser *Parser) emitBytes(b1 byte, b2 byte) {
@@ -235,7 +341,7 @@ func (parser *Parser) emitReturn() {
 }
 
 func (parser *Parser) emitConstant(value value.Value) {
-	parser.currentChunk().WriteConstant(value, parser.Previous.Line)
+	parser.currentChunk().WriteConstantAt(value, positionOf(&parser.Previous))
 }
 
 func (parser *Parser) patchJump(offset int) {
@@ -250,10 +356,20 @@ func (parser *Parser) patchJump(offset int) {
 	parser.currentChunk().GetCode()[offset+1] = byte(jump & 0xff)
 }
 
+func (parser *Parser) patchNoop(offset int) {
+	parser.currentChunk().GetCode()[offset-1] = byte(opcode.OP_JUMP)
+	parser.currentChunk().GetCode()[offset] = 0
+	parser.currentChunk().GetCode()[offset+1] = 0
+}
+
 func (parser *Parser) endCompiler() *value.ObjFunction {
 	parser.emitReturn()
 	function := parser.CurrentCompiler.function
 
+	if !parser.HadError && !parser.noOptimize {
+		chunk.Optimize(function)
+	}
+
 	if config.DEBUG_PRINT_CODE {
 		if !parser.HadError {
 			var name string
@@ -262,7 +378,7 @@ func (parser *Parser) endCompiler() *value.ObjFunction {
 			} else {
 				name = "<script>"
 			}
-			debug.DisassembleChunk(parser.currentChunk(), name)
+			debug.FdisassembleChunk(parser.debugWriter, parser.currentChunk(), name)
 		}
 	}
 
@@ -278,48 +394,65 @@ func (parser *Parser) endScope() {
 	parser.CurrentCompiler.ScopeDepth--
 
 	for len(parser.CurrentCompiler.Locals) > 0 && parser.CurrentCompiler.Locals[len(parser.CurrentCompiler.Locals)-1].depth > parser.CurrentCompiler.ScopeDepth {
-		parser.emitByte(byte(opcode.OP_POP))
+		if parser.CurrentCompiler.Locals[len(parser.CurrentCompiler.Locals)-1].IsCaptured {
+			parser.emitByte(byte(opcode.OP_CLOSE_UPVALUE))
+		} else {
+			parser.emitByte(byte(opcode.OP_POP))
+		}
 		parser.CurrentCompiler.Locals = parser.CurrentCompiler.Locals[:len(parser.CurrentCompiler.Locals)-1]
 	}
 }
 
 func (parser *Parser) binary(canAssign bool) {
-	operatorType := parser.Previous.Type
+	operator := parser.Previous
+	operatorType := operator.Type
 
 	// Compile the right operand
 	rule := parser.getRule(operatorType)
-	parser.parsePrecedence(precedence.Precedence(rule.Precedence + 1))
+	if operatorType == tokentype.TOKEN_STAR_STAR {
+		// Power is right-associative and binds tighter than a unary operator
+		// on its left, so -2 ** 2 is -(2 ** 2) while 2 ** -1 still parses.
+		parser.parsePrecedence(precedence.PREC_UNARY)
+	} else {
+		parser.parsePrecedence(precedence.Precedence(rule.Precedence + 1))
+	}
 
 	switch operatorType {
 	case tokentype.TOKEN_BANG_EQUAL:
-		parser.emitBytes(byte(opcode.OP_EQUAL), byte(opcode.OP_NOT))
+		parser.emitAt(&operator, byte(opcode.OP_EQUAL), byte(opcode.OP_NOT))
 
 	case tokentype.TOKEN_EQUAL_EQUAL:
-		parser.emitByte(byte(opcode.OP_EQUAL))
+		parser.emitAt(&operator, byte(opcode.OP_EQUAL))
 
 	case tokentype.TOKEN_GREATER:
-		parser.emitByte(byte(opcode.OP_GREATER))
+		parser.emitAt(&operator, byte(opcode.OP_GREATER))
 
 	case tokentype.TOKEN_GREATER_EQUAL:
-		parser.emitBytes(byte(opcode.OP_LESS), byte(opcode.OP_NOT))
+		parser.emitAt(&operator, byte(opcode.OP_LESS), byte(opcode.OP_NOT))
 
 	case tokentype.TOKEN_LESS:
-		parser.emitByte(byte(opcode.OP_LESS))
+		parser.emitAt(&operator, byte(opcode.OP_LESS))
 
 	case tokentype.TOKEN_LESS_EQUAL:
-		parser.emitBytes(byte(opcode.OP_GREATER), byte(opcode.OP_NOT))
+		parser.emitAt(&operator, byte(opcode.OP_GREATER), byte(opcode.OP_NOT))
 
 	case tokentype.TOKEN_PLUS:
-		parser.emitByte(byte(opcode.OP_ADD))
+		parser.emitAt(&operator, byte(opcode.OP_ADD))
 
 	case tokentype.TOKEN_MINUS:
-		parser.emitBytes(byte(opcode.OP_NEGATE), byte(opcode.OP_ADD))
+		parser.emitAt(&operator, byte(opcode.OP_SUBTRACT))
 
 	case tokentype.TOKEN_STAR:
-		parser.emitByte(byte(opcode.OP_MULTIPLY))
+		parser.emitAt(&operator, byte(opcode.OP_MULTIPLY))
 
 	case tokentype.TOKEN_SLASH:
-		parser.emitByte(byte(opcode.OP_DIVIDE))
+		parser.emitAt(&operator, byte(opcode.OP_DIVIDE))
+
+	case tokentype.TOKEN_PERCENT:
+		parser.emitAt(&operator, byte(opcode.OP_MODULO))
+
+	case tokentype.TOKEN_STAR_STAR:
+		parser.emitAt(&operator, byte(opcode.OP_POWER))
 
 	default:
 		return
@@ -343,6 +476,60 @@ func (parser *Parser) dot(canAssign bool) {
 	}
 }
 
+func (parser *Parser) subscript(canAssign bool) {
+	parser.expression()
+	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after index.")
+
+	if canAssign && parser.match(tokentype.TOKEN_EQUAL) {
+		parser.expression()
+		parser.emitByte(byte(opcode.OP_SET_INDEX))
+	} else {
+		parser.emitByte(byte(opcode.OP_GET_INDEX))
+	}
+}
+
+func (parser *Parser) list(canAssign bool) {
+	var itemCount int = 0
+	if !parser.check(tokentype.TOKEN_RIGHT_BRACKET) {
+		for {
+			parser.expression()
+
+			if itemCount == 255 {
+				parser.error("Cant have more than 255 items in a list literal.")
+			}
+			itemCount++
+			if !parser.match(tokentype.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_BRACKET, "Expect ']' after list items.")
+	parser.emitBytes(byte(opcode.OP_BUILD_LIST), byte(itemCount))
+}
+
+func (parser *Parser) map_(canAssign bool) {
+	var entryCount int = 0
+	if !parser.check(tokentype.TOKEN_RIGHT_BRACE) {
+		for {
+			parser.expression()
+			parser.consume(tokentype.TOKEN_COLON, "Expect ':' after map key.")
+			parser.expression()
+
+			if entryCount == 255 {
+				parser.error("Cant have more than 255 entries in a map literal.")
+			}
+			entryCount++
+			if !parser.match(tokentype.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after map entries.")
+	parser.emitBytes(byte(opcode.OP_BUILD_MAP), byte(entryCount))
+}
+
 func (parser *Parser) literal(canAssign bool) {
 	switch parser.Previous.Type {
 	case tokentype.TOKEN_FALSE:
@@ -365,10 +552,44 @@ func (parser *Parser) grouping(canAssign bool) {
 }
 
 func (parser *Parser) number(canAssign bool) {
-	val, err := strconv.ParseFloat(parser.Previous.Lexeme, 64)
-	if err != nil {
+	val := parseNumber(parser.Previous.Literal)
+	if math.IsInf(val, 0) {
+		parser.error("Number literal is too large.")
+	}
+	parser.emitConstant(value.NumberValue(val))
+}
+
+// parseNumber returns the value of a number literal as scanned, with a 0x,
+// 0b or 0o prefix for other bases than 10.
+func parseNumber(literal string) float64 {
+	base := 10
+	if len(literal) > 2 && literal[0] == '0' {
+		switch literal[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+	}
+	if base == 10 {
+		val, _ := strconv.ParseFloat(literal, 64)
+		return val
+	}
+
+	digits := literal[2:]
+	if n, err := strconv.ParseUint(digits, base, 64); err == nil {
+		return float64(n)
 	}
-	parser.emitConstant(value.New(valuetype.VAL_NUMBER, val))
+
+	// Too large for 64 bits, the digits are added up as a float instead.
+	var val float64
+	for _, digit := range digits {
+		n, _ := strconv.ParseUint(string(digit), base, 8)
+		val = val*float64(base) + float64(n)
+	}
+	return val
 }
 
 func (parser *Parser) or(canAssign bool) {
@@ -383,22 +604,62 @@ func (parser *Parser) or(canAssign bool) {
 }
 
 func (parser *Parser) string_(canAssign bool) {
-	parser.emitConstant(
-		value.NewObjString(parser.Previous.Lexeme[1 : len(parser.Previous.Lexeme)-1]))
+	parser.emitConstant(value.NewObjString(parser.Previous.Literal))
+}
+
+// interpolation compiles a string with interpolated expressions, starting
+// from the text before the first one. The text and the value of each
+// expression are joined by OP_INTERPOLATE, leaving out empty text.
+func (parser *Parser) interpolation(canAssign bool) {
+	partCount := 0
+	for {
+		if parser.Previous.Literal != "" {
+			parser.string_(false)
+			partCount++
+		}
+		parser.expression()
+		partCount++
+		parser.consume(tokentype.TOKEN_RIGHT_BRACE, "Expect '}' after interpolated expression.")
+
+		if !parser.match(tokentype.TOKEN_INTERPOLATION) {
+			break
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_STRING, "Expect end of string after interpolation.")
+	if parser.Previous.Literal != "" {
+		parser.string_(false)
+		partCount++
+	}
+
+	if partCount > 255 {
+		parser.error("Can't have more than 255 parts in an interpolated string.")
+	}
+	parser.emitBytes(byte(opcode.OP_INTERPOLATE), byte(partCount))
 }
 
 func (parser *Parser) namedVariable(name token.Token, canAssign bool) {
 	var getOp, setOp opcode.OpCode
 	var getOpLong, setOpLong opcode.OpCode
-	arg := parser.resolveLocal(&name)
+	arg := parser.resolveLocal(parser.CurrentCompiler, &name)
 
 	if arg != -1 {
 		getOp = opcode.OP_GET_LOCAL
 		setOp = opcode.OP_SET_LOCAL
 		getOpLong = opcode.OP_GET_LOCAL_LONG
 		setOpLong = opcode.OP_SET_LOCAL_LONG
+	} else if arg = parser.resolveUpvalue(parser.CurrentCompiler, &name); arg != -1 {
+		// A function has at most 256 upvalues, so they always take a one
+		// byte operand.
+		if canAssign && parser.match(tokentype.TOKEN_EQUAL) {
+			parser.expression()
+			parser.emitBytes(byte(opcode.OP_SET_UPVALUE), byte(arg))
+		} else {
+			parser.emitBytes(byte(opcode.OP_GET_UPVALUE), byte(arg))
+		}
+		return
 	} else {
-		arg = parser.identifierConstant(&name)
+		arg = parser.globalSlot(&name)
 		getOp = opcode.OP_GET_GLOBAL
 		setOp = opcode.OP_SET_GLOBAL
 		getOpLong = opcode.OP_GET_GLOBAL_LONG
@@ -458,17 +719,18 @@ func (parser *Parser) this(canAssign bool) {
 }
 
 func (parser *Parser) unary(canAssign bool) {
-	operatorType := parser.Previous.Type
+	operator := parser.Previous
+	operatorType := operator.Type
 
 	// Compile the operand
 	parser.parsePrecedence(precedence.PREC_UNARY)
 
 	switch operatorType {
 	case tokentype.TOKEN_BANG:
-		parser.emitByte(byte(opcode.OP_NOT))
+		parser.emitAt(&operator, byte(opcode.OP_NOT))
 
 	case tokentype.TOKEN_MINUS:
-		parser.emitByte(byte(opcode.OP_NEGATE))
+		parser.emitAt(&operator, byte(opcode.OP_NEGATE))
 
 	default:
 		return
@@ -501,9 +763,23 @@ func (parser *Parser) identifierConstant(name *token.Token) int {
 	return parser.currentChunk().AddConstant(value.NewObjString(name.Lexeme))
 }
 
-func (parser *Parser) resolveLocal(name *token.Token) int {
-	for i := len(parser.CurrentCompiler.Locals) - 1; i >= 0; i-- {
-		local := &parser.CurrentCompiler.Locals[i]
+// globalSlot returns the index of the global variable called name, giving it
+// the next one the first time the script refers to it. The VM links the
+// indices to its variables by name when the script is loaded, so a global may
+// be used in a function before the line defining it has run.
+func (parser *Parser) globalSlot(name *token.Token) int {
+	slot, present := parser.globals[name.Lexeme]
+	if !present {
+		slot = len(parser.globalNames)
+		parser.globals[name.Lexeme] = slot
+		parser.globalNames = append(parser.globalNames, name.Lexeme)
+	}
+	return slot
+}
+
+func (parser *Parser) resolveLocal(compiler *Compiler, name *token.Token) int {
+	for i := len(compiler.Locals) - 1; i >= 0; i-- {
+		local := &compiler.Locals[i]
 		if name.Lexeme == local.Name.Lexeme {
 			if local.depth == -1 {
 				parser.error("Cannot read local variable in its own initializer.")
@@ -515,6 +791,46 @@ func (parser *Parser) resolveLocal(name *token.Token) int {
 	return -1
 }
 
+func (parser *Parser) addUpvalue(compiler *Compiler, index int, isLocal bool) int {
+	for i, upvalue := range compiler.Upvalues {
+		if int(upvalue.Index) == index && upvalue.IsLocal == isLocal {
+			return i
+		}
+	}
+
+	if len(compiler.Upvalues) == 256 {
+		parser.error("Too many closure variables in function.")
+		return 0
+	}
+	if index > 255 {
+		parser.error("Can't capture a local variable past the first 256 slots.")
+		return 0
+	}
+
+	compiler.Upvalues = append(compiler.Upvalues, Upvalue{Index: byte(index), IsLocal: isLocal})
+	compiler.function.UpvalueCount = len(compiler.Upvalues)
+	return len(compiler.Upvalues) - 1
+}
+
+func (parser *Parser) resolveUpvalue(compiler *Compiler, name *token.Token) int {
+	if compiler.enclosing == nil {
+		return -1
+	}
+
+	local := parser.resolveLocal(compiler.enclosing, name)
+	if local != -1 {
+		compiler.enclosing.Locals[local].IsCaptured = true
+		return parser.addUpvalue(compiler, local, true)
+	}
+
+	upvalue := parser.resolveUpvalue(compiler.enclosing, name)
+	if upvalue != -1 {
+		return parser.addUpvalue(compiler, upvalue, false)
+	}
+
+	return -1
+}
+
 func (parser *Parser) addLocal(name token.Token) {
 	local := Local{Name: name, depth: -1}
 	parser.CurrentCompiler.Locals = append(parser.CurrentCompiler.Locals, local)
@@ -548,7 +864,7 @@ func (parser *Parser) parserVariable(errorMessage string) int {
 		return 0
 	}
 
-	return parser.identifierConstant(&parser.Previous)
+	return parser.globalSlot(&parser.Previous)
 }
 
 func (parser *Parser) markInitialized() {
@@ -641,8 +957,19 @@ func (parser *Parser) function(funcType FunctionType) {
 	parser.block()
 
 	// Create the function object.
+	compiler := parser.CurrentCompiler
 	function := parser.endCompiler()
-	parser.emitConstant(value.NewObjFunction(function))
+	constant := parser.currentChunk().AddConstant(value.NewObjFunction(function))
+	parser.emitLongOrShort(constant, byte(opcode.OP_CLOSURE), byte(opcode.OP_CLOSURE_LONG))
+
+	for _, upvalue := range compiler.Upvalues {
+		if upvalue.IsLocal {
+			parser.emitByte(1)
+		} else {
+			parser.emitByte(0)
+		}
+		parser.emitByte(upvalue.Index)
+	}
 }
 
 func (parser *Parser) method() {
@@ -666,7 +993,11 @@ func (parser *Parser) classDeclaration() {
 
 	parser.emitLongOrShort(nameConstant, byte(opcode.OP_CLASS), byte(opcode.OP_CLASS_LONG))
 
-	parser.defineVariable(nameConstant)
+	global := 0
+	if parser.CurrentCompiler.ScopeDepth == 0 {
+		global = parser.globalSlot(&className)
+	}
+	parser.defineVariable(global)
 
 	var classCompiler ClassCompiler
 	classCompiler.HasSuperClass = false
@@ -714,6 +1045,43 @@ func (parser *Parser) funDeclaration() {
 	parser.defineVariable(global)
 }
 
+func (parser *Parser) modulePath(errorMessage string) int {
+	parser.consume(tokentype.TOKEN_STRING, errorMessage)
+	return parser.currentChunk().AddConstant(value.NewObjString(parser.Previous.Literal))
+}
+
+func (parser *Parser) importDeclaration() {
+	path := parser.modulePath("Expect module path after 'import'.")
+	parser.consume(tokentype.TOKEN_AS, "Expect 'as' after module path.")
+	global := parser.parserVariable("Expect module name after 'as'.")
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after import.")
+
+	parser.emitLongOrShort(path, byte(opcode.OP_IMPORT), byte(opcode.OP_IMPORT_LONG))
+	parser.defineVariable(global)
+}
+
+func (parser *Parser) fromImportDeclaration() {
+	path := parser.modulePath("Expect module path after 'from'.")
+	parser.consume(tokentype.TOKEN_IMPORT, "Expect 'import' after module path.")
+
+	for {
+		global := parser.parserVariable("Expect name to import.")
+		name := parser.identifierConstant(&parser.Previous)
+
+		// Modules are cached after the first import, so reloading it for
+		// every name is cheap and keeps the stack free of temporaries.
+		parser.emitLongOrShort(path, byte(opcode.OP_IMPORT), byte(opcode.OP_IMPORT_LONG))
+		parser.emitLongOrShort(name, byte(opcode.OP_IMPORT_FROM), byte(opcode.OP_IMPORT_FROM_LONG))
+		parser.defineVariable(global)
+
+		if !parser.match(tokentype.TOKEN_COMMA) {
+			break
+		}
+	}
+
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after import.")
+}
+
 func (parser *Parser) varDeclaration() {
 	global := parser.parserVariable("Expect variable name.")
 
@@ -827,6 +1195,82 @@ func (parser *Parser) returnStatement() {
 	}
 }
 
+func (parser *Parser) throwStatement() {
+	keyword := parser.Previous
+	parser.expression()
+	parser.consume(tokentype.TOKEN_SEMICOLON, "Expect ';' after thrown value.")
+	parser.emitAt(&keyword, byte(opcode.OP_THROW))
+}
+
+func (parser *Parser) tryStatement() {
+	// Whether the statement has a catch or finally clause is only known once
+	// the try block has been compiled, so both handlers are set up front and
+	// turned into no-op jumps when their clause is missing.
+	finallySetup := parser.emitJump(opcode.OP_SETUP_FINALLY)
+	catchSetup := parser.emitJump(opcode.OP_SETUP_CATCH)
+
+	parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' after 'try'.")
+	parser.beginScope()
+	parser.block()
+	parser.endScope()
+
+	if !parser.check(tokentype.TOKEN_CATCH) && !parser.check(tokentype.TOKEN_FINALLY) {
+		parser.errorAtCurrent("Expect 'catch' or 'finally' after try block.")
+	}
+
+	if parser.match(tokentype.TOKEN_CATCH) {
+		parser.emitByte(byte(opcode.OP_POP_HANDLER))
+		endJump := parser.emitJump(opcode.OP_JUMP)
+		parser.patchJump(catchSetup)
+
+		// The VM pushes the thrown value, which becomes the catch variable.
+		parser.beginScope()
+		parser.consume(tokentype.TOKEN_LEFT_PAREN, "Expect '(' after 'catch'.")
+		parser.consume(tokentype.TOKEN_IDENTIFIER, "Expect exception variable name.")
+		parser.declareVariable()
+		parser.markInitialized()
+		parser.consume(tokentype.TOKEN_RIGHT_PAREN, "Expect ')' after exception variable.")
+
+		parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' after catch clause.")
+		parser.beginScope()
+		parser.block()
+		parser.endScope()
+		parser.endScope()
+
+		parser.patchJump(endJump)
+	} else {
+		parser.patchNoop(catchSetup)
+	}
+
+	if parser.match(tokentype.TOKEN_FINALLY) {
+		parser.emitByte(byte(opcode.OP_POP_HANDLER))
+
+		// The finally block runs with the completion on the stack: the
+		// pending value and a flag telling OP_END_FINALLY whether to carry on,
+		// rethrow or return. Normal completion uses nil for both.
+		parser.emitBytes(byte(opcode.OP_NIL), byte(opcode.OP_NIL))
+		parser.patchJump(finallySetup)
+
+		parser.beginScope()
+		parser.addLocal(parser.syntheticToken(""))
+		parser.addLocal(parser.syntheticToken(""))
+		parser.markInitialized()
+		parser.CurrentCompiler.Locals[len(parser.CurrentCompiler.Locals)-2].depth = parser.CurrentCompiler.ScopeDepth
+
+		parser.consume(tokentype.TOKEN_LEFT_BRACE, "Expect '{' after 'finally'.")
+		parser.beginScope()
+		parser.block()
+		parser.endScope()
+
+		// OP_END_FINALLY consumes the completion itself.
+		parser.CurrentCompiler.ScopeDepth--
+		parser.CurrentCompiler.Locals = parser.CurrentCompiler.Locals[:len(parser.CurrentCompiler.Locals)-2]
+		parser.emitByte(byte(opcode.OP_END_FINALLY))
+	} else {
+		parser.patchNoop(finallySetup)
+	}
+}
+
 func (parser *Parser) whileStatement() {
 	loopStart := len(parser.currentChunk().GetCode())
 
@@ -853,14 +1297,10 @@ func (parser *Parser) synchronize() {
 		}
 
 		switch parser.Current.Type {
-		case tokentype.TOKEN_CLASS:
-		case tokentype.TOKEN_FUN:
-		case tokentype.TOKEN_VAR:
-		case tokentype.TOKEN_FOR:
-		case tokentype.TOKEN_IF:
-		case tokentype.TOKEN_WHILE:
-		case tokentype.TOKEN_PRINT:
-		case tokentype.TOKEN_RETURN:
+		case tokentype.TOKEN_CLASS, tokentype.TOKEN_FUN, tokentype.TOKEN_VAR,
+			tokentype.TOKEN_IMPORT, tokentype.TOKEN_FROM, tokentype.TOKEN_FOR,
+			tokentype.TOKEN_IF, tokentype.TOKEN_WHILE, tokentype.TOKEN_PRINT,
+			tokentype.TOKEN_RETURN, tokentype.TOKEN_THROW, tokentype.TOKEN_TRY:
 			return
 
 		default:
@@ -879,6 +1319,10 @@ func (parser *Parser) declaration() {
 		parser.funDeclaration()
 	} else if parser.match(tokentype.TOKEN_VAR) {
 		parser.varDeclaration()
+	} else if parser.match(tokentype.TOKEN_IMPORT) {
+		parser.importDeclaration()
+	} else if parser.match(tokentype.TOKEN_FROM) {
+		parser.fromImportDeclaration()
 	} else {
 		parser.statement()
 	}
@@ -897,6 +1341,10 @@ func (parser *Parser) statement() {
 		parser.ifStatement()
 	} else if parser.match(tokentype.TOKEN_RETURN) {
 		parser.returnStatement()
+	} else if parser.match(tokentype.TOKEN_THROW) {
+		parser.throwStatement()
+	} else if parser.match(tokentype.TOKEN_TRY) {
+		parser.tryStatement()
 	} else if parser.match(tokentype.TOKEN_WHILE) {
 		parser.whileStatement()
 	} else if parser.match(tokentype.TOKEN_LEFT_BRACE) {
@@ -918,17 +1366,26 @@ func (parser *Parser) errorAt(token *token.Token, message string) {
 	}
 	parser.PanicMode = true
 
-	fmt.Fprintf(os.Stderr, "[line %d] Error", token.Line)
+	err := CompileError{Path: parser.source.Path, Line: token.Line, Column: token.Column, Message: message}
 
+	width := utf8.RuneCountInString(token.Lexeme)
 	if token.Type == tokentype.TOKEN_EOF {
-		fmt.Fprintf(os.Stderr, " at end")
+		err.Where = " at end"
 	} else if token.Type == tokentype.TOKEN_ERROR {
-
+		// The lexeme is the message, the carets mark where scanning failed.
+		width = 1
 	} else {
-		fmt.Fprintf(os.Stderr, " at %s", token.Lexeme)
+		err.Where = fmt.Sprintf(" at %s", token.Lexeme)
 	}
+	err.Excerpt = diagnostic.Excerpt(parser.source.Text, token.Offset, width)
 
-	fmt.Fprintf(os.Stderr, ": %s\n", message)
+	if parser.errorWriter != nil {
+		fmt.Fprintf(parser.errorWriter, "%s\n", err.Error())
+	}
+	if parser.diagnostics != nil {
+		parser.diagnostics.Report(err.Diagnostic())
+	}
+	parser.Errors = append(parser.Errors, err)
 	parser.HadError = true
 }
 
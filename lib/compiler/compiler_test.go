@@ -1,7 +1,229 @@
 package compiler
 
-import "testing"
+import (
+	"golox-lang/lib/chunk"
+	"golox-lang/lib/chunk/opcode"
+	"golox-lang/lib/value"
+	"testing"
+)
 
 func TestCompile(t *testing.T) {
 
 }
+
+func containsOpCode(code []byte, op opcode.OpCode) bool {
+	for _, b := range code {
+		if opcode.OpCode(b) == op {
+			return true
+		}
+	}
+	return false
+}
+
+func findFunctionConstant(function *value.ObjFunction) *value.ObjFunction {
+	for _, val := range function.Chunk.GetConstants().Values {
+		if val.IsFunction() {
+			return val.AsFunction()
+		}
+	}
+	return nil
+}
+
+func TestCompileClosure(t *testing.T) {
+	script := Compile("fun outer() { var x = 1; fun inner() { x = x + 1; return x; } return inner; }")
+	if script == nil {
+		t.Fatalf("compiler.Compile(...) failed, expected a function, got nil")
+	}
+	if !containsOpCode(script.Chunk.GetCode(), opcode.OP_CLOSURE) {
+		t.Errorf("compiler.Compile(...) failed, expected script to emit %v", opcode.OP_CLOSURE)
+	}
+
+	outer := findFunctionConstant(script)
+	inner := findFunctionConstant(outer)
+	if inner == nil {
+		t.Fatalf("compiler.Compile(...) failed, expected outer to contain the inner function")
+	}
+
+	if inner.UpvalueCount != 1 {
+		t.Errorf("compiler.Compile(...) failed, expected inner to capture 1 upvalue, got %v", inner.UpvalueCount)
+	}
+	if !containsOpCode(inner.Chunk.GetCode(), opcode.OP_GET_UPVALUE) || !containsOpCode(inner.Chunk.GetCode(), opcode.OP_SET_UPVALUE) {
+		t.Errorf("compiler.Compile(...) failed, expected inner to access x through an upvalue")
+	}
+}
+
+func TestCompileList(t *testing.T) {
+	script := Compile("var l = [1, 2, 3]; l[0] = l[1];")
+	if script == nil {
+		t.Fatalf("compiler.Compile(...) failed, expected a function, got nil")
+	}
+
+	for _, op := range []opcode.OpCode{opcode.OP_BUILD_LIST, opcode.OP_GET_INDEX, opcode.OP_SET_INDEX} {
+		if !containsOpCode(script.Chunk.GetCode(), op) {
+			t.Errorf("compiler.Compile(...) failed, expected script to emit %v", op)
+		}
+	}
+}
+
+func TestCompileInterpolation(t *testing.T) {
+	script := Compile(`var name = "x"; print "a ${name} b ${1 + 2}";`)
+	if script == nil {
+		t.Fatalf("compiler.Compile(...) failed, expected a function, got nil")
+	}
+
+	code := script.Chunk.GetCode()
+	parts := -1
+	for offset := 0; offset < len(code)-1; offset++ {
+		if opcode.OpCode(code[offset]) == opcode.OP_INTERPOLATE {
+			parts = int(code[offset+1])
+		}
+	}
+	if parts != 4 {
+		t.Errorf("compiler.Compile(...) failed, expected %v joining 4 parts, got %v", opcode.OP_INTERPOLATE, parts)
+	}
+
+	for _, source := range []string{`print "${1 +}";`, `print "${1 2}";`, `print "${1";`} {
+		if function, _ := CompileWithOptions(source, Options{}); function != nil {
+			t.Errorf("compiler.Compile(%q) failed, expected a compile error", source)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    float64
+	}{
+		{"0", 0},
+		{"12.25", 12.25},
+		{"1e-3", 0.001},
+		{"0xFF", 255},
+		{"0b101", 5},
+		{"0o755", 493},
+		{"0x10000000000000000", 1 << 64},
+	}
+
+	for _, test := range tests {
+		if got := parseNumber(test.literal); got != test.want {
+			t.Errorf("compiler.parseNumber(%q) failed, expected %v, got %v", test.literal, test.want, got)
+		}
+	}
+
+	if function, _ := CompileWithOptions("print 1e999;", Options{}); function != nil {
+		t.Errorf("compiler.Compile(...) failed, expected a number literal too large for a float to be an error")
+	}
+}
+
+func TestCompileTry(t *testing.T) {
+	script := Compile("try { throw 1; } catch (e) { print e; } finally { print 2; }")
+	if script == nil {
+		t.Fatalf("compiler.Compile(...) failed, expected a function, got nil")
+	}
+
+	for _, op := range []opcode.OpCode{opcode.OP_SETUP_FINALLY, opcode.OP_SETUP_CATCH, opcode.OP_THROW, opcode.OP_POP_HANDLER, opcode.OP_END_FINALLY} {
+		if !containsOpCode(script.Chunk.GetCode(), op) {
+			t.Errorf("compiler.Compile(...) failed, expected script to emit %v", op)
+		}
+	}
+
+	// without a finally clause its handler setup is turned into a no-op
+	script = Compile("try { throw 1; } catch (e) {}")
+	if script == nil || containsOpCode(script.Chunk.GetCode(), opcode.OP_SETUP_FINALLY) {
+		t.Errorf("compiler.Compile(...) failed, expected no %v without a finally clause", opcode.OP_SETUP_FINALLY)
+	}
+}
+
+func TestSynchronize(t *testing.T) {
+	// after an error the parser resumes at the next statement keyword, so
+	// the error inside the statement that starts there is reported too
+	sources := []string{
+		"print 1\nthrow +;",
+		"print 1\nimport 1;",
+		"print 1\nfrom \"m.lox\" import 1;",
+		"fun f() { print 1\nreturn +; }",
+		"print 1\ntry { print +; } catch (e) {}",
+	}
+
+	for _, source := range sources {
+		function, errs := CompileWithOptions(source, Options{})
+		if function != nil || len(errs) != 2 {
+			t.Errorf("compiler.CompileWithOptions(%q) failed, expected 2 errors, got %v", source, errs)
+			continue
+		}
+		if errs[0].Line != 2 || errs[1].Line != 2 || errs[1].Column == errs[0].Column {
+			t.Errorf("compiler.CompileWithOptions(%q) failed, expected errors at two places on line 2, got %v", source, errs)
+		}
+	}
+}
+
+func TestCompileVerifies(t *testing.T) {
+	sources := []string{
+		"fun outer() { var x = 1; fun inner() { x = x + 1; return x; } return inner; }",
+		"class A { init(n) { this.n = n; } get() { return this.n; } } class B < A { get() { return super.get() + 1; } }",
+		"fun f(k) { try { if (k) throw 1; return 1; } catch (e) { return e; } finally { print 2; } }",
+		"var m = {\"a\": [1, 2]}; for (var i = 0; i < 2; i = i + 1) { m[\"a\"][i] = !i and -i or nil; }",
+		"import \"lib.lox\" as lib; from \"lib.lox\" import f;",
+		"var n = 1; print \"n is ${n + 1}, nested ${\"${n}\"}\";",
+	}
+
+	for _, source := range sources {
+		script := Compile(source)
+		if script == nil {
+			t.Fatalf("compiler.Compile(%q) failed, expected a function, got nil", source)
+		}
+		if err := chunk.Verify(script); err != nil {
+			t.Errorf("chunk.Verify(...) failed for %q, expected no error, got %v", source, err)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	compile := func(source string, noOptimize bool) *value.ObjFunction {
+		function, errs := CompileWithOptions(source, Options{NoOptimize: noOptimize})
+		if function == nil {
+			t.Fatalf("compiler.CompileWithOptions(%q) failed, expected a function, got %v", source, errs)
+		}
+		return function
+	}
+
+	// constant expressions are folded into one push
+	script := compile("print 1 + 2 * 3 != 8;", false)
+	expected := []byte{byte(opcode.OP_TRUE), byte(opcode.OP_PRINT), byte(opcode.OP_NIL), byte(opcode.OP_RETURN)}
+	if string(script.Chunk.GetCode()) != string(expected) {
+		t.Errorf("compiler.Compile(...) failed, expected code %v, got %v", expected, script.Chunk.GetCode())
+	}
+
+	script = compile(`print "a" + "b";`, false)
+	if constants := script.Chunk.GetConstants().Values; len(constants) != 1 || constants[0].AsGoString() != "ab" {
+		t.Errorf("compiler.Compile(...) failed, expected the only constant to be \"ab\", got %v", constants)
+	}
+
+	// dead branches and code after a return are removed
+	script = compile("while (false) print 1; fun f() { return 1; print 2; }", false)
+	if containsOpCode(script.Chunk.GetCode(), opcode.OP_PRINT) || containsOpCode(findFunctionConstant(script).Chunk.GetCode(), opcode.OP_PRINT) {
+		t.Errorf("compiler.Compile(...) failed, expected unreachable prints to be removed")
+	}
+
+	// no jump lands on another jump
+	script = compile("var a; var b; var c = a and b and c; if (a) { if (b) print 1; } else print 2;", false)
+	code := script.Chunk.GetCode()
+	for offset := 0; offset < len(code); offset++ {
+		op := opcode.OpCode(code[offset])
+		switch op {
+		case opcode.OP_CONSTANT, opcode.OP_GET_GLOBAL, opcode.OP_DEFINE_GLOBAL:
+			offset++
+		case opcode.OP_JUMP, opcode.OP_JUMP_IF_FALSE:
+			target := offset + 3 + (int(code[offset+1])<<8 | int(code[offset+2]))
+			if target := opcode.OpCode(code[target]); target == opcode.OP_JUMP || (op == opcode.OP_JUMP_IF_FALSE && target == opcode.OP_JUMP_IF_FALSE) {
+				t.Errorf("compiler.Compile(...) failed, expected the jump at %d not to land on %v", offset, target)
+			}
+			offset += 2
+		}
+	}
+
+	// the optimizer can be turned off
+	script = compile("print 1 + 2;", true)
+	if !containsOpCode(script.Chunk.GetCode(), opcode.OP_ADD) {
+		t.Errorf("compiler.CompileWithOptions(...) failed, expected %v with NoOptimize", opcode.OP_ADD)
+	}
+}
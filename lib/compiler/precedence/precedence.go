@@ -12,6 +12,7 @@ const (
 	PREC_TERM
 	PREC_FACTOR
 	PREC_UNARY
+	PREC_POWER
 	PREC_CALL
 	PREC_PRIMARY
 )
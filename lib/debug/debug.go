@@ -5,145 +5,233 @@ import (
 	"fmt"
 	"golox-lang/lib/chunk"
 	"golox-lang/lib/chunk/opcode"
+	"io"
+	"os"
 )
 
 func DisassembleChunk(chunk *chunk.Chunk, name string) {
-	fmt.Printf("== %s ==\n", name)
+	FdisassembleChunk(os.Stdout, chunk, name)
+}
+
+func DisassembleInstruction(chunk *chunk.Chunk, offset int) int {
+	return FdisassembleInstruction(os.Stdout, chunk, offset)
+}
+
+// FdisassembleChunk writes the disassembly of chunk to out.
+func FdisassembleChunk(out io.Writer, chunk *chunk.Chunk, name string) {
+	fmt.Fprintf(out, "== %s ==\n", name)
 
 	for offset := 0; offset < len(chunk.GetCode()); {
-		offset = DisassembleInstruction(chunk, offset)
+		offset = FdisassembleInstruction(out, chunk, offset)
 	}
 }
 
-func DisassembleInstruction(chunk *chunk.Chunk, offset int) int {
-	fmt.Printf("%04d ", offset)
-	if offset > 0 && chunk.GetLines()[offset] == chunk.GetLines()[offset-1] {
-		fmt.Printf("   | ")
+// FdisassembleInstruction writes the instruction at offset to out and returns
+// the offset of the next one.
+func FdisassembleInstruction(out io.Writer, chunk *chunk.Chunk, offset int) int {
+	fmt.Fprintf(out, "%04d ", offset)
+	line, _ := chunk.GetPosition(offset)
+	if previous, _ := chunk.GetPosition(offset - 1); offset > 0 && line == previous {
+		fmt.Fprintf(out, "   | ")
 	} else {
-		fmt.Printf("%4d ", chunk.GetLines()[offset])
+		fmt.Fprintf(out, "%4d ", line)
 	}
 
 	instruction := opcode.OpCode(chunk.GetCode()[offset])
 	switch instruction {
 	case opcode.OP_CONSTANT:
-		return constantInstruction("OP_CONSTANT", chunk, offset)
+		return constantInstruction(out, "OP_CONSTANT", chunk, offset)
 	case opcode.OP_CONSTANT_LONG:
-		return longConstantInstruction("OP_CONSTANT_LONG", chunk, offset)
+		return longConstantInstruction(out, "OP_CONSTANT_LONG", chunk, offset)
 	case opcode.OP_NIL:
-		return simpleInstruction("OP_NIL", offset)
+		return simpleInstruction(out, "OP_NIL", offset)
 	case opcode.OP_TRUE:
-		return simpleInstruction("OP_TRUE", offset)
+		return simpleInstruction(out, "OP_TRUE", offset)
 	case opcode.OP_FALSE:
-		return simpleInstruction("OP_FALSE", offset)
+		return simpleInstruction(out, "OP_FALSE", offset)
 	case opcode.OP_POP:
-		return simpleInstruction("OP_POP", offset)
+		return simpleInstruction(out, "OP_POP", offset)
 	case opcode.OP_GET_LOCAL:
-		return byteInstruction("OP_GET_LOCAL", chunk, offset)
+		return byteInstruction(out, "OP_GET_LOCAL", chunk, offset)
 	case opcode.OP_GET_LOCAL_LONG:
-		return byteInstructionLong("OP_GET_LOCAL_LONG", chunk, offset)
+		return byteInstructionLong(out, "OP_GET_LOCAL_LONG", chunk, offset)
 	case opcode.OP_SET_LOCAL:
-		return byteInstruction("OP_SET_LOCAL", chunk, offset)
+		return byteInstruction(out, "OP_SET_LOCAL", chunk, offset)
 	case opcode.OP_SET_LOCAL_LONG:
-		return byteInstructionLong("OP_SET_LOCAL_LONG", chunk, offset)
+		return byteInstructionLong(out, "OP_SET_LOCAL_LONG", chunk, offset)
 	case opcode.OP_GET_GLOBAL:
-		return constantInstruction("OP_GET_GLOBAL", chunk, offset)
+		return byteInstruction(out, "OP_GET_GLOBAL", chunk, offset)
 	case opcode.OP_GET_GLOBAL_LONG:
-		return longConstantInstruction("OP_GET_GLOBAL_LONG", chunk, offset)
+		return byteInstructionLong(out, "OP_GET_GLOBAL_LONG", chunk, offset)
 	case opcode.OP_DEFINE_GLOBAL:
-		return constantInstruction("OP_DEFINE_GLOBAL", chunk, offset)
+		return byteInstruction(out, "OP_DEFINE_GLOBAL", chunk, offset)
 	case opcode.OP_DEFINE_GLOBAL_LONG:
-		return longConstantInstruction("OP_DEFINE_GLOBAL_LONG", chunk, offset)
+		return byteInstructionLong(out, "OP_DEFINE_GLOBAL_LONG", chunk, offset)
 	case opcode.OP_SET_GLOBAL:
-		return constantInstruction("OP_SET_GLOBAL", chunk, offset)
+		return byteInstruction(out, "OP_SET_GLOBAL", chunk, offset)
 	case opcode.OP_SET_GLOBAL_LONG:
-		return longConstantInstruction("OP_SET_GLOBAL_LONG", chunk, offset)
+		return byteInstructionLong(out, "OP_SET_GLOBAL_LONG", chunk, offset)
+	case opcode.OP_GET_UPVALUE:
+		return byteInstruction(out, "OP_GET_UPVALUE", chunk, offset)
+	case opcode.OP_SET_UPVALUE:
+		return byteInstruction(out, "OP_SET_UPVALUE", chunk, offset)
 	case opcode.OP_GET_PROPERTY:
-		return constantInstruction("OP_GET_PROPERTY", chunk, offset)
+		return constantInstruction(out, "OP_GET_PROPERTY", chunk, offset)
 	case opcode.OP_SET_PROPERTY:
-		return constantInstruction("OP_SET_PROPERTY", chunk, offset)
+		return constantInstruction(out, "OP_SET_PROPERTY", chunk, offset)
 	case opcode.OP_GET_SUPER:
-		return constantInstruction("OP_GET_SUPER", chunk, offset)
+		return constantInstruction(out, "OP_GET_SUPER", chunk, offset)
+	case opcode.OP_BUILD_LIST:
+		return byteInstruction(out, "OP_BUILD_LIST", chunk, offset)
+	case opcode.OP_INTERPOLATE:
+		return byteInstruction(out, "OP_INTERPOLATE", chunk, offset)
+	case opcode.OP_BUILD_MAP:
+		return byteInstruction(out, "OP_BUILD_MAP", chunk, offset)
+	case opcode.OP_GET_INDEX:
+		return simpleInstruction(out, "OP_GET_INDEX", offset)
+	case opcode.OP_SET_INDEX:
+		return simpleInstruction(out, "OP_SET_INDEX", offset)
 	case opcode.OP_EQUAL:
-		return simpleInstruction("OP_EQUAL", offset)
+		return simpleInstruction(out, "OP_EQUAL", offset)
 	case opcode.OP_GREATER:
-		return simpleInstruction("OP_GREATER", offset)
+		return simpleInstruction(out, "OP_GREATER", offset)
 	case opcode.OP_LESS:
-		return simpleInstruction("OP_LESS", offset)
+		return simpleInstruction(out, "OP_LESS", offset)
 	case opcode.OP_ADD:
-		return simpleInstruction("OP_ADD", offset)
+		return simpleInstruction(out, "OP_ADD", offset)
+	case opcode.OP_SUBTRACT:
+		return simpleInstruction(out, "OP_SUBTRACT", offset)
 	case opcode.OP_MULTIPLY:
-		return simpleInstruction("OP_MULTIPLY", offset)
+		return simpleInstruction(out, "OP_MULTIPLY", offset)
 	case opcode.OP_DIVIDE:
-		return simpleInstruction("OP_DIVIDE", offset)
+		return simpleInstruction(out, "OP_DIVIDE", offset)
+	case opcode.OP_MODULO:
+		return simpleInstruction(out, "OP_MODULO", offset)
+	case opcode.OP_POWER:
+		return simpleInstruction(out, "OP_POWER", offset)
 	case opcode.OP_NOT:
-		return simpleInstruction("OP_NOT", offset)
+		return simpleInstruction(out, "OP_NOT", offset)
 	case opcode.OP_NEGATE:
-		return simpleInstruction("OP_NEGATE", offset)
+		return simpleInstruction(out, "OP_NEGATE", offset)
 	case opcode.OP_PRINT:
-		return simpleInstruction("OP_PRINT", offset)
+		return simpleInstruction(out, "OP_PRINT", offset)
 	case opcode.OP_JUMP:
-		return jumpInstruction("OP_JUMP", 1, chunk, offset)
+		return jumpInstruction(out, "OP_JUMP", 1, chunk, offset)
 	case opcode.OP_JUMP_IF_FALSE:
-		return jumpInstruction("OP_JUMP_IF_FALSE", 1, chunk, offset)
+		return jumpInstruction(out, "OP_JUMP_IF_FALSE", 1, chunk, offset)
 	case opcode.OP_LOOP:
-		return jumpInstruction("OP_LOOP", -1, chunk, offset)
+		return jumpInstruction(out, "OP_LOOP", -1, chunk, offset)
+	case opcode.OP_THROW:
+		return simpleInstruction(out, "OP_THROW", offset)
+	case opcode.OP_SETUP_CATCH:
+		return jumpInstruction(out, "OP_SETUP_CATCH", 1, chunk, offset)
+	case opcode.OP_SETUP_FINALLY:
+		return jumpInstruction(out, "OP_SETUP_FINALLY", 1, chunk, offset)
+	case opcode.OP_POP_HANDLER:
+		return simpleInstruction(out, "OP_POP_HANDLER", offset)
+	case opcode.OP_END_FINALLY:
+		return simpleInstruction(out, "OP_END_FINALLY", offset)
 	case opcode.OP_CALL:
-		return byteInstruction("OP_CALL", chunk, offset)
+		return byteInstruction(out, "OP_CALL", chunk, offset)
+	case opcode.OP_CLOSURE:
+		return closureInstruction(out, "OP_CLOSURE", chunk, offset, 2)
+	case opcode.OP_CLOSURE_LONG:
+		return closureInstruction(out, "OP_CLOSURE_LONG", chunk, offset, 4)
+	case opcode.OP_CLOSE_UPVALUE:
+		return simpleInstruction(out, "OP_CLOSE_UPVALUE", offset)
 	case opcode.OP_RETURN:
-		return simpleInstruction("OP_RETURN", offset)
+		return simpleInstruction(out, "OP_RETURN", offset)
 	case opcode.OP_CLASS:
-		return constantInstruction("OP_CLASS", chunk, offset)
+		return constantInstruction(out, "OP_CLASS", chunk, offset)
 	case opcode.OP_INHERIT:
-		return simpleInstruction("OP_INHERIT", offset)
+		return simpleInstruction(out, "OP_INHERIT", offset)
 	case opcode.OP_METHOD:
-		return constantInstruction("OP_METHOD", chunk, offset)
+		return constantInstruction(out, "OP_METHOD", chunk, offset)
+	case opcode.OP_IMPORT:
+		return constantInstruction(out, "OP_IMPORT", chunk, offset)
+	case opcode.OP_IMPORT_LONG:
+		return longConstantInstruction(out, "OP_IMPORT_LONG", chunk, offset)
+	case opcode.OP_IMPORT_FROM:
+		return constantInstruction(out, "OP_IMPORT_FROM", chunk, offset)
+	case opcode.OP_IMPORT_FROM_LONG:
+		return longConstantInstruction(out, "OP_IMPORT_FROM_LONG", chunk, offset)
 	default:
-		fmt.Println("Unknown opcode ", instruction)
+		fmt.Fprintln(out, "Unknown opcode ", instruction)
 		return offset + 1
 	}
 }
 
-func simpleInstruction(name string, offset int) int {
-	fmt.Println(name)
+func simpleInstruction(out io.Writer, name string, offset int) int {
+	fmt.Fprintln(out, name)
 	return offset + 1
 }
 
-func byteInstruction(name string, chunk *chunk.Chunk, offset int) int {
+func byteInstruction(out io.Writer, name string, chunk *chunk.Chunk, offset int) int {
 	slot := chunk.GetCode()[offset+1]
-	fmt.Printf("%s %4d\n", name, slot)
+	fmt.Fprintf(out, "%s %4d\n", name, slot)
 	return offset + 2
 }
 
-func byteInstructionLong(name string, chunk *chunk.Chunk, offset int) int {
+func byteInstructionLong(out io.Writer, name string, chunk *chunk.Chunk, offset int) int {
 	bytes := make([]byte, 4)
 	copy(bytes, chunk.GetCode()[offset+1:offset+4])
 	var slot uint32 = binary.LittleEndian.Uint32(bytes)
-	fmt.Printf("%s %4d\n", name, slot)
+	fmt.Fprintf(out, "%s %4d\n", name, slot)
 	return offset + 4
 }
 
-func jumpInstruction(name string, sign int, chunk *chunk.Chunk, offset int) int {
+func jumpInstruction(out io.Writer, name string, sign int, chunk *chunk.Chunk, offset int) int {
 	bytes := make([]byte, 4)
 	copy(bytes, chunk.GetCode()[offset+1:offset+3])
 	jump := binary.BigEndian.Uint16(bytes)
-	fmt.Printf("%s %4d -> %d\n", name, offset, offset+3+sign*int(jump))
+	fmt.Fprintf(out, "%s %4d -> %d\n", name, offset, offset+3+sign*int(jump))
 	return offset + 3
 }
 
-func constantInstruction(name string, chunk *chunk.Chunk, offset int) int {
+func constantInstruction(out io.Writer, name string, chunk *chunk.Chunk, offset int) int {
 	constant := chunk.GetCode()[offset+1]
-	fmt.Printf("%s %4d ", name, constant)
-	chunk.GetConstants().Values[constant].PrintValue()
-	fmt.Print("\n")
+	fmt.Fprintf(out, "%s %4d ", name, constant)
+	fmt.Fprint(out, chunk.GetConstants().Values[constant].String())
+	fmt.Fprint(out, "\n")
 	return offset + 2
 }
 
-func longConstantInstruction(name string, chunk *chunk.Chunk, offset int) int {
+func longConstantInstruction(out io.Writer, name string, chunk *chunk.Chunk, offset int) int {
 	constBytes := make([]byte, 4)
 	copy(constBytes, chunk.GetCode()[offset+1:offset+4])
 	var constant uint32 = binary.LittleEndian.Uint32(constBytes)
-	fmt.Printf("%s %4d ", name, constant)
-	chunk.GetConstants().Values[constant].PrintValue()
-	fmt.Print("\n")
+	fmt.Fprintf(out, "%s %4d ", name, constant)
+	fmt.Fprint(out, chunk.GetConstants().Values[constant].String())
+	fmt.Fprint(out, "\n")
 	return offset + 4
 }
+
+func closureInstruction(out io.Writer, name string, chunk *chunk.Chunk, offset int, operandLength int) int {
+	var constant uint32
+	if operandLength == 2 {
+		constant = uint32(chunk.GetCode()[offset+1])
+	} else {
+		constBytes := make([]byte, 4)
+		copy(constBytes, chunk.GetCode()[offset+1:offset+4])
+		constant = binary.LittleEndian.Uint32(constBytes)
+	}
+	offset += operandLength
+
+	fmt.Fprintf(out, "%-16s %4d ", name, constant)
+	function := chunk.GetConstants().Values[constant]
+	fmt.Fprint(out, function.String())
+	fmt.Fprint(out, "\n")
+
+	for j := 0; j < function.AsFunction().UpvalueCount; j++ {
+		isLocal := chunk.GetCode()[offset]
+		index := chunk.GetCode()[offset+1]
+		kind := "upvalue"
+		if isLocal == 1 {
+			kind = "local"
+		}
+		fmt.Fprintf(out, "%04d      |                     %s %d\n", offset, kind, index)
+		offset += 2
+	}
+
+	return offset
+}
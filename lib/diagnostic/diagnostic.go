@@ -0,0 +1,155 @@
+// Package diagnostic describes the errors reported while compiling and
+// running scripts, so hosts can collect them instead of parsing stderr.
+package diagnostic
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+type Kind byte
+
+const (
+	COMPILE_ERROR Kind = iota
+	RUNTIME_ERROR
+)
+
+type Diagnostic struct {
+	Kind    Kind
+	Message string
+	// Path is the file the error is in, empty for a script without one.
+	Path string
+	Line int
+	// Column counts characters from 1, it is 0 when only the line is known.
+	Column int
+	// Where is the token a compile error was reported at, like " at end".
+	Where string
+	// Excerpt quotes the source line with the error underlined, when the
+	// source is known.
+	Excerpt string
+	// Trace is the stack trace of a runtime error, innermost frame first.
+	Trace []string
+}
+
+// String formats the diagnostic the way the command line prints it.
+func (diagnostic Diagnostic) String() string {
+	var lines []string
+	switch {
+	case diagnostic.Kind == COMPILE_ERROR:
+		lines = append(lines, fmt.Sprintf("%s: Error%s: %s", diagnostic.Location(), diagnostic.Where, diagnostic.Message))
+	case diagnostic.Line == 0:
+		// Raised from Go with no script running.
+		lines = append(lines, diagnostic.Message)
+	default:
+		lines = append(lines, fmt.Sprintf("%s: %s", diagnostic.Location(), diagnostic.Message))
+	}
+
+	if diagnostic.Excerpt != "" {
+		lines = append(lines, diagnostic.Excerpt)
+	}
+	lines = append(lines, diagnostic.Trace...)
+	return strings.Join(lines, "\n")
+}
+
+// Location formats where the diagnostic is as path:line:column.
+func (diagnostic Diagnostic) Location() string {
+	return FormatLocation(diagnostic.Path, diagnostic.Line, diagnostic.Column)
+}
+
+// FormatLocation formats a place in a script as path:line:column, leaving
+// out the column when it is 0. Scripts without a path are called <script>.
+func FormatLocation(path string, line int, column int) string {
+	if path == "" {
+		path = "<script>"
+	}
+	if column == 0 {
+		return fmt.Sprintf("%s:%d", path, line)
+	}
+	return fmt.Sprintf("%s:%d:%d", path, line, column)
+}
+
+// Excerpt quotes the line of source holding the byte at offset, with carets
+// under width characters from there. The carets stop at the end of the line.
+func Excerpt(source string, offset int, width int) string {
+	if offset < 0 || offset > len(source) {
+		return ""
+	}
+
+	start := strings.LastIndexByte(source[:offset], '\n') + 1
+	end := len(source)
+	if newline := strings.IndexByte(source[offset:], '\n'); newline >= 0 {
+		end = offset + newline
+	}
+	if end > offset && source[end-1] == '\r' {
+		end--
+	}
+
+	var marker strings.Builder
+	for _, c := range source[start:offset] {
+		// Tabs are kept so that the carets line up however wide they are.
+		if c == '\t' {
+			marker.WriteByte('\t')
+		} else {
+			marker.WriteByte(' ')
+		}
+	}
+	if rest := utf8.RuneCountInString(source[offset:end]); width > rest {
+		width = rest
+	}
+	if width < 1 {
+		width = 1
+	}
+	marker.WriteString(strings.Repeat("^", width))
+
+	return "    " + source[start:end] + "\n    " + marker.String()
+}
+
+// ExcerptAt is Excerpt for a line and column of source.
+func ExcerptAt(source string, line int, column int, width int) string {
+	offset := 0
+	for current := 1; current < line; current++ {
+		newline := strings.IndexByte(source[offset:], '\n')
+		if newline < 0 {
+			return ""
+		}
+		offset += newline + 1
+	}
+
+	for current := 1; current < column && offset < len(source) && source[offset] != '\n'; current++ {
+		_, size := utf8.DecodeRuneInString(source[offset:])
+		offset += size
+	}
+	return Excerpt(source, offset, width)
+}
+
+// Sink receives diagnostics as they are reported.
+type Sink interface {
+	Report(diagnostic Diagnostic)
+}
+
+// SinkFunc lets an ordinary function be used as a Sink.
+type SinkFunc func(diagnostic Diagnostic)
+
+func (fn SinkFunc) Report(diagnostic Diagnostic) {
+	fn(diagnostic)
+}
+
+// Collector keeps every diagnostic reported to it.
+type Collector struct {
+	Diagnostics []Diagnostic
+}
+
+func (collector *Collector) Report(diagnostic Diagnostic) {
+	collector.Diagnostics = append(collector.Diagnostics, diagnostic)
+}
+
+// WriterSink writes each diagnostic to Writer as text.
+type WriterSink struct {
+	Writer io.Writer
+}
+
+func (sink WriterSink) Report(diagnostic Diagnostic) {
+	fmt.Fprintf(sink.Writer, "%s\n", diagnostic.String())
+}
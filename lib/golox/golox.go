@@ -0,0 +1,196 @@
+// Package golox embeds the interpreter in Go programs. It wraps a vm.VM with
+// configurable output, preloaded globals and typed errors.
+package golox
+
+import (
+	"context"
+	"golox-lang/lib/compiler"
+	"golox-lang/lib/diagnostic"
+	"golox-lang/lib/value"
+	"golox-lang/lib/vm"
+	"golox-lang/lib/vm/interpretresult"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// RuntimeError is returned when an exception escapes a script. It carries the
+// thrown value, the line it was thrown from and the stack trace.
+type RuntimeError = vm.RuntimeError
+
+// CompileError is returned when a script fails to compile. It holds every
+// error the compiler reported, each with its line.
+type CompileError struct {
+	Errors []compiler.CompileError
+}
+
+func (err *CompileError) Error() string {
+	messages := make([]string, len(err.Errors))
+	for i, e := range err.Errors {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+type Options struct {
+	// Stdout receives the output of print statements, it defaults to
+	// os.Stdout.
+	Stdout io.Writer
+	// Stderr receives errors as they are reported. Errors are also returned
+	// from Run, so it defaults to discarding them.
+	Stderr io.Writer
+	// Globals are defined in the main module before any script runs.
+	Globals map[string]value.Value
+	// Diagnostics, when set, is sent every compile error and uncaught
+	// runtime error.
+	Diagnostics diagnostic.Sink
+	// Debug receives the output of the debug flags in config, it defaults
+	// to Stdout.
+	Debug io.Writer
+	// Limits bound the instructions, call depth and memory scripts may use.
+	Limits vm.Limits
+	// SearchPath lists directories imports are resolved in, it defaults to
+	// the LOXPATH environment variable.
+	SearchPath []string
+}
+
+// Program is a compiled script that can be run any number of times.
+type Program struct {
+	Function *value.ObjFunction
+}
+
+type Interpreter struct {
+	vm *vm.VM
+}
+
+func New(options Options) *Interpreter {
+	machine := vm.New()
+	machine.Stdout = options.Stdout
+	if machine.Stdout == nil {
+		machine.Stdout = os.Stdout
+	}
+	machine.Stderr = options.Stderr
+	if machine.Stderr == nil {
+		machine.Stderr = ioutil.Discard
+	}
+	machine.Debug = options.Debug
+	machine.Diagnostics = options.Diagnostics
+	machine.Limits = options.Limits
+	machine.InitVM()
+
+	if options.SearchPath != nil {
+		machine.SearchPath = options.SearchPath
+	}
+	for name, val := range options.Globals {
+		machine.Globals.Set(name, val)
+	}
+
+	return &Interpreter{vm: machine}
+}
+
+// Compile compiles source without running it.
+func Compile(source string) (*Program, error) {
+	return compile(source, compiler.Options{})
+}
+
+func compile(source string, options compiler.Options) (*Program, error) {
+	function, errors := compiler.CompileWithOptions(source, options)
+	if function == nil {
+		return nil, &CompileError{Errors: errors}
+	}
+	return &Program{Function: function}, nil
+}
+
+// Run compiles and runs source in the interpreter's main module.
+func (interpreter *Interpreter) Run(source string) error {
+	return interpreter.RunContext(context.Background(), source)
+}
+
+// compile compiles source reporting errors the way the interpreter's VM does.
+func (interpreter *Interpreter) compile(source string) (*Program, error) {
+	options := compiler.Options{
+		ErrorWriter: interpreter.vm.Stderr,
+		DebugWriter: interpreter.vm.Debug,
+		Diagnostics: interpreter.vm.Diagnostics,
+	}
+	return compile(source, options)
+}
+
+// RunProgram runs a compiled program in the interpreter's main module.
+func (interpreter *Interpreter) RunProgram(program *Program) error {
+	return interpreter.RunProgramContext(context.Background(), program)
+}
+
+// RunContext is Run, except that the script is stopped once ctx is done, in
+// which case ctx.Err() is returned.
+func (interpreter *Interpreter) RunContext(ctx context.Context, source string) error {
+	program, err := interpreter.compile(source)
+	if err != nil {
+		return err
+	}
+	return interpreter.RunProgramContext(ctx, program)
+}
+
+// RunProgramContext is RunProgram stopped once ctx is done.
+func (interpreter *Interpreter) RunProgramContext(ctx context.Context, program *Program) error {
+	switch interpreter.vm.InterpretFunctionContext(ctx, program.Function) {
+	case interpretresult.INTERPRET_RUNTIME_ERROR:
+		return interpreter.vm.LastError()
+	case interpretresult.INTERPRET_INTERRUPTED:
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Get returns the value of a global variable of the main module.
+func (interpreter *Interpreter) Get(name string) (value.Value, bool) {
+	return interpreter.vm.Globals.Get(name)
+}
+
+// Set defines or assigns a global variable of the main module.
+func (interpreter *Interpreter) Set(name string, val value.Value) {
+	interpreter.vm.Globals.Set(name, val)
+}
+
+// DefineNative makes a Go function callable from scripts under name, with
+// arity checked before each call.
+func (interpreter *Interpreter) DefineNative(name string, arity value.Arity, function value.NativeFn) {
+	interpreter.vm.DefineNative(name, arity, function)
+}
+
+// Bind makes a Go function callable from scripts under name, converting its
+// arguments and results.
+func (interpreter *Interpreter) Bind(name string, fn interface{}) error {
+	return interpreter.vm.BindFunction(name, fn)
+}
+
+// BindStruct defines a class called name for the struct type of prototype.
+func (interpreter *Interpreter) BindStruct(name string, prototype interface{}) error {
+	return interpreter.vm.BindStruct(name, prototype)
+}
+
+// ToValue converts a Go value to a Lox value.
+func (interpreter *Interpreter) ToValue(goValue interface{}) (value.Value, error) {
+	return interpreter.vm.ToValue(goValue)
+}
+
+// FromValue converts val into the Go value target points to.
+func (interpreter *Interpreter) FromValue(val value.Value, target interface{}) error {
+	return interpreter.vm.FromValue(val, target)
+}
+
+// Call calls a Lox function, class or native value with args.
+func (interpreter *Interpreter) Call(callee value.Value, args ...value.Value) (value.Value, error) {
+	return interpreter.vm.Call(callee, args...)
+}
+
+// Invoke calls the method called name on receiver with args.
+func (interpreter *Interpreter) Invoke(receiver value.Value, name string, args ...value.Value) (value.Value, error) {
+	return interpreter.vm.Invoke(receiver, name, args...)
+}
+
+// VM returns the underlying virtual machine.
+func (interpreter *Interpreter) VM() *vm.VM {
+	return interpreter.vm
+}
@@ -0,0 +1,146 @@
+package golox
+
+import (
+	"bytes"
+	"context"
+	"golox-lang/lib/diagnostic"
+	"golox-lang/lib/value"
+	"golox-lang/lib/value/valuetype"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	var stdout bytes.Buffer
+	interpreter := New(Options{
+		Stdout:  &stdout,
+		Globals: map[string]value.Value{"base": value.New(valuetype.VAL_NUMBER, 40.0)},
+	})
+
+	if err := interpreter.Run("var answer = base + 2; print answer;"); err != nil {
+		t.Fatalf("Interpreter.Run(...) failed, expected no error, got %v", err)
+	}
+
+	if stdout.String() != "42\n" {
+		t.Errorf("Interpreter.Run(...) failed, expected output %q, got %q", "42\n", stdout.String())
+	}
+	if answer, present := interpreter.Get("answer"); !present || answer.AsNumber() != 42 {
+		t.Errorf("Interpreter.Get(...) failed, expected answer to be 42, got %v", answer)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	_, err := Compile("var x = ;\nprint 1 +;")
+
+	compileErr, ok := err.(*CompileError)
+	if !ok {
+		t.Fatalf("golox.Compile(...) failed, expected a *CompileError, got %T", err)
+	}
+	if len(compileErr.Errors) != 2 || compileErr.Errors[1].Line != 2 {
+		t.Errorf("golox.Compile(...) failed, expected errors on lines 1 and 2, got %v", compileErr.Errors)
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	interpreter := New(Options{})
+
+	err := interpreter.Run("fun f() {\n  return 1 + nil;\n}\nf();")
+
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Interpreter.Run(...) failed, expected a *RuntimeError, got %T", err)
+	}
+	if runtimeErr.Message != "Operands must be numbers." || runtimeErr.Line != 2 || runtimeErr.Column != 12 {
+		t.Errorf("Interpreter.Run(...) failed, expected message at 2:12, got %q at %v:%v", runtimeErr.Message, runtimeErr.Line, runtimeErr.Column)
+	}
+	if len(runtimeErr.Trace) != 2 || runtimeErr.Trace[0] != "<script>:2:12 in f()" {
+		t.Errorf("Interpreter.Run(...) failed, expected a two frame trace, got %v", runtimeErr.Trace)
+	}
+
+	// the interpreter stays usable after an error
+	if err := interpreter.Run("var x = 1;"); err != nil {
+		t.Errorf("Interpreter.Run(...) failed, expected no error after recovering, got %v", err)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	program, err := Compile("counter = counter + 1;")
+	if err != nil {
+		t.Fatalf("golox.Compile(...) failed, expected no error, got %v", err)
+	}
+
+	interpreter := New(Options{})
+	interpreter.Set("counter", value.New(valuetype.VAL_NUMBER, 0.0))
+	for i := 0; i < 3; i++ {
+		if err := interpreter.RunProgram(program); err != nil {
+			t.Fatalf("Interpreter.RunProgram(...) failed, expected no error, got %v", err)
+		}
+	}
+
+	if counter, _ := interpreter.Get("counter"); counter.AsNumber() != 3 {
+		t.Errorf("Interpreter.RunProgram(...) failed, expected counter to be 3, got %v", counter)
+	}
+}
+
+func TestProgramShared(t *testing.T) {
+	program, err := Compile(`var words = ["a", "b"]; fun join() { return words[0] + words[1]; } var joined = join() == "ab";`)
+	if err != nil {
+		t.Fatalf("golox.Compile(...) failed, expected no error, got %v", err)
+	}
+
+	// a program is read only, so interpreters can run it at the same time
+	errs := make(chan error)
+	interpreters := make([]*Interpreter, 4)
+	for i := range interpreters {
+		interpreters[i] = New(Options{})
+		go func(interpreter *Interpreter) {
+			errs <- interpreter.RunProgram(program)
+		}(interpreters[i])
+	}
+	for range interpreters {
+		if err := <-errs; err != nil {
+			t.Errorf("Interpreter.RunProgram(...) failed, expected no error, got %v", err)
+		}
+	}
+
+	for _, interpreter := range interpreters {
+		if joined, _ := interpreter.Get("joined"); !joined.IsBool() || !joined.AsBool() {
+			t.Errorf("Interpreter.RunProgram(...) failed, expected joined to be true, got %v", joined)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var stderr bytes.Buffer
+	collector := &diagnostic.Collector{}
+	interpreter := New(Options{Stderr: &stderr, Diagnostics: collector})
+
+	interpreter.Run("var x = ;")
+	interpreter.Run("throw Error(\"boom\");")
+
+	if len(collector.Diagnostics) != 2 {
+		t.Fatalf("Interpreter.Run(...) failed, expected 2 diagnostics, got %v", collector.Diagnostics)
+	}
+	if kind := collector.Diagnostics[0].Kind; kind != diagnostic.COMPILE_ERROR {
+		t.Errorf("Interpreter.Run(...) failed, expected a compile error first, got %v", kind)
+	}
+	if report := collector.Diagnostics[1]; report.Kind != diagnostic.RUNTIME_ERROR || report.Message != "boom" || report.Line != 1 {
+		t.Errorf("Interpreter.Run(...) failed, expected a runtime error on line 1, got %v", report)
+	}
+
+	expected := "<script>:1:9: Error at ;: Expect Expression.\n    var x = ;\n            ^\n" +
+		"<script>:1:1: boom\n    throw Error(\"boom\");\n    ^\n<script>:1:1 in script\n"
+	if stderr.String() != expected {
+		t.Errorf("Interpreter.Run(...) failed, expected stderr %q, got %q", expected, stderr.String())
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	interpreter := New(Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := interpreter.RunContext(ctx, "while (true) {}"); err != context.Canceled {
+		t.Errorf("Interpreter.RunContext(...) failed, expected %v, got %v", context.Canceled, err)
+	}
+}
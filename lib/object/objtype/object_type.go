@@ -9,4 +9,10 @@ const (
 	OBJ_CLASS
 	OBJ_INSTANCE
 	OBJ_BOUND_METHOD
+	OBJ_CLOSURE
+	OBJ_UPVALUE
+	OBJ_LIST
+	OBJ_MAP
+	OBJ_BOUND_BUILTIN
+	OBJ_MODULE
 )
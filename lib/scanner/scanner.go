@@ -1,16 +1,39 @@
 package scanner
 
 import (
+	"fmt"
 	"golox-lang/lib/scanner/token"
 	"golox-lang/lib/scanner/token/tokentype"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
+// Scanner splits Source into tokens. Start and Current are byte offsets into
+// Source, and the scanner decodes the UTF-8 one character at a time as it
+// goes, so scanning is linear in the size of the source. Line and Column are
+// the position of Current.
 type Scanner struct {
 	Source  string
 	Start   int
 	Current int
 	Line    int
+	Column  int
+
+	// startLine and startColumn are the position of Start.
+	startLine   int
+	startColumn int
+	// invalid is the error for the first invalid escape sequence or digit
+	// in the literal being scanned, reported once the whole literal is
+	// scanned.
+	invalid *token.Token
+	// interpolations holds, for each interpolated expression being scanned,
+	// how many braces are open inside it, so that the brace closing the
+	// expression can be told apart. inString is set once that brace is
+	// scanned, as the next token continues the string.
+	interpolations []int
+	inString       bool
 }
 
 func New(source string) *Scanner {
@@ -19,12 +42,19 @@ func New(source string) *Scanner {
 	scanner.Start = 0
 	scanner.Current = 0
 	scanner.Line = 1
+	scanner.Column = 1
 
 	return scanner
 }
 
+// isDigit only accepts ASCII digits, since those are all a number literal
+// can be made of. Other digits may still appear in identifiers.
 func isDigit(c rune) bool {
-	return unicode.IsDigit(c)
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c rune) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
 }
 
 func isAlpha(c rune) bool {
@@ -32,8 +62,14 @@ func isAlpha(c rune) bool {
 }
 
 func (scanner *Scanner) ScanToken() token.Token {
+	if scanner.inString {
+		scanner.inString = false
+		scanner.startToken()
+		return scanner.stringSegment()
+	}
+
 	scanner.skipWhiteSpace()
-	scanner.Start = scanner.Current
+	scanner.startToken()
 
 	if scanner.isAtEnd() {
 		return scanner.makeToken(tokentype.TOKEN_EOF)
@@ -41,11 +77,14 @@ func (scanner *Scanner) ScanToken() token.Token {
 
 	c := scanner.advance()
 
+	if c == 'r' && scanner.match('"') {
+		return scanner.string(true)
+	}
 	if isAlpha(c) {
 		return scanner.identifier()
 	}
 	if isDigit(c) {
-		return scanner.number()
+		return scanner.number(c)
 	}
 
 	switch c {
@@ -54,11 +93,28 @@ func (scanner *Scanner) ScanToken() token.Token {
 	case ')':
 		return scanner.makeToken(tokentype.TOKEN_RIGHT_PAREN)
 	case '{':
+		if last := len(scanner.interpolations) - 1; last >= 0 {
+			scanner.interpolations[last]++
+		}
 		return scanner.makeToken(tokentype.TOKEN_LEFT_BRACE)
 	case '}':
+		if last := len(scanner.interpolations) - 1; last >= 0 {
+			if scanner.interpolations[last] == 0 {
+				scanner.interpolations = scanner.interpolations[:last]
+				scanner.inString = true
+			} else {
+				scanner.interpolations[last]--
+			}
+		}
 		return scanner.makeToken(tokentype.TOKEN_RIGHT_BRACE)
+	case '[':
+		return scanner.makeToken(tokentype.TOKEN_LEFT_BRACKET)
+	case ']':
+		return scanner.makeToken(tokentype.TOKEN_RIGHT_BRACKET)
 	case ';':
 		return scanner.makeToken(tokentype.TOKEN_SEMICOLON)
+	case ':':
+		return scanner.makeToken(tokentype.TOKEN_COLON)
 	case ',':
 		return scanner.makeToken(tokentype.TOKEN_COMMA)
 	case '.':
@@ -67,10 +123,16 @@ func (scanner *Scanner) ScanToken() token.Token {
 		return scanner.makeToken(tokentype.TOKEN_MINUS)
 	case '+':
 		return scanner.makeToken(tokentype.TOKEN_PLUS)
+	case '%':
+		return scanner.makeToken(tokentype.TOKEN_PERCENT)
 	case '/':
 		return scanner.makeToken(tokentype.TOKEN_SLASH)
 	case '*':
-		return scanner.makeToken(tokentype.TOKEN_STAR)
+		tokenType := tokentype.TOKEN_STAR
+		if scanner.match('*') {
+			tokenType = tokentype.TOKEN_STAR_STAR
+		}
+		return scanner.makeToken(tokenType)
 	case '!':
 		tokenType := tokentype.TOKEN_BANG
 		if scanner.match('=') {
@@ -96,33 +158,60 @@ func (scanner *Scanner) ScanToken() token.Token {
 		}
 		return scanner.makeToken(tokenType)
 	case '"':
-		return scanner.string()
+		return scanner.string(false)
 	}
 
 	return scanner.errorToken("Unexpected character.")
 }
 
+func (scanner *Scanner) startToken() {
+	scanner.Start = scanner.Current
+	scanner.startLine = scanner.Line
+	scanner.startColumn = scanner.Column
+}
+
 func (scanner *Scanner) isAtEnd() bool {
 	return scanner.Current >= len(scanner.Source)
 }
 
+// decode returns the character at offset and its size in bytes, or a zero
+// rune at the end of the source. Invalid UTF-8 reads as utf8.RuneError one
+// byte at a time.
+func (scanner *Scanner) decode(offset int) (rune, int) {
+	if offset >= len(scanner.Source) {
+		return rune(0), 0
+	}
+	if c := scanner.Source[offset]; c < utf8.RuneSelf {
+		return rune(c), 1
+	}
+	return utf8.DecodeRuneInString(scanner.Source[offset:])
+}
+
 func (scanner *Scanner) advance() rune {
-	scanner.Current++
-	return []rune(scanner.Source)[scanner.Current-1]
+	c, size := scanner.decode(scanner.Current)
+	scanner.Current += size
+
+	if c == '\n' {
+		scanner.Line++
+		scanner.Column = 1
+	} else {
+		scanner.Column++
+	}
+	return c
 }
 
 func (scanner *Scanner) peek() rune {
-	if scanner.isAtEnd() {
-		return rune(0)
-	}
-	return []rune(scanner.Source)[scanner.Current]
+	c, _ := scanner.decode(scanner.Current)
+	return c
 }
 
 func (scanner *Scanner) peekNext() rune {
-	if scanner.Current+1 >= len(scanner.Source) {
+	_, size := scanner.decode(scanner.Current)
+	if size == 0 {
 		return rune(0)
 	}
-	return []rune(scanner.Source)[scanner.Current+1]
+	c, _ := scanner.decode(scanner.Current + size)
+	return c
 }
 
 func (scanner *Scanner) match(expected rune) bool {
@@ -130,16 +219,23 @@ func (scanner *Scanner) match(expected rune) bool {
 		return false
 	}
 
-	scanner.Current++
+	scanner.advance()
 	return true
 }
 
 func (scanner *Scanner) makeToken(tokenType tokentype.TokenType) token.Token {
-	return token.MakeToken(tokenType, scanner.Source[scanner.Start:scanner.Current], scanner.Line)
+	return scanner.positioned(token.MakeToken(tokenType, scanner.Source[scanner.Start:scanner.Current], scanner.startLine))
 }
 
 func (scanner *Scanner) errorToken(message string) token.Token {
-	return token.MakeToken(tokentype.TOKEN_ERROR, message, scanner.Line)
+	return scanner.positioned(token.MakeToken(tokentype.TOKEN_ERROR, message, scanner.startLine))
+}
+
+// positioned places tkn at the start of the token being scanned.
+func (scanner *Scanner) positioned(tkn token.Token) token.Token {
+	tkn.Column = scanner.startColumn
+	tkn.Offset = scanner.Start
+	return tkn
 }
 
 func (scanner *Scanner) skipWhiteSpace() {
@@ -150,7 +246,6 @@ func (scanner *Scanner) skipWhiteSpace() {
 			scanner.advance()
 
 		case '\n':
-			scanner.Line++
 			scanner.advance()
 
 		case '/':
@@ -180,9 +275,23 @@ func (scanner *Scanner) checkKeyword(start int, length int, rest string, tokenTy
 func (scanner *Scanner) identifierType() tokentype.TokenType {
 	switch scanner.Source[scanner.Start] {
 	case 'a':
-		return scanner.checkKeyword(1, 2, "nd", tokentype.TOKEN_AND)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'n':
+				return scanner.checkKeyword(2, 1, "d", tokentype.TOKEN_AND)
+			case 's':
+				return scanner.checkKeyword(2, 0, "", tokentype.TOKEN_AS)
+			}
+		}
 	case 'c':
-		return scanner.checkKeyword(1, 4, "lass", tokentype.TOKEN_CLASS)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'a':
+				return scanner.checkKeyword(2, 3, "tch", tokentype.TOKEN_CATCH)
+			case 'l':
+				return scanner.checkKeyword(2, 3, "ass", tokentype.TOKEN_CLASS)
+			}
+		}
 	case 'e':
 		return scanner.checkKeyword(1, 3, "lse", tokentype.TOKEN_ELSE)
 	case 'f':
@@ -190,14 +299,25 @@ func (scanner *Scanner) identifierType() tokentype.TokenType {
 			switch scanner.Source[scanner.Start+1] {
 			case 'a':
 				return scanner.checkKeyword(2, 3, "lse", tokentype.TOKEN_FALSE)
+			case 'i':
+				return scanner.checkKeyword(2, 5, "nally", tokentype.TOKEN_FINALLY)
 			case 'o':
 				return scanner.checkKeyword(2, 1, "r", tokentype.TOKEN_FOR)
+			case 'r':
+				return scanner.checkKeyword(2, 2, "om", tokentype.TOKEN_FROM)
 			case 'u':
 				return scanner.checkKeyword(2, 1, "n", tokentype.TOKEN_FUN)
 			}
 		}
 	case 'i':
-		return scanner.checkKeyword(1, 1, "f", tokentype.TOKEN_IF)
+		if scanner.Current-scanner.Start > 1 {
+			switch scanner.Source[scanner.Start+1] {
+			case 'f':
+				return scanner.checkKeyword(2, 0, "", tokentype.TOKEN_IF)
+			case 'm':
+				return scanner.checkKeyword(2, 4, "port", tokentype.TOKEN_IMPORT)
+			}
+		}
 	case 'n':
 		return scanner.checkKeyword(1, 2, "il", tokentype.TOKEN_NIL)
 	case 'o':
@@ -212,9 +332,23 @@ func (scanner *Scanner) identifierType() tokentype.TokenType {
 		if scanner.Current-scanner.Start > 1 {
 			switch scanner.Source[scanner.Start+1] {
 			case 'h':
-				return scanner.checkKeyword(2, 2, "is", tokentype.TOKEN_THIS)
+				if scanner.Current-scanner.Start > 2 {
+					switch scanner.Source[scanner.Start+2] {
+					case 'i':
+						return scanner.checkKeyword(3, 1, "s", tokentype.TOKEN_THIS)
+					case 'r':
+						return scanner.checkKeyword(3, 2, "ow", tokentype.TOKEN_THROW)
+					}
+				}
 			case 'r':
-				return scanner.checkKeyword(2, 2, "ue", tokentype.TOKEN_TRUE)
+				if scanner.Current-scanner.Start > 2 {
+					switch scanner.Source[scanner.Start+2] {
+					case 'u':
+						return scanner.checkKeyword(3, 1, "e", tokentype.TOKEN_TRUE)
+					case 'y':
+						return scanner.checkKeyword(3, 0, "", tokentype.TOKEN_TRY)
+					}
+				}
 			}
 		}
 	case 'v':
@@ -227,37 +361,169 @@ func (scanner *Scanner) identifierType() tokentype.TokenType {
 }
 
 func (scanner *Scanner) identifier() token.Token {
-	for isAlpha(scanner.peek()) || isDigit(scanner.peek()) {
+	for isAlpha(scanner.peek()) || unicode.IsDigit(scanner.peek()) {
 		scanner.advance()
 	}
 
 	return scanner.makeToken(scanner.identifierType())
 }
 
-func (scanner *Scanner) number() token.Token {
-	for isDigit(scanner.peek()) {
-		scanner.advance()
+func isBinaryDigit(c rune) bool {
+	return c == '0' || c == '1'
+}
+
+func isOctalDigit(c rune) bool {
+	return c >= '0' && c <= '7'
+}
+
+// number scans a number literal whose first digit has been consumed. Its
+// Literal is the text of the number without digit separators.
+func (scanner *Scanner) number(first rune) token.Token {
+	var text strings.Builder
+	text.WriteRune(first)
+	scanner.invalid = nil
+
+	if first == '0' {
+		switch scanner.peek() {
+		case 'x', 'X':
+			return scanner.prefixedNumber(&text, isHexDigit, "hexadecimal")
+		case 'b', 'B':
+			return scanner.prefixedNumber(&text, isBinaryDigit, "binary")
+		case 'o', 'O':
+			return scanner.prefixedNumber(&text, isOctalDigit, "octal")
+		}
 	}
 
+	scanner.digits(&text, isDigit, true)
+
 	// Look for a fractional part.
 	if scanner.peek() == '.' && isDigit(scanner.peekNext()) {
 		// Consume the ".".
+		text.WriteRune(scanner.advance())
+		scanner.digits(&text, isDigit, false)
+	}
+
+	// Look for an exponent.
+	if c := scanner.peek(); c == 'e' || c == 'E' {
+		offset, line, column := scanner.Current, scanner.Line, scanner.Column
+		text.WriteRune(scanner.advance())
+		if c := scanner.peek(); c == '+' || c == '-' {
+			text.WriteRune(scanner.advance())
+		}
+		if scanner.digits(&text, isDigit, false) == 0 {
+			scanner.invalidAt(offset, line, column, "Expect digits in exponent.")
+		}
+	}
+
+	if c := scanner.peek(); isAlpha(c) || unicode.IsDigit(c) {
+		scanner.invalidAt(scanner.Current, scanner.Line, scanner.Column,
+			fmt.Sprintf("Unexpected character '%c' in number.", c))
+	}
+	return scanner.numberToken(text.String())
+}
+
+// prefixedNumber scans the rest of a number after its leading 0, when it is
+// followed by the letter giving its base.
+func (scanner *Scanner) prefixedNumber(text *strings.Builder, valid func(rune) bool, base string) token.Token {
+	text.WriteRune(scanner.advance())
+	count := scanner.digits(text, valid, false)
+
+	if c := scanner.peek(); isAlpha(c) || unicode.IsDigit(c) {
+		scanner.invalidAt(scanner.Current, scanner.Line, scanner.Column,
+			fmt.Sprintf("Invalid digit '%c' in %s literal.", c, base))
+	}
+	if count == 0 {
+		scanner.invalidAt(scanner.Start, scanner.startLine, scanner.startColumn,
+			fmt.Sprintf("Expect digits after '%s'.", scanner.Source[scanner.Start:scanner.Start+2]))
+	}
+	return scanner.numberToken(text.String())
+}
+
+// digits adds a run of the digits valid accepts to text, and returns how
+// many there were. Digits may be separated by single underscores, which are
+// left out of text. afterDigit tells whether the run continues a digit that
+// has already been scanned.
+func (scanner *Scanner) digits(text *strings.Builder, valid func(rune) bool, afterDigit bool) int {
+	count := 0
+	for {
+		c := scanner.peek()
+		if valid(c) {
+			text.WriteRune(scanner.advance())
+			count++
+			afterDigit = true
+			continue
+		}
+		if c != '_' {
+			return count
+		}
+
+		offset, line, column := scanner.Current, scanner.Line, scanner.Column
 		scanner.advance()
+		if !afterDigit || !valid(scanner.peek()) {
+			scanner.invalidAt(offset, line, column, "Digit separators must be between digits.")
+		}
+		afterDigit = false
+	}
+}
 
-		for isDigit(scanner.peek()) {
+// numberToken makes a number token, or returns the error recorded while
+// scanning it once the rest of the malformed literal has been skipped.
+func (scanner *Scanner) numberToken(text string) token.Token {
+	if scanner.invalid != nil {
+		for c := scanner.peek(); isAlpha(c) || unicode.IsDigit(c); c = scanner.peek() {
 			scanner.advance()
 		}
 	}
+	return scanner.literalToken(tokentype.TOKEN_NUMBER, text)
+}
 
-	return scanner.makeToken(tokentype.TOKEN_NUMBER)
+// string scans a string literal whose opening quote, and its r prefix when
+// raw, have been consumed. Three quotes open a text block instead.
+func (scanner *Scanner) string(raw bool) token.Token {
+	if scanner.peek() == '"' && scanner.peekNext() == '"' {
+		scanner.advance()
+		scanner.advance()
+		return scanner.textBlock(raw)
+	}
+	if raw {
+		return scanner.rawString()
+	}
+	return scanner.stringSegment()
 }
 
-func (scanner *Scanner) string() token.Token {
+// stringSegment scans a string up to its closing quote, or up to the "${"
+// starting an interpolated expression. A string with interpolations is
+// scanned as a TOKEN_INTERPOLATION for the text before each expression,
+// followed by the tokens of the expression and its closing brace, and ends
+// with a TOKEN_STRING for the text after the last one.
+func (scanner *Scanner) stringSegment() token.Token {
+	var text strings.Builder
+	scanner.invalid = nil
 	for scanner.peek() != '"' && !scanner.isAtEnd() {
-		if scanner.peek() == '\n' {
-			scanner.Line++
+		if scanner.peek() == '$' && scanner.peekNext() == '{' {
+			scanner.advance()
+			scanner.advance()
+			scanner.interpolations = append(scanner.interpolations, 0)
+			return scanner.literalToken(tokentype.TOKEN_INTERPOLATION, text.String())
 		}
-		scanner.advance()
+		scanner.character(&text, false)
+	}
+
+	if scanner.isAtEnd() {
+		return scanner.errorToken("Unterminated string.")
+	}
+
+	// The closing quote.
+	scanner.advance()
+	return scanner.literalToken(tokentype.TOKEN_STRING, text.String())
+}
+
+// rawString scans a string that keeps backslashes and "${" as written.
+func (scanner *Scanner) rawString() token.Token {
+	var text strings.Builder
+	scanner.invalid = nil
+	for scanner.peek() != '"' && !scanner.isAtEnd() {
+		scanner.character(&text, true)
 	}
 
 	if scanner.isAtEnd() {
@@ -266,5 +532,203 @@ func (scanner *Scanner) string() token.Token {
 
 	// The closing quote.
 	scanner.advance()
-	return scanner.makeToken(tokentype.TOKEN_STRING)
+	return scanner.literalToken(tokentype.TOKEN_STRING, text.String())
+}
+
+// textBlock scans a string between triple quotes, the opening ones consumed.
+// When the opening quotes end their line, the string is made of the lines
+// that follow them, with the indentation they have in common removed and
+// blank lines left empty. Closing quotes on a line of their own count towards
+// that indentation, and their line is not part of the string.
+func (scanner *Scanner) textBlock(raw bool) token.Token {
+	end := scanner.textBlockEnd(raw)
+	if end < 0 {
+		for !scanner.isAtEnd() {
+			scanner.advance()
+		}
+		return scanner.errorToken("Unterminated string.")
+	}
+
+	var text strings.Builder
+	scanner.invalid = nil
+	lines := strings.Split(scanner.Source[scanner.Current:end], "\n")
+	if len(lines) == 1 || !isBlank(lines[0]) {
+		for scanner.Current < end {
+			scanner.character(&text, raw)
+		}
+	} else {
+		lines = lines[1:]
+		last := len(lines) - 1
+		indent := commonIndent(lines)
+		if isBlank(lines[last]) {
+			lines = lines[:last]
+		}
+
+		scanner.skipLine(end)
+		for i, line := range lines {
+			if i > 0 {
+				text.WriteByte('\n')
+			}
+			if isBlank(line) {
+				scanner.skipLine(end)
+				continue
+			}
+
+			for n := 0; n < indent; n++ {
+				scanner.advance()
+			}
+			for scanner.peek() != '\n' && scanner.Current < end {
+				scanner.character(&text, raw)
+			}
+			scanner.skipLine(end)
+		}
+		for scanner.Current < end {
+			scanner.advance()
+		}
+	}
+
+	// The closing quotes.
+	scanner.advance()
+	scanner.advance()
+	scanner.advance()
+	return scanner.literalToken(tokentype.TOKEN_STRING, text.String())
+}
+
+// textBlockEnd returns the offset of the quotes closing the text block that
+// starts at Current, or -1 when it is unterminated.
+func (scanner *Scanner) textBlockEnd(raw bool) int {
+	for i := scanner.Current; i < len(scanner.Source); i++ {
+		switch scanner.Source[i] {
+		case '\\':
+			if !raw {
+				i++
+			}
+		case '"':
+			if strings.HasPrefix(scanner.Source[i:], `"""`) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// skipLine advances past the rest of the line, stopping at end.
+func (scanner *Scanner) skipLine(end int) {
+	for scanner.Current < end {
+		if scanner.advance() == '\n' {
+			return
+		}
+	}
+}
+
+func isBlank(line string) bool {
+	return strings.TrimLeft(line, " \t\r") == ""
+}
+
+// commonIndent returns the number of spaces and tabs that start every line
+// that is not blank, or the last line, which holds the closing quotes.
+func commonIndent(lines []string) int {
+	indent := -1
+	for i, line := range lines {
+		if isBlank(line) && i != len(lines)-1 {
+			continue
+		}
+
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	return indent
+}
+
+// character adds the next character of a string literal to text, decoding
+// an escape sequence unless the string is raw.
+func (scanner *Scanner) character(text *strings.Builder, raw bool) {
+	if raw || scanner.peek() != '\\' {
+		start := scanner.Current
+		scanner.advance()
+		text.WriteString(scanner.Source[start:scanner.Current])
+		return
+	}
+
+	start, line, column := scanner.Current, scanner.Line, scanner.Column
+	scanner.advance()
+	if scanner.isAtEnd() {
+		return
+	}
+
+	switch c := scanner.advance(); c {
+	case 'n':
+		text.WriteByte('\n')
+	case 't':
+		text.WriteByte('\t')
+	case 'r':
+		text.WriteByte('\r')
+	case '0':
+		text.WriteByte(0)
+	case '"', '\\', '$':
+		text.WriteRune(c)
+	case 'u':
+		if r, ok := scanner.unicodeEscape(); ok {
+			text.WriteRune(r)
+		} else {
+			scanner.invalidAt(start, line, column,
+				fmt.Sprintf("Invalid unicode escape '%s'.", scanner.Source[start:scanner.Current]))
+		}
+	default:
+		message := "Invalid escape sequence."
+		if unicode.IsPrint(c) {
+			message = fmt.Sprintf("Invalid escape sequence '%s'.", scanner.Source[start:scanner.Current])
+		}
+		scanner.invalidAt(start, line, column, message)
+	}
+}
+
+// unicodeEscape reads the braces and hex digits that follow a \u, which
+// must name a Unicode scalar value.
+func (scanner *Scanner) unicodeEscape() (rune, bool) {
+	if !scanner.match('{') {
+		return 0, false
+	}
+
+	start := scanner.Current
+	for isHexDigit(scanner.peek()) {
+		scanner.advance()
+	}
+	digits := scanner.Source[start:scanner.Current]
+	if !scanner.match('}') || len(digits) == 0 || len(digits) > 6 {
+		return 0, false
+	}
+
+	code, _ := strconv.ParseUint(digits, 16, 32)
+	if !utf8.ValidRune(rune(code)) {
+		return 0, false
+	}
+	return rune(code), true
+}
+
+// invalidAt records message for the part of a literal at offset, unless an
+// earlier part of the same literal was already invalid.
+func (scanner *Scanner) invalidAt(offset int, line int, column int, message string) {
+	if scanner.invalid != nil {
+		return
+	}
+
+	tkn := token.MakeToken(tokentype.TOKEN_ERROR, message, line)
+	tkn.Column = column
+	tkn.Offset = offset
+	scanner.invalid = &tkn
+}
+
+// literalToken makes a string or number token holding text, or returns the
+// error recorded while scanning it.
+func (scanner *Scanner) literalToken(tokenType tokentype.TokenType, text string) token.Token {
+	if scanner.invalid != nil {
+		return *scanner.invalid
+	}
+
+	tkn := scanner.makeToken(tokenType)
+	tkn.Literal = text
+	return tkn
 }
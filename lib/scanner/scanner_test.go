@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"golox-lang/lib/scanner/token/tokentype"
+	"strings"
 	"testing"
 )
 
@@ -38,16 +39,61 @@ func TestScanToken(t *testing.T) {
 				wantedTokenType: tokentype.TOKEN_LEFT_BRACE,
 				wantedLexeme:    "{",
 			},
+			{
+				source:          "[",
+				wantedTokenType: tokentype.TOKEN_LEFT_BRACKET,
+				wantedLexeme:    "[",
+			},
+			{
+				source:          "]",
+				wantedTokenType: tokentype.TOKEN_RIGHT_BRACKET,
+				wantedLexeme:    "]",
+			},
+			{
+				source:          ":",
+				wantedTokenType: tokentype.TOKEN_COLON,
+				wantedLexeme:    ":",
+			},
 			{
 				source:          "and",
 				wantedTokenType: tokentype.TOKEN_AND,
 				wantedLexeme:    "and",
 			},
+			{
+				source:          "as",
+				wantedTokenType: tokentype.TOKEN_AS,
+				wantedLexeme:    "as",
+			},
+			{
+				source:          "import",
+				wantedTokenType: tokentype.TOKEN_IMPORT,
+				wantedLexeme:    "import",
+			},
+			{
+				source:          "from",
+				wantedTokenType: tokentype.TOKEN_FROM,
+				wantedLexeme:    "from",
+			},
+			{
+				source:          "catch",
+				wantedTokenType: tokentype.TOKEN_CATCH,
+				wantedLexeme:    "catch",
+			},
 			{
 				source:          "class",
 				wantedTokenType: tokentype.TOKEN_CLASS,
 				wantedLexeme:    "class",
 			},
+			{
+				source:          "%",
+				wantedTokenType: tokentype.TOKEN_PERCENT,
+				wantedLexeme:    "%",
+			},
+			{
+				source:          "**",
+				wantedTokenType: tokentype.TOKEN_STAR_STAR,
+				wantedLexeme:    "**",
+			},
 			{
 				source:          "!",
 				wantedTokenType: tokentype.TOKEN_BANG,
@@ -223,11 +269,31 @@ func TestScanToken(t *testing.T) {
 				wantedTokenType: tokentype.TOKEN_THIS,
 				wantedLexeme:    "this",
 			},
+			{
+				source:          "throw",
+				wantedTokenType: tokentype.TOKEN_THROW,
+				wantedLexeme:    "throw",
+			},
 			{
 				source:          "true",
 				wantedTokenType: tokentype.TOKEN_TRUE,
 				wantedLexeme:    "true",
 			},
+			{
+				source:          "try",
+				wantedTokenType: tokentype.TOKEN_TRY,
+				wantedLexeme:    "try",
+			},
+			{
+				source:          "tr",
+				wantedTokenType: tokentype.TOKEN_IDENTIFIER,
+				wantedLexeme:    "tr",
+			},
+			{
+				source:          "finally",
+				wantedTokenType: tokentype.TOKEN_FINALLY,
+				wantedLexeme:    "finally",
+			},
 			{
 				source:          "var",
 				wantedTokenType: tokentype.TOKEN_VAR,
@@ -251,3 +317,236 @@ func TestScanToken(t *testing.T) {
 		}
 	})
 }
+
+func TestScanUnicode(t *testing.T) {
+	type scanned struct {
+		tokenType tokentype.TokenType
+		lexeme    string
+	}
+
+	tests := []struct {
+		source string
+		tokens []scanned
+	}{
+		{`var café = "naïve ☕";`, []scanned{
+			{tokentype.TOKEN_VAR, "var"},
+			{tokentype.TOKEN_IDENTIFIER, "café"},
+			{tokentype.TOKEN_EQUAL, "="},
+			{tokentype.TOKEN_STRING, `"naïve ☕"`},
+			{tokentype.TOKEN_SEMICOLON, ";"},
+		}},
+		{"π2 * 日本語 // ünïcode comment\n+ x", []scanned{
+			{tokentype.TOKEN_IDENTIFIER, "π2"},
+			{tokentype.TOKEN_STAR, "*"},
+			{tokentype.TOKEN_IDENTIFIER, "日本語"},
+			{tokentype.TOKEN_PLUS, "+"},
+			{tokentype.TOKEN_IDENTIFIER, "x"},
+		}},
+		{"x٣ ٣", []scanned{
+			{tokentype.TOKEN_IDENTIFIER, "x٣"},
+			{tokentype.TOKEN_ERROR, "Unexpected character."},
+		}},
+		{"\"😀\"\xff1", []scanned{
+			{tokentype.TOKEN_STRING, `"😀"`},
+			{tokentype.TOKEN_ERROR, "Unexpected character."},
+			{tokentype.TOKEN_NUMBER, "1"},
+		}},
+	}
+
+	for _, test := range tests {
+		s := New(test.source)
+		for _, want := range test.tokens {
+			if got := s.ScanToken(); got.Type != want.tokenType || got.Lexeme != want.lexeme {
+				t.Errorf("scanner.ScanToken() failed for %q, expected token %q of type %v, got token %q of type %v",
+					test.source, want.lexeme, want.tokenType, got.Lexeme, got.Type)
+			}
+		}
+		if got := s.ScanToken(); got.Type != tokentype.TOKEN_EOF {
+			t.Errorf("scanner.ScanToken() failed for %q, expected %v, got token %q of type %v", test.source, tokentype.TOKEN_EOF, got.Lexeme, got.Type)
+		}
+	}
+}
+
+// benchmarkScan scans source to the end once per iteration.
+func benchmarkScan(b *testing.B, source string) {
+	b.SetBytes(int64(len(source)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(source)
+		for s.ScanToken().Type != tokentype.TOKEN_EOF {
+		}
+	}
+}
+
+func BenchmarkScanASCII(b *testing.B) {
+	line := "var total = total + items[index] * 2.5; // running sum\n"
+	benchmarkScan(b, strings.Repeat(line, (4<<20)/len(line)))
+}
+
+func BenchmarkScanUnicode(b *testing.B) {
+	line := "var größe = \"日本語のテキスト ☕\" + π; // ünïcode\n"
+	benchmarkScan(b, strings.Repeat(line, (4<<20)/len(line)))
+}
+
+func TestScanPositions(t *testing.T) {
+	s := New("var é = 1;\n\t\"a\nb\" + x")
+
+	expected := []struct {
+		lexeme string
+		line   int
+		column int
+		offset int
+	}{
+		{"var", 1, 1, 0},
+		{"é", 1, 5, 4},
+		{"=", 1, 7, 7},
+		{"1", 1, 9, 9},
+		{";", 1, 10, 10},
+		{"\"a\nb\"", 2, 2, 13},
+		{"+", 3, 4, 19},
+		{"x", 3, 6, 21},
+	}
+	for _, want := range expected {
+		if got := s.ScanToken(); got.Lexeme != want.lexeme || got.Line != want.line || got.Column != want.column || got.Offset != want.offset {
+			t.Errorf("scanner.ScanToken() failed, expected %q at %v:%v (byte %v), got %q at %v:%v (byte %v)",
+				want.lexeme, want.line, want.column, want.offset, got.Lexeme, got.Line, got.Column, got.Offset)
+		}
+	}
+}
+
+func TestScanStrings(t *testing.T) {
+	tests := []struct {
+		source    string
+		tokenType tokentype.TokenType
+		// literal is the value of a string, or the message of an error.
+		literal string
+		column  int
+	}{
+		{`"a\tb\n\"c\"\\"`, tokentype.TOKEN_STRING, "a\tb\n\"c\"\\", 1},
+		{`"\u{48}\u{1F600}\0"`, tokentype.TOKEN_STRING, "H😀\x00", 1},
+		{`r"C:\new\"`, tokentype.TOKEN_STRING, `C:\new\`, 1},
+		{`""`, tokentype.TOKEN_STRING, "", 1},
+		{"\"\"\"\n    one\n      two\n\n    three\n    \"\"\"", tokentype.TOKEN_STRING, "one\n  two\n\nthree", 1},
+		{"\"\"\"\n    one\n  \"\"\"", tokentype.TOKEN_STRING, "  one", 1},
+		{"\"\"\"\n\t\\tone\n\ttwo\"\"\"", tokentype.TOKEN_STRING, "\tone\ntwo", 1},
+		{`"""say "hi"\n"""`, tokentype.TOKEN_STRING, "say \"hi\"\n", 1},
+		{"r\"\"\"\n  \\n\n  \"\"\"", tokentype.TOKEN_STRING, `\n`, 1},
+		{`x = "ab\qc\z"`, tokentype.TOKEN_ERROR, `Invalid escape sequence '\q'.`, 8},
+		{`"\u{D800}"`, tokentype.TOKEN_ERROR, `Invalid unicode escape '\u{D800}'.`, 2},
+		{`"\u{1234567}"`, tokentype.TOKEN_ERROR, `Invalid unicode escape '\u{1234567}'.`, 2},
+		{`"\u41"`, tokentype.TOKEN_ERROR, `Invalid unicode escape '\u'.`, 2},
+		{`"abc\"`, tokentype.TOKEN_ERROR, "Unterminated string.", 1},
+		{`"""abc""`, tokentype.TOKEN_ERROR, "Unterminated string.", 1},
+	}
+
+	for _, test := range tests {
+		s := New(test.source)
+		tkn := s.ScanToken()
+		for tkn.Type != test.tokenType && tkn.Type != tokentype.TOKEN_EOF {
+			tkn = s.ScanToken()
+		}
+
+		got := tkn.Literal
+		if tkn.Type == tokentype.TOKEN_ERROR {
+			got = tkn.Lexeme
+		}
+		if tkn.Type != test.tokenType || got != test.literal || tkn.Column != test.column {
+			t.Errorf("scanner.ScanToken() failed for %q, expected %q of type %v at column %v, got %q of type %v at column %v",
+				test.source, test.literal, test.tokenType, test.column, got, tkn.Type, tkn.Column)
+		}
+		if tkn.Type == tokentype.TOKEN_STRING {
+			if next := s.ScanToken(); next.Type != tokentype.TOKEN_EOF {
+				t.Errorf("scanner.ScanToken() failed for %q, expected the string to end the source, got %q", test.source, next.Lexeme)
+			}
+		}
+	}
+}
+
+func TestScanInterpolation(t *testing.T) {
+	s := New(`"a ${x + {"k": "${y}"}["k"]} b\${c}" }`)
+
+	expected := []struct {
+		tokenType tokentype.TokenType
+		literal   string
+	}{
+		{tokentype.TOKEN_INTERPOLATION, "a "},
+		{tokentype.TOKEN_IDENTIFIER, ""},
+		{tokentype.TOKEN_PLUS, ""},
+		{tokentype.TOKEN_LEFT_BRACE, ""},
+		{tokentype.TOKEN_STRING, "k"},
+		{tokentype.TOKEN_COLON, ""},
+		{tokentype.TOKEN_INTERPOLATION, ""},
+		{tokentype.TOKEN_IDENTIFIER, ""},
+		{tokentype.TOKEN_RIGHT_BRACE, ""},
+		{tokentype.TOKEN_STRING, ""},
+		{tokentype.TOKEN_RIGHT_BRACE, ""},
+		{tokentype.TOKEN_LEFT_BRACKET, ""},
+		{tokentype.TOKEN_STRING, "k"},
+		{tokentype.TOKEN_RIGHT_BRACKET, ""},
+		{tokentype.TOKEN_RIGHT_BRACE, ""},
+		{tokentype.TOKEN_STRING, " b${c}"},
+		{tokentype.TOKEN_RIGHT_BRACE, ""},
+		{tokentype.TOKEN_EOF, ""},
+	}
+	for _, want := range expected {
+		if got := s.ScanToken(); got.Type != want.tokenType || got.Literal != want.literal {
+			t.Errorf("scanner.ScanToken() failed, expected %q of type %v, got %q (%q) of type %v",
+				want.literal, want.tokenType, got.Literal, got.Lexeme, got.Type)
+		}
+	}
+}
+
+func TestScanNumbers(t *testing.T) {
+	tests := []struct {
+		source    string
+		tokenType tokentype.TokenType
+		// literal is the digits of a number, or the message of an error.
+		literal string
+		column  int
+	}{
+		{"12.5", tokentype.TOKEN_NUMBER, "12.5", 1},
+		{"1_000_000", tokentype.TOKEN_NUMBER, "1000000", 1},
+		{"0xFF_ff", tokentype.TOKEN_NUMBER, "0xFFff", 1},
+		{"0b1010", tokentype.TOKEN_NUMBER, "0b1010", 1},
+		{"0O755", tokentype.TOKEN_NUMBER, "0O755", 1},
+		{"1e-9", tokentype.TOKEN_NUMBER, "1e-9", 1},
+		{"2.5E+1_0", tokentype.TOKEN_NUMBER, "2.5E+10", 1},
+		{"x = 0x;", tokentype.TOKEN_ERROR, "Expect digits after '0x'.", 5},
+		{"x = 0b;", tokentype.TOKEN_ERROR, "Expect digits after '0b'.", 5},
+		{"x = 1e;", tokentype.TOKEN_ERROR, "Expect digits in exponent.", 6},
+		{"x = 1.5e+;", tokentype.TOKEN_ERROR, "Expect digits in exponent.", 8},
+		{"x = 0b102;", tokentype.TOKEN_ERROR, "Invalid digit '2' in binary literal.", 9},
+		{"x = 0o78;", tokentype.TOKEN_ERROR, "Invalid digit '8' in octal literal.", 8},
+		{"x = 0xFG;", tokentype.TOKEN_ERROR, "Invalid digit 'G' in hexadecimal literal.", 8},
+		{"x = 1__0;", tokentype.TOKEN_ERROR, "Digit separators must be between digits.", 6},
+		{"x = 1_;", tokentype.TOKEN_ERROR, "Digit separators must be between digits.", 6},
+		{"x = 0x_1;", tokentype.TOKEN_ERROR, "Digit separators must be between digits.", 7},
+		{"x = 12ab;", tokentype.TOKEN_ERROR, "Unexpected character 'a' in number.", 7},
+	}
+
+	for _, test := range tests {
+		s := New(test.source)
+		tkn := s.ScanToken()
+		for tkn.Type != test.tokenType && tkn.Type != tokentype.TOKEN_EOF {
+			tkn = s.ScanToken()
+		}
+
+		got := tkn.Literal
+		if tkn.Type == tokentype.TOKEN_ERROR {
+			got = tkn.Lexeme
+		}
+		if tkn.Type != test.tokenType || got != test.literal || tkn.Column != test.column {
+			t.Errorf("scanner.ScanToken() failed for %q, expected %q of type %v at column %v, got %q of type %v at column %v",
+				test.source, test.literal, test.tokenType, test.column, got, tkn.Type, tkn.Column)
+		}
+
+		// a malformed literal is skipped as a whole
+		wantNext := tokentype.TOKEN_EOF
+		if tkn.Type == tokentype.TOKEN_ERROR {
+			wantNext = tokentype.TOKEN_SEMICOLON
+		}
+		if next := s.ScanToken(); next.Type != wantNext {
+			t.Errorf("scanner.ScanToken() failed for %q, expected %v after the number, got %q", test.source, wantNext, next.Lexeme)
+		}
+	}
+}
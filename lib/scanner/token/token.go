@@ -6,6 +6,14 @@ type Token struct {
 	Type   tokentype.TokenType
 	Lexeme string
 	Line   int
+	// Column is where the token starts on its line, counting characters
+	// from 1, and Offset is the byte offset of its start in the source.
+	Column int
+	Offset int
+	// Literal is the text a string token stands for, without its quotes and
+	// with its escape sequences replaced, or the digits of a number token
+	// without their separators.
+	Literal string
 }
 
 func MakeToken(tokenType tokentype.TokenType, lexem string, line int) Token {
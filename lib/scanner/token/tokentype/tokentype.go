@@ -4,51 +4,64 @@ type TokenType byte
 
 const (
 	// Single-character tokens.
-	TOKEN_LEFT_PAREN  TokenType = iota // 0
-	TOKEN_RIGHT_PAREN                  // 1
-	TOKEN_LEFT_BRACE                   // 2
-	TOKEN_RIGHT_BRACE                  // 3
-	TOKEN_COMMA                        // 4
-	TOKEN_DOT                          // 5
-	TOKEN_MINUS                        // 6
-	TOKEN_PLUS                         // 7
-	TOKEN_SEMICOLON                    // 8
-	TOKEN_SLASH                        // 9
-	TOKEN_STAR                         // 10
+	TOKEN_LEFT_PAREN    TokenType = iota // 0
+	TOKEN_RIGHT_PAREN                    // 1
+	TOKEN_LEFT_BRACE                     // 2
+	TOKEN_RIGHT_BRACE                    // 3
+	TOKEN_LEFT_BRACKET                   // 4
+	TOKEN_RIGHT_BRACKET                  // 5
+	TOKEN_COLON                          // 6
+	TOKEN_COMMA                          // 7
+	TOKEN_DOT                            // 8
+	TOKEN_MINUS                          // 9
+	TOKEN_PERCENT                        // 10
+	TOKEN_PLUS                           // 11
+	TOKEN_SEMICOLON                      // 12
+	TOKEN_SLASH                          // 13
+	TOKEN_STAR                           // 14
 
 	// One or two character tokens.
-	TOKEN_BANG          // 11
-	TOKEN_BANG_EQUAL    // 12
-	TOKEN_EQUAL         // 13
-	TOKEN_EQUAL_EQUAL   // 14
-	TOKEN_GREATER       // 15
-	TOKEN_GREATER_EQUAL // 16
-	TOKEN_LESS          // 17
-	TOKEN_LESS_EQUAL    // 18
+	TOKEN_BANG          // 15
+	TOKEN_BANG_EQUAL    // 16
+	TOKEN_EQUAL         // 17
+	TOKEN_EQUAL_EQUAL   // 18
+	TOKEN_GREATER       // 19
+	TOKEN_GREATER_EQUAL // 20
+	TOKEN_LESS          // 21
+	TOKEN_LESS_EQUAL    // 22
+	TOKEN_STAR_STAR     // 23
 
 	// Literals.
-	TOKEN_IDENTIFIER // 19
-	TOKEN_STRING     // 20
-	TOKEN_NUMBER     // 21
+	TOKEN_IDENTIFIER    // 24
+	TOKEN_STRING        // 25
+	TOKEN_INTERPOLATION // 26
+	TOKEN_NUMBER        // 27
 
 	// Keywords.
-	TOKEN_AND    // 22
-	TOKEN_CLASS  // 23
-	TOKEN_ELSE   // 24
-	TOKEN_FALSE  // 25
-	TOKEN_FOR    // 26
-	TOKEN_FUN    // 27
-	TOKEN_IF     // 28
-	TOKEN_NIL    // 29
-	TOKEN_OR     // 30
-	TOKEN_PRINT  // 31
-	TOKEN_RETURN // 32
-	TOKEN_SUPER  // 33
-	TOKEN_THIS   // 34
-	TOKEN_TRUE   // 35
-	TOKEN_VAR    // 36
-	TOKEN_WHILE  // 37
+	TOKEN_AND     // 28
+	TOKEN_AS      // 29
+	TOKEN_CATCH   // 30
+	TOKEN_CLASS   // 31
+	TOKEN_ELSE    // 32
+	TOKEN_FALSE   // 33
+	TOKEN_FINALLY // 34
+	TOKEN_FOR     // 35
+	TOKEN_FROM    // 36
+	TOKEN_FUN     // 37
+	TOKEN_IF      // 38
+	TOKEN_IMPORT  // 39
+	TOKEN_NIL     // 40
+	TOKEN_OR      // 41
+	TOKEN_PRINT   // 42
+	TOKEN_RETURN  // 43
+	TOKEN_SUPER   // 44
+	TOKEN_THIS    // 45
+	TOKEN_THROW   // 46
+	TOKEN_TRUE    // 47
+	TOKEN_TRY     // 48
+	TOKEN_VAR     // 49
+	TOKEN_WHILE   // 50
 
-	TOKEN_ERROR // 38
-	TOKEN_EOF   // 39
+	TOKEN_ERROR // 51
+	TOKEN_EOF   // 52
 )
@@ -0,0 +1,65 @@
+package value
+
+// Global is the slot of one global variable. A slot is made the first time
+// code refers to its name, which can be before the variable is defined, and
+// stays undefined until then.
+type Global struct {
+	Name    string
+	Value   Value
+	Defined bool
+}
+
+// Globals holds the global variables of a module. A name keeps its slot for
+// as long as the module lives, so compiled code can be linked to the slots
+// once and reach them by index from then on.
+type Globals struct {
+	slots map[string]*Global
+}
+
+func NewGlobals() *Globals {
+	return &Globals{slots: make(map[string]*Global)}
+}
+
+// Slot returns the slot of name, making an undefined one if there is none.
+func (globals *Globals) Slot(name string) *Global {
+	global, present := globals.slots[name]
+	if !present {
+		global = &Global{Name: name, Value: NilValue()}
+		globals.slots[name] = global
+	}
+	return global
+}
+
+// Link returns the slots of names, in order. It is how a compiled script's
+// global indices are turned into the variables of the module it runs in.
+func (globals *Globals) Link(names []string) []*Global {
+	linked := make([]*Global, len(names))
+	for i, name := range names {
+		linked[i] = globals.Slot(name)
+	}
+	return linked
+}
+
+// Get returns the value of the variable called name, if it is defined.
+func (globals *Globals) Get(name string) (Value, bool) {
+	global, present := globals.slots[name]
+	if !present || !global.Defined {
+		return NilValue(), false
+	}
+	return global.Value, true
+}
+
+// Set defines the variable called name, or assigns it if it already is.
+func (globals *Globals) Set(name string, val Value) {
+	global := globals.Slot(name)
+	global.Value = val
+	global.Defined = true
+}
+
+// Delete makes the variable called name undefined again.
+func (globals *Globals) Delete(name string) {
+	if global, present := globals.slots[name]; present {
+		global.Value = NilValue()
+		global.Defined = false
+	}
+}
@@ -0,0 +1,105 @@
+package value
+
+import (
+	"golox-lang/lib/object"
+	"golox-lang/lib/object/objtype"
+	"golox-lang/lib/value/valuetype"
+	"unsafe"
+)
+
+type HashKey struct {
+	Type valuetype.ValueType
+	Data interface{}
+}
+
+type MapEntry struct {
+	Key   Value
+	Value Value
+}
+
+// ObjMap keeps its entries in insertion order, the index maps a key to its
+// position in Entries.
+type ObjMap struct {
+	object.Obj
+	Entries []MapEntry
+	index   map[HashKey]int
+}
+
+func NewMap() *ObjMap {
+	return &ObjMap{Obj: object.Obj{Type: objtype.OBJ_MAP}, Entries: make([]MapEntry, 0), index: make(map[HashKey]int)}
+}
+
+func NewObjMap(val *ObjMap) Value {
+	return ObjValue((*object.Obj)(unsafe.Pointer(val)))
+}
+
+func (value Value) AsMap() *ObjMap {
+	return (*ObjMap)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) IsMap() bool {
+	return value.isobjtype(objtype.OBJ_MAP)
+}
+
+// HashKeyOf returns the key under which value is stored in a map. Strings
+// hash by content and every other object by identity, mirroring ValuesEqual.
+// Lists and maps are mutable containers and can't be used as keys.
+func HashKeyOf(value Value) (HashKey, bool) {
+	switch value.Type {
+	case valuetype.VAL_BOOL:
+		return HashKey{Type: value.Type, Data: value.AsBool()}, true
+	case valuetype.VAL_NIL:
+		return HashKey{Type: value.Type}, true
+	case valuetype.VAL_NUMBER:
+		return HashKey{Type: value.Type, Data: value.AsNumber()}, true
+	case valuetype.VAL_OBJ:
+		if value.IsString() {
+			return HashKey{Type: value.Type, Data: value.AsGoString()}, true
+		}
+		if value.IsList() || value.IsMap() {
+			return HashKey{}, false
+		}
+		return HashKey{Type: value.Type, Data: value.AsObj()}, true
+	default:
+		return HashKey{}, false
+	}
+}
+
+func (m *ObjMap) Get(key HashKey) (Value, bool) {
+	i, present := m.index[key]
+	if !present {
+		return Value{}, false
+	}
+	return m.Entries[i].Value, true
+}
+
+func (m *ObjMap) Set(key HashKey, k Value, v Value) {
+	if i, present := m.index[key]; present {
+		m.Entries[i].Value = v
+		return
+	}
+
+	m.index[key] = len(m.Entries)
+	m.Entries = append(m.Entries, MapEntry{Key: k, Value: v})
+}
+
+// Replace makes m hold the entries of other.
+func (m *ObjMap) Replace(other *ObjMap) {
+	m.Entries = other.Entries
+	m.index = other.index
+}
+
+func (m *ObjMap) Delete(key HashKey) bool {
+	i, present := m.index[key]
+	if !present {
+		return false
+	}
+
+	delete(m.index, key)
+	m.Entries = append(m.Entries[:i], m.Entries[i+1:]...)
+	for j := i; j < len(m.Entries); j++ {
+		hashKey, _ := HashKeyOf(m.Entries[j].Key)
+		m.index[hashKey] = j
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package value
+
+import (
+	"golox-lang/lib/value/valuetype"
+	"testing"
+)
+
+func TestMapSetGet(t *testing.T) {
+	m := NewMap()
+
+	first, _ := HashKeyOf(NewObjString("key"))
+	m.Set(first, NewObjString("key"), New(valuetype.VAL_NUMBER, 1.0))
+
+	// a different string object with the same content must find the entry
+	second, _ := HashKeyOf(NewObjString("key"))
+	if val, present := m.Get(second); !present || val.AsNumber() != 1 {
+		t.Errorf("ObjMap.Get(...) failed, expected to find string key by content")
+	}
+
+	m.Set(second, NewObjString("key"), New(valuetype.VAL_NUMBER, 2.0))
+	if len(m.Entries) != 1 {
+		t.Errorf("ObjMap.Set(...) failed, expected to overwrite the entry, got %v entries", len(m.Entries))
+	}
+}
+
+func TestMapDelete(t *testing.T) {
+	m := NewMap()
+	for i := 0; i < 3; i++ {
+		key, _ := HashKeyOf(New(valuetype.VAL_NUMBER, float64(i)))
+		m.Set(key, New(valuetype.VAL_NUMBER, float64(i)), New(valuetype.VAL_NIL, nil))
+	}
+
+	key, _ := HashKeyOf(New(valuetype.VAL_NUMBER, 0.0))
+	if !m.Delete(key) || m.Delete(key) {
+		t.Errorf("ObjMap.Delete(...) failed, expected to delete an existing key exactly once")
+	}
+
+	last, _ := HashKeyOf(New(valuetype.VAL_NUMBER, 2.0))
+	if _, present := m.Get(last); !present || m.Entries[1].Key.AsNumber() != 2 {
+		t.Errorf("ObjMap.Delete(...) failed, expected remaining entries to keep their order")
+	}
+}
+
+func TestHashKeyOf(t *testing.T) {
+	if _, ok := HashKeyOf(NewObjList(nil)); ok {
+		t.Errorf("value.HashKeyOf(...) failed, expected lists to be unhashable")
+	}
+
+	klass := NewObjClass("A").AsClass()
+	a, _ := HashKeyOf(NewObjInstance(klass))
+	b, _ := HashKeyOf(NewObjInstance(klass))
+	if a == b {
+		t.Errorf("value.HashKeyOf(...) failed, expected instances to hash by identity")
+	}
+}
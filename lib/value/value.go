@@ -5,26 +5,101 @@ import (
 	"golox-lang/lib/object"
 	"golox-lang/lib/object/objtype"
 	"golox-lang/lib/value/valuetype"
+	"strings"
 	"unsafe"
 )
 
 type FuncChunk interface {
 	GetCode() []byte
-	GetLines() []int
+	GetPosition(offset int) (line int, column int)
 	GetConstants() ValueArray
 }
 
 type ObjFunction struct {
 	object.Obj
-	Arity int
-	Chunk FuncChunk
-	Name  *ObjString
+	Arity        int
+	UpvalueCount int
+	Chunk        FuncChunk
+	Name         *ObjString
+	// GlobalNames is set on a script's top-level function and names the
+	// global slots that the script and its nested functions index.
+	GlobalNames []string
+	// Source is what the function was compiled from, or nil when it was
+	// loaded from a compiled file.
+	Source *Source
+}
+
+// Source is the text of a script, shared by all of its functions so that
+// errors can quote the line they happened on.
+type Source struct {
+	// Path is the file the script was read from, empty if it has none.
+	Path string
+	Text string
+}
+
+type ObjUpvalue struct {
+	object.Obj
+	Location int
+	Closed   Value
+	IsClosed bool
+	Next     *ObjUpvalue
+}
+
+type ObjClosure struct {
+	object.Obj
+	Function *ObjFunction
+	Upvalues []*ObjUpvalue
+	Module   *ObjModule
+	// Globals are the module's slots for the function's GlobalNames,
+	// shared by every closure made from the same script.
+	Globals []*Global
+}
+
+type ObjModule struct {
+	object.Obj
+	Name string
+	// Path is the resolved path the module is registered under.
+	Path string
+	// DisplayPath is the path errors in the module are reported with, as
+	// given by the user for the main script.
+	DisplayPath string
+	Globals     *Globals
+	Loaded      bool
+}
+
+// NativeFn is a function implemented in Go. A non-nil error is raised as a
+// runtime error in the calling script.
+type NativeFn func(argCount int, args []Value) (Value, error)
+
+// VARIADIC as the Max of an Arity accepts any number of arguments past Min.
+const VARIADIC = -1
+
+// Arity is the number of arguments a native accepts, from Min to Max.
+type Arity struct {
+	Min int
+	Max int
 }
 
-type NativeFn func(argCount int, args []Value) Value
+func ExactArity(count int) Arity {
+	return Arity{Min: count, Max: count}
+}
+
+func RangeArity(min int, max int) Arity {
+	return Arity{Min: min, Max: max}
+}
+
+func VariadicArity(min int) Arity {
+	return Arity{Min: min, Max: VARIADIC}
+}
+
+func (arity Arity) Accepts(argCount int) bool {
+	return argCount >= arity.Min && (arity.Max == VARIADIC || argCount <= arity.Max)
+}
 
 type ObjNative struct {
 	object.Obj
+	Name     string
+	Arity    Arity
 	Function NativeFn
 }
 
@@ -36,7 +111,11 @@ type ObjString struct {
 type ObjClass struct {
 	object.Obj
 	Name    string
-	Methods map[string]*ObjFunction
+	Methods map[string]*ObjClosure
+	// NativeMethods are implemented in Go and get the receiver as their
+	// first argument.
+	NativeMethods map[string]*ObjNative
+	SuperClass    *ObjClass
 }
 
 type ObjInstance struct {
@@ -45,19 +124,68 @@ type ObjInstance struct {
 	Fields map[string]Value
 }
 
+type ObjList struct {
+	object.Obj
+	Items []Value
+}
+
+type ObjBoundBuiltin struct {
+	object.Obj
+	Receiver Value
+	Name     string
+}
+
 type ObjBoundMethod struct {
 	object.Obj
 	Receiver Value
-	Method   *ObjFunction
+	Method   *ObjClosure
 }
 
+// Value is a tagged union. Numbers and booleans are stored unboxed in number,
+// with booleans as 0 or 1, and objects in obj, so only objects allocate.
 type Value struct {
-	Type valuetype.ValueType
-	Data interface{}
+	Type   valuetype.ValueType
+	number float64
+	obj    *object.Obj
+}
+
+func NilValue() Value {
+	return Value{Type: valuetype.VAL_NIL}
+}
+
+func BoolValue(val bool) Value {
+	if val {
+		return Value{Type: valuetype.VAL_BOOL, number: 1}
+	}
+	return Value{Type: valuetype.VAL_BOOL}
+}
+
+func NumberValue(val float64) Value {
+	return Value{Type: valuetype.VAL_NUMBER, number: val}
+}
+
+func ObjValue(obj *object.Obj) Value {
+	return Value{Type: valuetype.VAL_OBJ, obj: obj}
 }
 
+// New builds a value of valType from a bool, a number or an *object.Obj.
+// Prefer the typed constructors, which don't box their argument.
 func New(valType valuetype.ValueType, val interface{}) Value {
-	return Value{Type: valType, Data: val}
+	switch valType {
+	case valuetype.VAL_BOOL:
+		return BoolValue(val.(bool))
+	case valuetype.VAL_NUMBER:
+		switch number := val.(type) {
+		case int:
+			return NumberValue(float64(number))
+		default:
+			return NumberValue(number.(float64))
+		}
+	case valuetype.VAL_OBJ:
+		return ObjValue(val.(*object.Obj))
+	default:
+		return NilValue()
+	}
 }
 
 func NewFunction(c FuncChunk) *ObjFunction {
@@ -66,54 +194,89 @@ func NewFunction(c FuncChunk) *ObjFunction {
 }
 
 func NewObjFunction(val *ObjFunction) Value {
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(val))}
+	return ObjValue((*object.Obj)(unsafe.Pointer(val)))
+}
+
+func NewUpvalue(slot int) *ObjUpvalue {
+	return &ObjUpvalue{Obj: object.Obj{Type: objtype.OBJ_UPVALUE}, Location: slot}
+}
+
+func NewClosure(function *ObjFunction) *ObjClosure {
+	upvalues := make([]*ObjUpvalue, function.UpvalueCount)
+	return &ObjClosure{Obj: object.Obj{Type: objtype.OBJ_CLOSURE}, Function: function, Upvalues: upvalues}
+}
+
+func NewObjClosure(val *ObjClosure) Value {
+	return ObjValue((*object.Obj)(unsafe.Pointer(val)))
+}
+
+func NewModule(name string, path string, globals *Globals) *ObjModule {
+	return &ObjModule{Obj: object.Obj{Type: objtype.OBJ_MODULE}, Name: name, Path: path, DisplayPath: path, Globals: globals}
 }
 
-func NewNative(function NativeFn) *ObjNative {
-	native := &ObjNative{Obj: object.Obj{Type: objtype.OBJ_NATIVE}, Function: function}
+func NewObjModule(val *ObjModule) Value {
+	return ObjValue((*object.Obj)(unsafe.Pointer(val)))
+}
+
+func NewNative(name string, arity Arity, function NativeFn) *ObjNative {
+	native := &ObjNative{Obj: object.Obj{Type: objtype.OBJ_NATIVE}, Name: name, Arity: arity, Function: function}
 	return native
 }
 
 func NewObjNative(val *ObjNative) Value {
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(val))}
+	return ObjValue((*object.Obj)(unsafe.Pointer(val)))
 }
 
 func NewObjString(val string) Value {
 	valObj := &ObjString{Obj: object.Obj{Type: objtype.OBJ_STRING}, String: val}
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(valObj))}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
 }
 
 func NewObjClass(val string) Value {
-	valObj := &ObjClass{Obj: object.Obj{Type: objtype.OBJ_CLASS}, Name: val, Methods: make(map[string]*ObjFunction)}
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(valObj))}
+	valObj := &ObjClass{Obj: object.Obj{Type: objtype.OBJ_CLASS}, Name: val, Methods: make(map[string]*ObjClosure), NativeMethods: make(map[string]*ObjNative)}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
 }
 
 func NewObjInstance(klass *ObjClass) Value {
 	valObj := &ObjInstance{Obj: object.Obj{Type: objtype.OBJ_INSTANCE}, Klass: klass, Fields: make(map[string]Value)}
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(valObj))}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
 }
 
-func NewObjBoundMethod(receiver Value, method *ObjFunction) Value {
+func NewObjBoundMethod(receiver Value, method *ObjClosure) Value {
 	valObj := &ObjBoundMethod{Obj: object.Obj{Type: objtype.OBJ_BOUND_METHOD}, Receiver: receiver, Method: method}
-	return Value{Type: valuetype.VAL_OBJ, Data: (*object.Obj)(unsafe.Pointer(valObj))}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
+}
+
+func NewObjList(items []Value) Value {
+	valObj := &ObjList{Obj: object.Obj{Type: objtype.OBJ_LIST}, Items: items}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
+}
+
+func NewObjBoundBuiltin(receiver Value, name string) Value {
+	valObj := &ObjBoundBuiltin{Obj: object.Obj{Type: objtype.OBJ_BOUND_BUILTIN}, Receiver: receiver, Name: name}
+	return ObjValue((*object.Obj)(unsafe.Pointer(valObj)))
 }
 
 func (value Value) AsBool() bool {
-	return value.Data.(bool)
+	return value.number != 0
 }
 
 func (value Value) AsNumber() float64 {
-	return value.Data.(float64)
+	return value.number
 }
 
 func (value Value) AsObj() *object.Obj {
-	return value.Data.(*object.Obj)
+	return value.obj
 }
 
 func (value Value) AsFunction() *ObjFunction {
 	return (*ObjFunction)(unsafe.Pointer(value.AsObj()))
 }
 
+func (value Value) AsClosure() *ObjClosure {
+	return (*ObjClosure)(unsafe.Pointer(value.AsObj()))
+}
+
 func (value Value) AsNative() *ObjNative {
 	return (*ObjNative)(unsafe.Pointer(value.AsObj()))
 }
@@ -134,6 +297,18 @@ func (value Value) AsBoundMethod() *ObjBoundMethod {
 	return (*ObjBoundMethod)(unsafe.Pointer(value.AsObj()))
 }
 
+func (value Value) AsList() *ObjList {
+	return (*ObjList)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsBoundBuiltin() *ObjBoundBuiltin {
+	return (*ObjBoundBuiltin)(unsafe.Pointer(value.AsObj()))
+}
+
+func (value Value) AsModule() *ObjModule {
+	return (*ObjModule)(unsafe.Pointer(value.AsObj()))
+}
+
 func (value Value) AsGoString() string {
 	return value.AsString().String
 }
@@ -166,6 +341,10 @@ func (value Value) IsFunction() bool {
 	return value.isobjtype(objtype.OBJ_FUNCTION)
 }
 
+func (value Value) IsClosure() bool {
+	return value.isobjtype(objtype.OBJ_CLOSURE)
+}
+
 func (value Value) IsNative() bool {
 	return value.isobjtype(objtype.OBJ_NATIVE)
 }
@@ -182,6 +361,14 @@ func (value Value) IsInstance() bool {
 	return value.isobjtype(objtype.OBJ_INSTANCE)
 }
 
+func (value Value) IsList() bool {
+	return value.isobjtype(objtype.OBJ_LIST)
+}
+
+func (value Value) IsModule() bool {
+	return value.isobjtype(objtype.OBJ_MODULE)
+}
+
 func (value Value) isBoundMethod() bool {
 	return value.isobjtype(objtype.OBJ_BOUND_METHOD)
 }
@@ -199,55 +386,128 @@ func (valueArray *ValueArray) FreeValueArray() {
 }
 
 func (value Value) PrintValue() {
+	fmt.Print(value.String())
+}
+
+func (value Value) String() string {
+	return value.format(nil)
+}
+
+// format is String for a value inside the lists and maps in printing, which
+// are shown as [...] and {...} when they contain themselves.
+func (value Value) format(printing map[*object.Obj]bool) string {
 	switch value.Type {
 	case valuetype.VAL_BOOL:
 		if value.AsBool() {
-			fmt.Printf("true")
-		} else {
-			fmt.Printf("false")
+			return "true"
 		}
+		return "false"
 
 	case valuetype.VAL_NIL:
-		fmt.Printf("nil")
+		return "nil"
 
 	case valuetype.VAL_NUMBER:
-		fmt.Printf("%g", value.AsNumber())
+		return fmt.Sprintf("%g", value.AsNumber())
 
 	case valuetype.VAL_OBJ:
-		value.PrintObject()
+		return value.objectString(printing)
 
 	}
+	return ""
 }
 
-func printFunction(function *ObjFunction) {
+func functionString(function *ObjFunction) string {
 	if function.Name == nil {
-		fmt.Printf("<script>")
-		return
+		return "<script>"
 	}
-	fmt.Printf("<fn %s>", function.Name.String)
+	return fmt.Sprintf("<fn %s>", function.Name.String)
 }
 
 func (value Value) PrintObject() {
+	fmt.Print(value.objectString(nil))
+}
+
+func (value Value) objectString(printing map[*object.Obj]bool) string {
 	switch value.ObjType() {
 	case objtype.OBJ_FUNCTION:
-		printFunction(value.AsFunction())
+		return functionString(value.AsFunction())
+
+	case objtype.OBJ_CLOSURE:
+		return functionString(value.AsClosure().Function)
+
+	case objtype.OBJ_UPVALUE:
+		return "upvalue"
 
 	case objtype.OBJ_NATIVE:
-		fmt.Printf("<native fn>")
+		if value.AsNative().Name == "" {
+			return "<native fn>"
+		}
+		return fmt.Sprintf("<native fn %s>", value.AsNative().Name)
 
 	case objtype.OBJ_STRING:
-		fmt.Printf("%s", value.AsGoString())
+		return value.AsGoString()
 
 	case objtype.OBJ_CLASS:
-		fmt.Printf("%s", value.AsClass().Name)
+		return value.AsClass().Name
 
 	case objtype.OBJ_INSTANCE:
-		fmt.Printf("%s instance", value.AsInstance().Klass.Name)
+		return fmt.Sprintf("%s instance", value.AsInstance().Klass.Name)
 
 	case objtype.OBJ_BOUND_METHOD:
-		printFunction(value.AsBoundMethod().Method)
+		return functionString(value.AsBoundMethod().Method.Function)
+
+	case objtype.OBJ_LIST:
+		if printing[value.AsObj()] {
+			return "[...]"
+		}
+		if printing == nil {
+			printing = make(map[*object.Obj]bool)
+		}
+		printing[value.AsObj()] = true
+		defer delete(printing, value.AsObj())
+
+		var builder strings.Builder
+		builder.WriteString("[")
+		for i, item := range value.AsList().Items {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			builder.WriteString(item.format(printing))
+		}
+		builder.WriteString("]")
+		return builder.String()
+
+	case objtype.OBJ_MAP:
+		if printing[value.AsObj()] {
+			return "{...}"
+		}
+		if printing == nil {
+			printing = make(map[*object.Obj]bool)
+		}
+		printing[value.AsObj()] = true
+		defer delete(printing, value.AsObj())
+
+		var builder strings.Builder
+		builder.WriteString("{")
+		for i, entry := range value.AsMap().Entries {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			builder.WriteString(entry.Key.format(printing))
+			builder.WriteString(": ")
+			builder.WriteString(entry.Value.format(printing))
+		}
+		builder.WriteString("}")
+		return builder.String()
+
+	case objtype.OBJ_BOUND_BUILTIN:
+		return fmt.Sprintf("<native method %s>", value.AsBoundBuiltin().Name)
+
+	case objtype.OBJ_MODULE:
+		return fmt.Sprintf("<module %s>", value.AsModule().Name)
 
 	}
+	return ""
 }
 
 func ValuesEqual(a Value, b Value) bool {
@@ -256,21 +516,17 @@ func ValuesEqual(a Value, b Value) bool {
 	}
 
 	switch a.Type {
-	case valuetype.VAL_BOOL:
-		return a.AsBool() == b.AsBool()
+	case valuetype.VAL_BOOL, valuetype.VAL_NUMBER:
+		return a.number == b.number
 	case valuetype.VAL_NIL:
 		return true
-	case valuetype.VAL_NUMBER:
-		return a.AsNumber() == b.AsNumber()
 	case valuetype.VAL_OBJ:
-		aObj := a.AsObj()
-		bObj := b.AsObj()
-
-		if aObj.Type == objtype.OBJ_STRING {
-			return a.AsGoString() == b.AsGoString()
-		} else {
-			return aObj == bObj
+		// Equal strings can be different objects, so strings compare by
+		// content when the pointers differ.
+		if a.AsObj() == b.AsObj() {
+			return true
 		}
+		return a.IsString() && b.IsString() && a.AsGoString() == b.AsGoString()
 	default:
 		return false
 	}
@@ -0,0 +1,40 @@
+package value
+
+import (
+	"golox-lang/lib/value/valuetype"
+	"math"
+	"testing"
+)
+
+func TestUnboxedValues(t *testing.T) {
+	if val := NumberValue(2.5); !val.IsNumber() || val.AsNumber() != 2.5 {
+		t.Errorf("value.NumberValue(2.5) failed, expected number 2.5, got %v", val)
+	}
+	if val := BoolValue(true); !val.IsBool() || !val.AsBool() {
+		t.Errorf("value.BoolValue(true) failed, expected true, got %v", val)
+	}
+	if val := BoolValue(false); !val.IsBool() || val.AsBool() {
+		t.Errorf("value.BoolValue(false) failed, expected false, got %v", val)
+	}
+	if val := New(valuetype.VAL_NUMBER, 3); val.AsNumber() != 3 {
+		t.Errorf("value.New(VAL_NUMBER, 3) failed, expected number 3, got %v", val)
+	}
+
+	// a number and a bool with the same representation are still different
+	if ValuesEqual(NumberValue(1), BoolValue(true)) {
+		t.Errorf("value.ValuesEqual(1, true) failed, expected false")
+	}
+	if nan := NumberValue(math.NaN()); ValuesEqual(nan, nan) {
+		t.Errorf("value.ValuesEqual(nan, nan) failed, expected false")
+	}
+}
+
+func TestValueAllocations(t *testing.T) {
+	a, b := NumberValue(1), NumberValue(2)
+	allocs := testing.AllocsPerRun(100, func() {
+		a = NumberValue(a.AsNumber() + b.AsNumber())
+	})
+	if allocs != 0 {
+		t.Errorf("value.NumberValue(...) failed, expected no allocations, got %v", allocs)
+	}
+}
@@ -0,0 +1,640 @@
+package vm
+
+import (
+	"fmt"
+	"golox-lang/lib/object/objtype"
+	"golox-lang/lib/value"
+	"golox-lang/lib/value/valuetype"
+	"math"
+	"reflect"
+)
+
+var (
+	valueType = reflect.TypeOf(value.Value{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// conversionError reports a Lox value that can't be converted to a Go type.
+// Callers add the argument or field it came from.
+type conversionError struct {
+	Want string
+	Got  string
+}
+
+func (err *conversionError) Error() string {
+	return fmt.Sprintf("Expect %s but got %s.", err.Want, err.Got)
+}
+
+// conversionKey identifies a Go pointer, map or slice by its address and type.
+type conversionKey struct {
+	Pointer uintptr
+	Type    reflect.Type
+}
+
+type boundField struct {
+	Index int
+	Name  string
+}
+
+// BindFunction defines a native called name that calls fn, which must be a Go
+// function. Arguments are converted to fn's parameter types and checked, and
+// fn may return a value, an error or both.
+func (vm *VM) BindFunction(name string, fn interface{}) error {
+	function := reflect.ValueOf(fn)
+	if function.Kind() != reflect.Func {
+		return fmt.Errorf("Cannot bind %s, expect a function but got %T.", name, fn)
+	}
+	if err := checkResults(function.Type()); err != nil {
+		return fmt.Errorf("Cannot bind %s, %s", name, err.Error())
+	}
+
+	vm.DefineNative(name, arityOf(function.Type(), 0), vm.nativeOf(function))
+	return nil
+}
+
+// BindStruct defines a class called name that proxies the struct type of
+// prototype. Instances carry the struct's exported fields, its methods are
+// available as Lox methods, and calling the class takes the fields in order.
+func (vm *VM) BindStruct(name string, prototype interface{}) error {
+	structType := reflect.TypeOf(prototype)
+	if structType != nil && structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType == nil || structType.Kind() != reflect.Struct {
+		return fmt.Errorf("Cannot bind %s, expect a struct but got %T.", name, prototype)
+	}
+
+	klass, err := vm.newProxyClass(name, structType)
+	if err != nil {
+		return err
+	}
+
+	vm.proxies[structType] = klass.AsClass()
+	vm.Builtins[name] = klass
+	return nil
+}
+
+// ToValue converts a Go value to a Lox value. Structs become instances of
+// their proxy class, slices become lists and maps become maps.
+func (vm *VM) ToValue(goValue interface{}) (value.Value, error) {
+	return vm.toValue(reflect.ValueOf(goValue))
+}
+
+// FromValue converts val into the Go value target points to.
+func (vm *VM) FromValue(val value.Value, target interface{}) error {
+	pointer := reflect.ValueOf(target)
+	if pointer.Kind() != reflect.Ptr || pointer.IsNil() {
+		return fmt.Errorf("Cannot convert into %T, expect a non-nil pointer.", target)
+	}
+
+	converted, err := vm.fromValue(val, pointer.Type().Elem())
+	if err != nil {
+		return err
+	}
+	pointer.Elem().Set(converted)
+	return nil
+}
+
+func checkResults(fnType reflect.Type) error {
+	switch fnType.NumOut() {
+	case 0, 1:
+		return nil
+	case 2:
+		if fnType.Out(1) == errorType {
+			return nil
+		}
+	}
+	return fmt.Errorf("expect it to return at most a value and an error.")
+}
+
+// arityOf returns the arity of fnType not counting the parameters before
+// first.
+func arityOf(fnType reflect.Type, first int) value.Arity {
+	if fnType.IsVariadic() {
+		return value.VariadicArity(fnType.NumIn() - first - 1)
+	}
+	return value.ExactArity(fnType.NumIn() - first)
+}
+
+func (vm *VM) nativeOf(function reflect.Value) value.NativeFn {
+	return func(argCount int, args []value.Value) (value.Value, error) {
+		in, err := vm.goArgs(function.Type(), 0, args)
+		if err != nil {
+			return value.Value{}, err
+		}
+		out, err := callGo(function, in)
+		if err != nil {
+			return value.Value{}, err
+		}
+		return vm.goResults(out)
+	}
+}
+
+// callGo calls function with in, turning a panic into an error so a failing
+// Go function stops the script rather than the host.
+func callGo(function reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("Go function panicked: %v", recovered)
+		}
+	}()
+	return function.Call(in), nil
+}
+
+// goArgs converts args to the parameters of fnType starting at the first one.
+// The VM has already checked their count against arityOf.
+func (vm *VM) goArgs(fnType reflect.Type, first int, args []value.Value) ([]reflect.Value, error) {
+	arity := fnType.NumIn() - first
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var paramType reflect.Type
+		if fnType.IsVariadic() && i >= arity-1 {
+			paramType = fnType.In(fnType.NumIn() - 1).Elem()
+		} else {
+			paramType = fnType.In(first + i)
+		}
+
+		converted, err := vm.fromValue(arg, paramType)
+		if err != nil {
+			if convErr, ok := err.(*conversionError); ok {
+				return nil, fmt.Errorf("Expect %s for argument %d but got %s.", convErr.Want, i+1, convErr.Got)
+			}
+			return nil, err
+		}
+		in[i] = converted
+	}
+	return in, nil
+}
+
+func (vm *VM) goResults(out []reflect.Value) (value.Value, error) {
+	if len(out) > 0 && out[len(out)-1].Type() == errorType {
+		if err := out[len(out)-1]; !err.IsNil() {
+			return value.Value{}, err.Interface().(error)
+		}
+		out = out[:len(out)-1]
+	}
+
+	if len(out) == 0 {
+		return value.NilValue(), nil
+	}
+	return vm.toValue(out[0])
+}
+
+func (vm *VM) toValue(goValue reflect.Value) (value.Value, error) {
+	if !goValue.IsValid() {
+		return value.NilValue(), nil
+	}
+	if goValue.Type() == valueType {
+		return goValue.Interface().(value.Value), nil
+	}
+
+	switch goValue.Kind() {
+	case reflect.Bool:
+		return value.BoolValue(goValue.Bool()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.NumberValue(float64(goValue.Int())), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.NumberValue(float64(goValue.Uint())), nil
+
+	case reflect.Float32, reflect.Float64:
+		return value.NumberValue(goValue.Float()), nil
+
+	case reflect.String:
+		return value.NewObjString(goValue.String()), nil
+
+	case reflect.Slice, reflect.Array:
+		if goValue.Kind() == reflect.Slice && goValue.Len() > 0 {
+			key, err := vm.enterConversion(goValue)
+			if err != nil {
+				return value.Value{}, err
+			}
+			defer delete(vm.converting, key)
+		}
+
+		items := make([]value.Value, goValue.Len())
+		for i := range items {
+			item, err := vm.toValue(goValue.Index(i))
+			if err != nil {
+				return value.Value{}, err
+			}
+			items[i] = item
+		}
+		return value.NewObjList(items), nil
+
+	case reflect.Map:
+		if !goValue.IsNil() {
+			key, err := vm.enterConversion(goValue)
+			if err != nil {
+				return value.Value{}, err
+			}
+			defer delete(vm.converting, key)
+		}
+
+		m := value.NewMap()
+		iter := goValue.MapRange()
+		for iter.Next() {
+			key, err := vm.toValue(iter.Key())
+			if err != nil {
+				return value.Value{}, err
+			}
+			val, err := vm.toValue(iter.Value())
+			if err != nil {
+				return value.Value{}, err
+			}
+
+			hashKey, ok := value.HashKeyOf(key)
+			if !ok {
+				return value.Value{}, fmt.Errorf("Map keys must be hashable.")
+			}
+			m.Set(hashKey, key, val)
+		}
+		return value.NewObjMap(m), nil
+
+	case reflect.Struct:
+		klass, err := vm.proxyClass(goValue.Type())
+		if err != nil {
+			return value.Value{}, err
+		}
+
+		instance := value.NewObjInstance(klass)
+		if err := vm.storeStruct(goValue, instance.AsInstance()); err != nil {
+			return value.Value{}, err
+		}
+		return instance, nil
+
+	case reflect.Ptr, reflect.Interface:
+		if goValue.IsNil() {
+			return value.NilValue(), nil
+		}
+		if goValue.Kind() == reflect.Ptr {
+			key, err := vm.enterConversion(goValue)
+			if err != nil {
+				return value.Value{}, err
+			}
+			defer delete(vm.converting, key)
+		}
+		return vm.toValue(goValue.Elem())
+
+	case reflect.Func:
+		if goValue.IsNil() {
+			return value.NilValue(), nil
+		}
+		if err := checkResults(goValue.Type()); err != nil {
+			return value.Value{}, fmt.Errorf("Cannot convert Go function, %s", err.Error())
+		}
+		return value.NewObjNative(value.NewNative("", arityOf(goValue.Type(), 0), vm.nativeOf(goValue))), nil
+
+	}
+
+	return value.Value{}, fmt.Errorf("Cannot convert Go value of type %s.", goValue.Type())
+}
+
+// enterConversion marks the pointer, map or slice goValue as being converted
+// until its key is deleted from vm.converting. It fails when goValue is
+// already being converted, as converting it would never end.
+func (vm *VM) enterConversion(goValue reflect.Value) (conversionKey, error) {
+	key := conversionKey{Pointer: goValue.Pointer(), Type: goValue.Type()}
+	if vm.converting[key] {
+		return key, fmt.Errorf("Cannot convert Go value of type %s, it contains itself.", goValue.Type())
+	}
+
+	if vm.converting == nil {
+		vm.converting = make(map[conversionKey]bool)
+	}
+	vm.converting[key] = true
+	return key, nil
+}
+
+// fitsInt reports whether the integer n is in the range of a signed integer
+// of the given size. The bounds are compared as floats, since converting an
+// out of range float to an integer gives no useful result.
+func fitsInt(n float64, bits int) bool {
+	limit := math.Ldexp(1, bits-1)
+	return n >= -limit && n < limit
+}
+
+// fitsUint is fitsInt for an unsigned integer.
+func fitsUint(n float64, bits int) bool {
+	return n >= 0 && n < math.Ldexp(1, bits)
+}
+
+func (vm *VM) fromValue(val value.Value, goType reflect.Type) (reflect.Value, error) {
+	if goType == valueType {
+		return reflect.ValueOf(val), nil
+	}
+
+	result := reflect.New(goType).Elem()
+
+	switch goType.Kind() {
+	case reflect.Bool:
+		if !val.IsBool() {
+			return result, &conversionError{Want: "a bool", Got: typeName(val)}
+		}
+		result.SetBool(val.AsBool())
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !val.IsNumber() || val.AsNumber() != math.Trunc(val.AsNumber()) {
+			return result, &conversionError{Want: "an integer", Got: typeName(val)}
+		}
+		if !fitsInt(val.AsNumber(), goType.Bits()) {
+			return result, fmt.Errorf("Number %s doesn't fit in %s.", val.String(), goType)
+		}
+		result.SetInt(int64(val.AsNumber()))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !val.IsNumber() || val.AsNumber() != math.Trunc(val.AsNumber()) {
+			return result, &conversionError{Want: "an integer", Got: typeName(val)}
+		}
+		if !fitsUint(val.AsNumber(), goType.Bits()) {
+			return result, fmt.Errorf("Number %s doesn't fit in %s.", val.String(), goType)
+		}
+		result.SetUint(uint64(val.AsNumber()))
+
+	case reflect.Float32, reflect.Float64:
+		if !val.IsNumber() {
+			return result, &conversionError{Want: "a number", Got: typeName(val)}
+		}
+		result.SetFloat(val.AsNumber())
+
+	case reflect.String:
+		if !val.IsString() {
+			return result, &conversionError{Want: "a string", Got: typeName(val)}
+		}
+		result.SetString(val.AsGoString())
+
+	case reflect.Slice:
+		if val.IsNil() {
+			return result, nil
+		}
+		if !val.IsList() {
+			return result, &conversionError{Want: "a list", Got: typeName(val)}
+		}
+
+		items := val.AsList().Items
+		result = reflect.MakeSlice(goType, len(items), len(items))
+		for i, item := range items {
+			converted, err := vm.fromValue(item, goType.Elem())
+			if err != nil {
+				return result, err
+			}
+			result.Index(i).Set(converted)
+		}
+
+	case reflect.Map:
+		if val.IsNil() {
+			return result, nil
+		}
+		if !val.IsMap() {
+			return result, &conversionError{Want: "a map", Got: typeName(val)}
+		}
+
+		entries := val.AsMap().Entries
+		result = reflect.MakeMapWithSize(goType, len(entries))
+		for _, entry := range entries {
+			key, err := vm.fromValue(entry.Key, goType.Key())
+			if err != nil {
+				return result, err
+			}
+			converted, err := vm.fromValue(entry.Value, goType.Elem())
+			if err != nil {
+				return result, err
+			}
+			result.SetMapIndex(key, converted)
+		}
+
+	case reflect.Struct:
+		if !val.IsInstance() {
+			return result, &conversionError{Want: fmt.Sprintf("an instance of %s", goType.Name()), Got: typeName(val)}
+		}
+		if err := vm.loadStruct(val.AsInstance(), result); err != nil {
+			return result, err
+		}
+
+	case reflect.Ptr:
+		if val.IsNil() {
+			return result, nil
+		}
+		converted, err := vm.fromValue(val, goType.Elem())
+		if err != nil {
+			return result, err
+		}
+		result = reflect.New(goType.Elem())
+		result.Elem().Set(converted)
+
+	case reflect.Interface:
+		if goType.NumMethod() != 0 {
+			return result, fmt.Errorf("Cannot convert to Go interface %s.", goType)
+		}
+		if natural := vm.goValueOf(val); natural != nil {
+			result.Set(reflect.ValueOf(natural))
+		}
+
+	default:
+		return result, fmt.Errorf("Cannot convert to Go type %s.", goType)
+
+	}
+
+	return result, nil
+}
+
+// goValueOf converts val to the Go value it most naturally maps to, for
+// parameters typed interface{}.
+func (vm *VM) goValueOf(val value.Value) interface{} {
+	switch {
+	case val.IsNil():
+		return nil
+	case val.IsBool():
+		return val.AsBool()
+	case val.IsNumber():
+		return val.AsNumber()
+	case val.IsString():
+		return val.AsGoString()
+	case val.IsList():
+		items := make([]interface{}, len(val.AsList().Items))
+		for i, item := range val.AsList().Items {
+			items[i] = vm.goValueOf(item)
+		}
+		return items
+	case val.IsMap():
+		m := make(map[interface{}]interface{}, len(val.AsMap().Entries))
+		for _, entry := range val.AsMap().Entries {
+			m[vm.goValueOf(entry.Key)] = vm.goValueOf(entry.Value)
+		}
+		return m
+	}
+	return val
+}
+
+// proxyClass returns the class instances of structType are converted to,
+// creating an unnamed one if the type was never bound.
+func (vm *VM) proxyClass(structType reflect.Type) (*value.ObjClass, error) {
+	if klass, present := vm.proxies[structType]; present {
+		return klass, nil
+	}
+
+	name := structType.Name()
+	if name == "" {
+		name = "struct"
+	}
+
+	klass, err := vm.newProxyClass(name, structType)
+	if err != nil {
+		return nil, err
+	}
+	vm.proxies[structType] = klass.AsClass()
+	return klass.AsClass(), nil
+}
+
+func (vm *VM) newProxyClass(name string, structType reflect.Type) (value.Value, error) {
+	klass := value.NewObjClass(name)
+	fields := structFields(structType)
+
+	initializer := func(argCount int, args []value.Value) (value.Value, error) {
+		goValue := reflect.New(structType).Elem()
+		for i, arg := range args[1:] {
+			field := goValue.Field(fields[i].Index)
+			converted, err := vm.fromValue(arg, field.Type())
+			if err != nil {
+				if convErr, ok := err.(*conversionError); ok {
+					return value.Value{}, fmt.Errorf("Expect %s for argument %d but got %s.", convErr.Want, i+1, convErr.Got)
+				}
+				return value.Value{}, err
+			}
+			field.Set(converted)
+		}
+
+		return args[0], vm.storeStruct(goValue, args[0].AsInstance())
+	}
+	klass.AsClass().NativeMethods[vm.InitString] = value.NewNative(vm.InitString, value.RangeArity(0, len(fields)), initializer)
+
+	pointerType := reflect.PtrTo(structType)
+	for i := 0; i < pointerType.NumMethod(); i++ {
+		method := pointerType.Method(i)
+		if err := checkResults(method.Type); err != nil {
+			return value.Value{}, fmt.Errorf("Cannot bind method %s.%s, %s", name, method.Name, err.Error())
+		}
+		klass.AsClass().NativeMethods[method.Name] = value.NewNative(method.Name, arityOf(method.Type, 1), vm.nativeMethodOf(structType, method))
+	}
+
+	return klass, nil
+}
+
+// nativeMethodOf calls method on a copy of the receiver's fields and writes
+// them back afterwards, so pointer receivers can update the instance.
+func (vm *VM) nativeMethodOf(structType reflect.Type, method reflect.Method) value.NativeFn {
+	return func(argCount int, args []value.Value) (value.Value, error) {
+		receiver := args[0].AsInstance()
+		goValue := reflect.New(structType)
+		if err := vm.loadStruct(receiver, goValue.Elem()); err != nil {
+			return value.Value{}, err
+		}
+
+		in, err := vm.goArgs(method.Type, 1, args[1:])
+		if err != nil {
+			return value.Value{}, err
+		}
+
+		out, err := callGo(method.Func, append([]reflect.Value{goValue}, in...))
+		if err != nil {
+			return value.Value{}, err
+		}
+		if err := vm.storeStruct(goValue.Elem(), receiver); err != nil {
+			return value.Value{}, err
+		}
+		return vm.goResults(out)
+	}
+}
+
+// structFields lists the exported fields of structType with the names they
+// have in Lox, which can be changed with a `lox:"name"` tag.
+func structFields(structType reflect.Type) []boundField {
+	fields := make([]boundField, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		if tag, present := field.Tag.Lookup("lox"); present {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+		fields = append(fields, boundField{Index: i, Name: name})
+	}
+	return fields
+}
+
+func (vm *VM) loadStruct(instance *value.ObjInstance, goValue reflect.Value) error {
+	for _, field := range structFields(goValue.Type()) {
+		val, present := instance.Fields[field.Name]
+		if !present {
+			continue
+		}
+
+		converted, err := vm.fromValue(val, goValue.Field(field.Index).Type())
+		if err != nil {
+			if convErr, ok := err.(*conversionError); ok {
+				return fmt.Errorf("Expect %s for field '%s' but got %s.", convErr.Want, field.Name, convErr.Got)
+			}
+			return err
+		}
+		goValue.Field(field.Index).Set(converted)
+	}
+	return nil
+}
+
+// storeStruct writes the fields of goValue to instance. Lists and maps the
+// instance already holds are updated in place, so script code sharing them
+// sees the changes a method made.
+func (vm *VM) storeStruct(goValue reflect.Value, instance *value.ObjInstance) error {
+	for _, field := range structFields(goValue.Type()) {
+		val, err := vm.toValue(goValue.Field(field.Index))
+		if err != nil {
+			return err
+		}
+
+		old, present := instance.Fields[field.Name]
+		switch {
+		case present && old.IsList() && val.IsList():
+			old.AsList().Items = val.AsList().Items
+		case present && old.IsMap() && val.IsMap():
+			old.AsMap().Replace(val.AsMap())
+		default:
+			instance.Fields[field.Name] = val
+		}
+	}
+	return nil
+}
+
+func typeName(val value.Value) string {
+	switch val.Type {
+	case valuetype.VAL_BOOL:
+		return "bool"
+	case valuetype.VAL_NIL:
+		return "nil"
+	case valuetype.VAL_NUMBER:
+		return "number"
+	}
+
+	switch val.ObjType() {
+	case objtype.OBJ_STRING:
+		return "string"
+	case objtype.OBJ_LIST:
+		return "list"
+	case objtype.OBJ_MAP:
+		return "map"
+	case objtype.OBJ_INSTANCE:
+		return fmt.Sprintf("%s instance", val.AsInstance().Klass.Name)
+	case objtype.OBJ_CLASS:
+		return "class"
+	case objtype.OBJ_MODULE:
+		return "module"
+	}
+	return "function"
+}
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"golox-lang/lib/value"
+	"golox-lang/lib/vm/interpretresult"
+)
+
+// Call calls callee with args from Go and runs it until it returns. It can be
+// used while a script is running, for instance from inside a native, in which
+// case the callee runs on top of the script's frames.
+func (vm *VM) Call(callee value.Value, args ...value.Value) (value.Value, error) {
+	baseFrame := len(vm.Frames)
+	stackDepth := len(vm.Stack)
+	if baseFrame == 0 {
+		vm.resetLimits()
+	}
+
+	vm.push(callee)
+	for _, arg := range args {
+		vm.push(arg)
+	}
+
+	if vm.callValue(callee, len(args)) {
+		// Natives and classes without an initializer complete without
+		// pushing a frame.
+		if len(vm.Frames) == baseFrame || vm.run(baseFrame) == interpretresult.INTERPRET_OK {
+			return vm.pop(), nil
+		}
+	}
+
+	return value.NilValue(), vm.hostError(stackDepth)
+}
+
+// Invoke calls the method called name on receiver with args from Go, the same
+// way receiver.name(args) would from a script.
+func (vm *VM) Invoke(receiver value.Value, name string, args ...value.Value) (value.Value, error) {
+	if methods := builtinMethodsOf(receiver); methods != nil {
+		if _, present := methods[name]; present {
+			return vm.Call(value.NewObjBoundBuiltin(receiver, name), args...)
+		}
+	} else if receiver.IsInstance() {
+		instance := receiver.AsInstance()
+		if field, present := instance.Fields[name]; present {
+			return vm.Call(field, args...)
+		}
+		if method, present := instance.Klass.Methods[name]; present {
+			return vm.Call(value.NewObjBoundMethod(receiver, method), args...)
+		}
+		if _, present := instance.Klass.NativeMethods[name]; present {
+			return vm.Call(value.NewObjBoundBuiltin(receiver, name), args...)
+		}
+	} else {
+		vm.runtimeError("Only instances have methods.")
+		return value.NilValue(), vm.hostError(len(vm.Stack))
+	}
+
+	vm.runtimeError("Undefined property '%s'.", name)
+	return value.NilValue(), vm.hostError(len(vm.Stack))
+}
+
+// hostError hands the pending exception over to Go code as an error and drops
+// whatever the failed call left on the stack. A limit hit during the call no
+// longer stops try blocks in the script the Go code returns to.
+func (vm *VM) hostError(stackDepth int) error {
+	err := vm.newRuntimeError()
+
+	vm.closeUpvalues(stackDepth)
+	vm.truncateStack(stackDepth)
+	vm.exception = value.NilValue()
+	vm.fatal = false
+	return err
+}
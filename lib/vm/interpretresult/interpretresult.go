@@ -6,4 +6,5 @@ const (
 	INTERPRET_OK InterpretResult = iota
 	INTERPRET_COMPILE_ERROR
 	INTERPRET_RUNTIME_ERROR
+	INTERPRET_INTERRUPTED
 )
@@ -0,0 +1,52 @@
+package vm
+
+import (
+	"golox-lang/lib/value"
+	"unsafe"
+)
+
+// Approximate sizes used to charge allocations against Limits.MaxHeapBytes.
+const (
+	OBJ_SIZE   int = 32
+	VALUE_SIZE int = int(unsafe.Sizeof(value.Value{}))
+)
+
+// Limits bound the resources a script may use. They count from the start of
+// each top level run, and zero means no limit except for MaxFrames, which
+// InitVM sets to FRAMES_MAX when it's zero.
+type Limits struct {
+	// MaxInstructions caps the number of instructions executed.
+	MaxInstructions int
+	// MaxFrames caps the call depth, deeper calls fail with "Stack
+	// overflow.".
+	MaxFrames int
+	// MaxHeapBytes caps the approximate number of bytes allocated for
+	// strings, lists, maps, instances, classes and closures.
+	MaxHeapBytes int
+}
+
+// resetLimits starts counting the instruction and heap budgets anew.
+func (vm *VM) resetLimits() {
+	vm.instructionCount = 0
+	vm.bytesAllocated = 0
+	vm.fatal = false
+	vm.contextTicks = 0
+	vm.interrupted = false
+}
+
+// fatalError raises a runtime error that try blocks can't catch, so a script
+// can't keep running after exhausting its budget.
+func (vm *VM) fatalError(format string, args ...interface{}) {
+	vm.runtimeError(format, args...)
+	vm.fatal = true
+}
+
+// allocate charges bytes against the heap budget.
+func (vm *VM) allocate(bytes int) bool {
+	vm.bytesAllocated += bytes
+	if vm.Limits.MaxHeapBytes > 0 && vm.bytesAllocated > vm.Limits.MaxHeapBytes {
+		vm.fatalError("Memory limit exceeded.")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"golox-lang/lib/value"
+	"math"
+)
+
+type builtinMethod func(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool)
+
+var listMethods map[string]builtinMethod
+
+func init() {
+	listMethods = make(map[string]builtinMethod)
+	listMethods["push"] = listPush
+	listMethods["pop"] = listPop
+	listMethods["len"] = listLen
+	listMethods["insert"] = listInsert
+	listMethods["remove"] = listRemove
+	listMethods["slice"] = listSlice
+}
+
+func listPush(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 1, 1) {
+		return value.Value{}, false
+	}
+
+	if !vm.allocate(VALUE_SIZE) {
+		return value.Value{}, false
+	}
+
+	list := receiver.AsList()
+	list.Items = append(list.Items, args[0])
+	return value.NilValue(), true
+}
+
+func listPop(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 0, 0) {
+		return value.Value{}, false
+	}
+
+	list := receiver.AsList()
+	if len(list.Items) == 0 {
+		vm.runtimeError("Can't pop from an empty list.")
+		return value.Value{}, false
+	}
+
+	item := list.Items[len(list.Items)-1]
+	list.Items = list.Items[:len(list.Items)-1]
+	return item, true
+}
+
+func listLen(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 0, 0) {
+		return value.Value{}, false
+	}
+
+	return value.NumberValue(float64(len(receiver.AsList().Items))), true
+}
+
+func listInsert(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 2, 2) {
+		return value.Value{}, false
+	}
+
+	list := receiver.AsList()
+	index, ok := vm.listIndex(list, args[0], len(list.Items))
+	if !ok {
+		return value.Value{}, false
+	}
+
+	if !vm.allocate(VALUE_SIZE) {
+		return value.Value{}, false
+	}
+
+	list.Items = append(list.Items, value.Value{})
+	copy(list.Items[index+1:], list.Items[index:])
+	list.Items[index] = args[1]
+	return value.NilValue(), true
+}
+
+func listRemove(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 1, 1) {
+		return value.Value{}, false
+	}
+
+	list := receiver.AsList()
+	index, ok := vm.listIndex(list, args[0], len(list.Items)-1)
+	if !ok {
+		return value.Value{}, false
+	}
+
+	item := list.Items[index]
+	list.Items = append(list.Items[:index], list.Items[index+1:]...)
+	return item, true
+}
+
+func listSlice(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 1, 2) {
+		return value.Value{}, false
+	}
+
+	list := receiver.AsList()
+	start, ok := vm.listIndex(list, args[0], len(list.Items))
+	if !ok {
+		return value.Value{}, false
+	}
+
+	end := len(list.Items)
+	if len(args) == 2 {
+		if end, ok = vm.listIndex(list, args[1], len(list.Items)); !ok {
+			return value.Value{}, false
+		}
+	}
+
+	if end < start {
+		vm.runtimeError("Slice end must not be before its start.")
+		return value.Value{}, false
+	}
+
+	if !vm.allocate(OBJ_SIZE + (end-start)*VALUE_SIZE) {
+		return value.Value{}, false
+	}
+
+	items := make([]value.Value, end-start)
+	copy(items, list.Items[start:end])
+	return value.NewObjList(items), true
+}
+
+// listIndex validates that index is an integer in the range [0, max].
+func (vm *VM) listIndex(list *value.ObjList, index value.Value, max int) (int, bool) {
+	if !index.IsNumber() {
+		vm.runtimeError("List index must be a number.")
+		return 0, false
+	}
+
+	number := index.AsNumber()
+	if number != math.Trunc(number) {
+		vm.runtimeError("List index must be an integer.")
+		return 0, false
+	}
+
+	if number < 0 || number > float64(max) {
+		vm.runtimeError("List index out of range.")
+		return 0, false
+	}
+
+	return int(number), true
+}
+
+func (vm *VM) checkArgCount(args []value.Value, min int, max int) bool {
+	return vm.checkArity(value.RangeArity(min, max), len(args))
+}
+
+func (vm *VM) checkArity(arity value.Arity, argCount int) bool {
+	if arity.Accepts(argCount) {
+		return true
+	}
+
+	if arity.Max == value.VARIADIC {
+		vm.runtimeError("Expect at least %d arguments but got %d.", arity.Min, argCount)
+	} else if arity.Min == arity.Max {
+		vm.runtimeError("Expect %d arguments but got %d.", arity.Min, argCount)
+	} else {
+		vm.runtimeError("Expect %d to %d arguments but got %d.", arity.Min, arity.Max, argCount)
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"golox-lang/lib/value"
+)
+
+var mapMethods map[string]builtinMethod
+
+func init() {
+	mapMethods = make(map[string]builtinMethod)
+	mapMethods["keys"] = mapKeys
+	mapMethods["values"] = mapValues
+	mapMethods["has"] = mapHas
+	mapMethods["delete"] = mapDelete
+	mapMethods["len"] = mapLen
+}
+
+func mapKeys(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 0, 0) {
+		return value.Value{}, false
+	}
+
+	entries := receiver.AsMap().Entries
+	if !vm.allocate(OBJ_SIZE + len(entries)*VALUE_SIZE) {
+		return value.Value{}, false
+	}
+
+	keys := make([]value.Value, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return value.NewObjList(keys), true
+}
+
+func mapValues(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 0, 0) {
+		return value.Value{}, false
+	}
+
+	entries := receiver.AsMap().Entries
+	if !vm.allocate(OBJ_SIZE + len(entries)*VALUE_SIZE) {
+		return value.Value{}, false
+	}
+
+	values := make([]value.Value, len(entries))
+	for i, entry := range entries {
+		values[i] = entry.Value
+	}
+	return value.NewObjList(values), true
+}
+
+func mapHas(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 1, 1) {
+		return value.Value{}, false
+	}
+
+	key, ok := vm.hashKey(args[0])
+	if !ok {
+		return value.Value{}, false
+	}
+
+	_, present := receiver.AsMap().Get(key)
+	return value.BoolValue(present), true
+}
+
+func mapDelete(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 1, 1) {
+		return value.Value{}, false
+	}
+
+	key, ok := vm.hashKey(args[0])
+	if !ok {
+		return value.Value{}, false
+	}
+
+	return value.BoolValue(receiver.AsMap().Delete(key)), true
+}
+
+func mapLen(vm *VM, receiver value.Value, args []value.Value) (value.Value, bool) {
+	if !vm.checkArgCount(args, 0, 0) {
+		return value.Value{}, false
+	}
+
+	return value.NumberValue(float64(len(receiver.AsMap().Entries))), true
+}
+
+func (vm *VM) hashKey(key value.Value) (value.HashKey, bool) {
+	hashKey, ok := value.HashKeyOf(key)
+	if !ok {
+		vm.runtimeError("Map keys must be hashable.")
+	}
+	return hashKey, ok
+}
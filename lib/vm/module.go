@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"golox-lang/lib/chunk"
+	"golox-lang/lib/compiler"
+	"golox-lang/lib/value"
+	"golox-lang/lib/vm/interpretresult"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importModule returns the module at path, compiling and running it in its
+// own global namespace the first time it is imported.
+func (vm *VM) importModule(path string) (*value.ObjModule, bool) {
+	importer := vm.Frames[len(vm.Frames)-1].Closure.Module
+	resolved, ok := vm.resolveModule(path, importer.Path)
+	if !ok {
+		vm.runtimeError("Could not find module '%s'.", path)
+		return nil, false
+	}
+
+	if module, present := vm.modules[resolved]; present {
+		if !module.Loaded {
+			cycle := make([]string, 0, len(vm.importStack)+1)
+			for _, modulePath := range append(vm.importStack, resolved) {
+				cycle = append(cycle, filepath.Base(modulePath))
+			}
+			vm.runtimeError("Import cycle detected: %s.", strings.Join(cycle, " -> "))
+			return nil, false
+		}
+		return module, true
+	}
+
+	source, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		vm.runtimeError("Could not read module '%s'.", path)
+		return nil, false
+	}
+
+	var function *value.ObjFunction
+	if chunk.IsCompiled(source) {
+		if function, err = chunk.Unmarshal(source); err != nil {
+			vm.runtimeError("Could not load module '%s': %s", path, err.Error())
+			return nil, false
+		}
+	} else {
+		function, _ = compiler.CompileWithOptions(string(source), vm.compilerOptions(resolved))
+		if function == nil {
+			vm.runtimeError("Could not compile module '%s'.", path)
+			return nil, false
+		}
+	}
+
+	name := strings.TrimSuffix(filepath.Base(resolved), filepath.Ext(resolved))
+	module := value.NewModule(name, resolved, value.NewGlobals())
+	vm.modules[resolved] = module
+	vm.importStack = append(vm.importStack, resolved)
+	defer func() {
+		vm.importStack = vm.importStack[:len(vm.importStack)-1]
+	}()
+
+	closure := value.NewClosure(function)
+	closure.Module = module
+	closure.Globals = module.Globals.Link(function.GlobalNames)
+	vm.push(value.NewObjClosure(closure))
+	if !vm.call(closure, 0) || vm.run(len(vm.Frames)-1) != interpretresult.INTERPRET_OK {
+		delete(vm.modules, resolved)
+		return nil, false
+	}
+	vm.pop()
+
+	module.Loaded = true
+	return module, true
+}
+
+// resolveModule looks path up relative to the importing file first and then
+// in each directory of the search path.
+func (vm *VM) resolveModule(path string, importerPath string) (string, bool) {
+	candidates := make([]string, 0, len(vm.SearchPath)+1)
+	if filepath.IsAbs(path) {
+		candidates = append(candidates, path)
+	} else {
+		baseDir := "."
+		if importerPath != "" {
+			baseDir = filepath.Dir(importerPath)
+		}
+		candidates = append(candidates, filepath.Join(baseDir, path))
+
+		for _, dir := range vm.SearchPath {
+			candidates = append(candidates, filepath.Join(dir, path))
+		}
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		resolved, err := filepath.Abs(candidate)
+		if err != nil {
+			continue
+		}
+		return resolved, true
+	}
+
+	return "", false
+}
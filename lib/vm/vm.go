@@ -1,43 +1,180 @@
 package vm
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"golox-lang/lib/chunk"
 	"golox-lang/lib/chunk/opcode"
 	"golox-lang/lib/compiler"
 	"golox-lang/lib/config"
 	"golox-lang/lib/debug"
+	"golox-lang/lib/diagnostic"
 	"golox-lang/lib/object/objtype"
-	"golox-lang/lib/utils/unsafecode"
 	"golox-lang/lib/value"
-	"golox-lang/lib/value/valuetype"
 	"golox-lang/lib/vm/interpretresult"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
 )
 
 const (
 	FRAMES_INITIAL_SIZE int = 64
+	FRAMES_MAX          int = FRAMES_INITIAL_SIZE * 16
 	STACK_INITIAL_SIZE  int = FRAMES_INITIAL_SIZE * 256
+
+	// CONTEXT_CHECK_INTERVAL is the number of instructions executed between
+	// checks of the context given to InterpretContext.
+	CONTEXT_CHECK_INTERVAL int = 1024
+)
+
+// Completion flags left on the stack for OP_END_FINALLY when a finally block
+// is entered because of a throw or a return. Normal completion uses nil.
+const (
+	COMPLETION_THROW  float64 = 1
+	COMPLETION_RETURN float64 = 2
 )
 
+const prelude = `
+class Error {
+	init(message) {
+		this.message = message;
+	}
+}
+`
+
+type ExceptionHandler struct {
+	Handler    int
+	StackDepth int
+	IsFinally  bool
+}
+
+// CallFrame is a function call in progress. IP is the offset of the next
+// instruction in the function's code.
 type CallFrame struct {
-	Function *value.ObjFunction
-	IP       *byte
+	Closure  *value.ObjClosure
+	IP       int
 	Slots    int
+	Handlers []ExceptionHandler
+
+	// code caches the function's bytecode so that reading an instruction
+	// doesn't go through the chunk interface.
+	code []byte
+	// pending holds where each exception carried through a finally block of
+	// the frame was thrown, innermost block last.
+	pending []pendingThrow
+}
+
+// pendingThrow is the site and stack trace of an exception that a finally
+// block, set up at stackDepth, rethrows once it completes.
+type pendingThrow struct {
+	stackDepth int
+	site       site
+	trace      []string
+}
+
+// RuntimeError describes an exception that escaped the script, with the
+// place it was thrown from and the stack trace at that point.
+type RuntimeError struct {
+	Value   value.Value
+	Message string
+	Path    string
+	Line    int
+	Column  int
+	// Excerpt quotes the line the exception was thrown from, when the
+	// script's source is known.
+	Excerpt string
+	Trace   []string
+}
+
+func (err *RuntimeError) Error() string {
+	return err.Message
+}
+
+func (err *RuntimeError) Diagnostic() diagnostic.Diagnostic {
+	return diagnostic.Diagnostic{
+		Kind:    diagnostic.RUNTIME_ERROR,
+		Message: err.Message,
+		Path:    err.Path,
+		Line:    err.Line,
+		Column:  err.Column,
+		Excerpt: err.Excerpt,
+		Trace:   err.Trace,
+	}
+}
+
+// site is a place in a script that code ran from.
+type site struct {
+	source *value.Source
+	path   string
+	line   int
+	column int
+}
+
+func (site site) location() string {
+	return diagnostic.FormatLocation(site.path, site.line, site.column)
+}
+
+func (site site) excerpt() string {
+	if site.source == nil {
+		return ""
+	}
+	return diagnostic.ExcerptAt(site.source.Text, site.line, site.column, 1)
 }
 
 type VM struct {
 	Frames []CallFrame
 
-	Stack      []value.Value
-	Globals    map[string]value.Value
-	InitString string
+	// Stdout receives the output of print statements and Stderr compile and
+	// runtime errors. InitVM defaults them to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Debug receives the execution trace and disassembly printed by the
+	// debug flags in config, it defaults to Stdout.
+	Debug io.Writer
+	// Diagnostics, when set, is sent every compile error and uncaught
+	// runtime error as well.
+	Diagnostics diagnostic.Sink
+	Limits      Limits
+	// NoOptimize compiles scripts without the bytecode optimizer.
+	NoOptimize bool
+
+	Stack        []value.Value
+	Globals      *value.Globals
+	Builtins     map[string]value.Value
+	OpenUpvalues *value.ObjUpvalue
+	InitString   string
+	SearchPath   []string
+
+	mainModule  *value.ObjModule
+	modules     map[string]*value.ObjModule
+	importStack []string
+
+	proxies map[reflect.Type]*value.ObjClass
+	// converting holds the Go pointers, maps and slices that toValue is in
+	// the middle of converting.
+	converting map[conversionKey]bool
+
+	instructionCount int
+	bytesAllocated   int
+	fatal            bool
+
+	ctx          context.Context
+	contextTicks int
+	interrupted  bool
+
+	errorClass     *value.ObjClass
+	exception      value.Value
+	exceptionSite  site
+	exceptionTrace []string
+	lastError      *RuntimeError
 }
 
-func clockNative(argCount int, args []value.Value) value.Value {
-	return value.New(valuetype.VAL_NUMBER, float64(time.Now().UnixNano()/(int64(time.Millisecond)/int64(time.Nanosecond))))
+func clockNative(argCount int, args []value.Value) (value.Value, error) {
+	return value.NumberValue(float64(time.Now().UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond)))), nil
 }
 
 func New() *VM {
@@ -45,62 +182,203 @@ func New() *VM {
 }
 
 func (vm *VM) InitVM() {
+	if vm.Stdout == nil {
+		vm.Stdout = os.Stdout
+	}
+	if vm.Stderr == nil {
+		vm.Stderr = os.Stderr
+	}
+	if vm.Debug == nil {
+		vm.Debug = vm.Stdout
+	}
+	if vm.Limits.MaxFrames == 0 {
+		vm.Limits.MaxFrames = FRAMES_MAX
+	}
+
 	vm.resetStack()
+	vm.Globals = value.NewGlobals()
+	vm.Builtins = make(map[string]value.Value)
+	vm.mainModule = value.NewModule("main", "", vm.Globals)
+	vm.modules = make(map[string]*value.ObjModule)
+	vm.proxies = make(map[reflect.Type]*value.ObjClass)
+	vm.SearchPath = filepath.SplitList(os.Getenv("LOXPATH"))
 
 	vm.InitString = ""
 	vm.InitString = "init"
 
-	vm.defineNative("clock", clockNative)
+	vm.DefineNative("clock", value.ExactArity(0), clockNative)
+
+	vm.Interpret(prelude)
+	vm.Builtins["Error"], _ = vm.Globals.Get("Error")
+	vm.errorClass = vm.Builtins["Error"].AsClass()
+	vm.Globals.Delete("Error")
 }
 
 func (vm *VM) Interpret(source string) interpretresult.InterpretResult {
-	function := compiler.Compile(source)
+	function, _ := compiler.CompileWithOptions(source, vm.compilerOptions(""))
+	if function == nil {
+		return interpretresult.INTERPRET_COMPILE_ERROR
+	}
+
+	return vm.InterpretFunction(function)
+}
+
+// InterpretContext is Interpret, except that the script is stopped with
+// INTERPRET_INTERRUPTED once ctx is done. The VM can be used again afterwards.
+func (vm *VM) InterpretContext(ctx context.Context, source string) interpretresult.InterpretResult {
+	vm.setContext(ctx)
+	defer vm.setContext(nil)
+
+	return vm.Interpret(source)
+}
+
+// InterpretFunctionContext is InterpretFunction stopped once ctx is done.
+func (vm *VM) InterpretFunctionContext(ctx context.Context, function *value.ObjFunction) interpretresult.InterpretResult {
+	vm.setContext(ctx)
+	defer vm.setContext(nil)
+
+	return vm.InterpretFunction(function)
+}
+
+// setContext makes the dispatch loop check ctx, unless it can never be done.
+func (vm *VM) setContext(ctx context.Context) {
+	if ctx != nil && ctx.Done() == nil {
+		ctx = nil
+	}
+	vm.ctx = ctx
+}
+
+// InterpretFunction runs an already compiled script in the main module.
+func (vm *VM) InterpretFunction(function *value.ObjFunction) interpretresult.InterpretResult {
+	vm.lastError = nil
+	vm.resetLimits()
+
+	closure := value.NewClosure(function)
+	closure.Module = vm.mainModule
+	closure.Globals = vm.Globals.Link(function.GlobalNames)
+	vm.push(value.NewObjClosure(closure))
+
+	result := interpretresult.INTERPRET_RUNTIME_ERROR
+	if vm.call(closure, 0) {
+		result = vm.run(0)
+	}
+	if result == interpretresult.INTERPRET_OK {
+		vm.pop()
+	} else if vm.interrupted {
+		vm.resetStack()
+		return interpretresult.INTERPRET_INTERRUPTED
+	} else {
+		vm.reportException()
+		vm.resetStack()
+	}
+	return result
+}
+
+// InterpretFile runs source as the main script loaded from path, so that
+// its imports resolve relative to that file.
+func (vm *VM) InterpretFile(source string, path string) interpretresult.InterpretResult {
+	function, _ := compiler.CompileWithOptions(source, vm.compilerOptions(path))
 	if function == nil {
 		return interpretresult.INTERPRET_COMPILE_ERROR
 	}
 
-	vm.push(value.NewObjFunction(function))
-	vm.callValue(value.NewObjFunction(function), 0)
+	return vm.InterpretFunctionFile(function, path)
+}
 
-	return vm.run()
+// InterpretFunctionFile runs an already compiled script as the main script
+// loaded from path.
+func (vm *VM) InterpretFunctionFile(function *value.ObjFunction, path string) interpretresult.InterpretResult {
+	vm.mainModule.DisplayPath = path
+	if absPath, err := filepath.Abs(path); err == nil {
+		vm.mainModule.Path = absPath
+		vm.modules[absPath] = vm.mainModule
+		vm.importStack = append(vm.importStack, absPath)
+		defer func() {
+			vm.importStack = vm.importStack[:len(vm.importStack)-1]
+		}()
+	}
+
+	result := vm.InterpretFunction(function)
+	vm.mainModule.Loaded = true
+	return result
 }
 
 func (vm *VM) FreeVM() {}
 
-func (vm *VM) run() interpretresult.InterpretResult {
+// LastError returns the exception that ended the last script run, or nil if
+// it completed normally.
+func (vm *VM) LastError() *RuntimeError {
+	return vm.lastError
+}
+
+// run executes until the frame sitting at baseFrame returns, leaving its
+// result on the stack. An exception that escapes that frame is left pending
+// for the caller.
+func (vm *VM) run(baseFrame int) interpretresult.InterpretResult {
+	for {
+		result := vm.execute(baseFrame)
+		if result != interpretresult.INTERPRET_RUNTIME_ERROR {
+			return result
+		}
+
+		if !vm.unwind(baseFrame) {
+			return result
+		}
+	}
+}
+
+// execute runs the dispatch loop until the frame at baseFrame returns or an
+// exception is thrown, in which case the exception is left in vm.exception
+// for run to unwind.
+func (vm *VM) execute(baseFrame int) interpretresult.InterpretResult {
 	var frame *CallFrame = &vm.Frames[len(vm.Frames)-1]
 
 	for {
+		if vm.Limits.MaxInstructions > 0 {
+			vm.instructionCount++
+			if vm.instructionCount > vm.Limits.MaxInstructions {
+				vm.fatalError("Instruction limit exceeded.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+		}
+
+		if vm.ctx != nil {
+			if vm.contextTicks%CONTEXT_CHECK_INTERVAL == 0 && vm.ctx.Err() != nil {
+				vm.fatalError("Execution interrupted.")
+				vm.interrupted = true
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			vm.contextTicks++
+		}
+
 		if config.DEBUG_TRACE_EXECUTION {
-			fmt.Print("          ")
+			fmt.Fprint(vm.Debug, "          ")
 			for _, val := range vm.Stack {
-				fmt.Print("[ ")
-				val.PrintValue()
-				fmt.Print(" ]")
+				fmt.Fprintf(vm.Debug, "[ %s ]", val.String())
 			}
-			fmt.Print("\n")
-			debug.DisassembleInstruction(frame.Function.Chunk.(*chunk.Chunk), unsafecode.Diff(frame.IP, &((frame.Function.Chunk.GetCode())[0])))
+			fmt.Fprint(vm.Debug, "\n")
+			debug.FdisassembleInstruction(vm.Debug, frame.Closure.Function.Chunk.(*chunk.Chunk), frame.IP)
 		}
 
 		var instruction opcode.OpCode
-		switch instruction = opcode.OpCode(vm.readByte()); instruction {
+		switch instruction = opcode.OpCode(frame.readByte()); instruction {
 		case opcode.OP_CONSTANT, opcode.OP_CONSTANT_LONG:
 			var constant value.Value
 			if instruction == opcode.OP_CONSTANT {
-				constant = vm.readConstant()
+				constant = frame.readConstant()
 			} else {
-				constant = vm.readConstantLong()
+				constant = frame.readConstantLong()
 			}
 			vm.push(constant)
 
 		case opcode.OP_NIL:
-			vm.push(value.New(valuetype.VAL_NIL, nil))
+			vm.push(value.NilValue())
 
 		case opcode.OP_TRUE:
-			vm.push(value.New(valuetype.VAL_BOOL, true))
+			vm.push(value.BoolValue(true))
 
 		case opcode.OP_FALSE:
-			vm.push(value.New(valuetype.VAL_BOOL, false))
+			vm.push(value.BoolValue(false))
 
 		case opcode.OP_POP:
 			vm.pop()
@@ -108,72 +386,121 @@ func (vm *VM) run() interpretresult.InterpretResult {
 		case opcode.OP_GET_LOCAL, opcode.OP_GET_LOCAL_LONG:
 			var slot int
 			if instruction == opcode.OP_GET_LOCAL {
-				slot = int(vm.readByte())
+				slot = int(frame.readByte())
 			} else {
-				slot = int(vm.readLong())
+				slot = int(frame.readLong())
 			}
 			vm.push(vm.Stack[frame.Slots+slot])
 
 		case opcode.OP_SET_LOCAL, opcode.OP_SET_LOCAL_LONG:
 			var slot int
 			if instruction == opcode.OP_SET_LOCAL {
-				slot = int(vm.readByte())
+				slot = int(frame.readByte())
 			} else {
-				slot = int(vm.readLong())
+				slot = int(frame.readLong())
 			}
 			vm.Stack[frame.Slots+slot] = vm.peek(0)
 
 		case opcode.OP_GET_GLOBAL, opcode.OP_GET_GLOBAL_LONG:
-			var name string
+			var slot int
 			if instruction == opcode.OP_GET_GLOBAL {
-				name = vm.readConstant().AsGoString()
+				slot = int(frame.readByte())
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				slot = int(frame.readLong())
+			}
+			global := frame.Closure.Globals[slot]
+			if global.Defined {
+				vm.push(global.Value)
+				break
 			}
-			val, present := vm.Globals[name]
+
+			val, present := vm.Builtins[global.Name]
 			if !present {
-				vm.runtimeError("Undefined variable '%s'.", name)
+				vm.runtimeError("Undefined variable '%s'.", global.Name)
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 			vm.push(val)
 
 		case opcode.OP_DEFINE_GLOBAL, opcode.OP_DEFINE_GLOBAL_LONG:
-			var name string
+			var slot int
 			if instruction == opcode.OP_DEFINE_GLOBAL {
-				name = vm.readConstant().AsGoString()
+				slot = int(frame.readByte())
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				slot = int(frame.readLong())
 			}
-			vm.Globals[name] = vm.peek(0)
+			global := frame.Closure.Globals[slot]
+			global.Value = vm.peek(0)
+			global.Defined = true
 			vm.pop()
 
 		case opcode.OP_SET_GLOBAL, opcode.OP_SET_GLOBAL_LONG:
-			var name string
+			var slot int
 			if instruction == opcode.OP_SET_GLOBAL {
-				name = vm.readConstant().AsGoString()
+				slot = int(frame.readByte())
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				slot = int(frame.readLong())
 			}
-			_, present := vm.Globals[name]
-			if !present {
-				vm.runtimeError("Undefined variable '%s'.", name)
+			global := frame.Closure.Globals[slot]
+			if !global.Defined {
+				vm.runtimeError("Undefined variable '%s'.", global.Name)
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
-			vm.Globals[name] = vm.peek(0)
+			global.Value = vm.peek(0)
+
+		case opcode.OP_GET_UPVALUE:
+			slot := frame.readByte()
+			upvalue := frame.Closure.Upvalues[slot]
+			if upvalue.IsClosed {
+				vm.push(upvalue.Closed)
+			} else {
+				vm.push(vm.Stack[upvalue.Location])
+			}
+
+		case opcode.OP_SET_UPVALUE:
+			slot := frame.readByte()
+			upvalue := frame.Closure.Upvalues[slot]
+			if upvalue.IsClosed {
+				upvalue.Closed = vm.peek(0)
+			} else {
+				vm.Stack[upvalue.Location] = vm.peek(0)
+			}
 
 		case opcode.OP_GET_PROPERTY, opcode.OP_GET_PROPERTY_LONG:
+			var name string
+			if instruction == opcode.OP_GET_PROPERTY {
+				name = frame.readConstant().AsGoString()
+			} else {
+				name = frame.readConstantLong().AsGoString()
+			}
+
+			if vm.peek(0).IsModule() {
+				member, present := vm.peek(0).AsModule().Globals.Get(name)
+				if !present {
+					vm.runtimeError("Undefined property '%s'.", name)
+					return interpretresult.INTERPRET_RUNTIME_ERROR
+				}
+
+				vm.pop() // Module
+				vm.push(member)
+				break
+			}
+
+			if methods := builtinMethodsOf(vm.peek(0)); methods != nil {
+				if _, present := methods[name]; !present {
+					vm.runtimeError("Undefined property '%s'.", name)
+					return interpretresult.INTERPRET_RUNTIME_ERROR
+				}
+
+				vm.push(value.NewObjBoundBuiltin(vm.pop(), name))
+				break
+			}
+
 			if !vm.peek(0).IsInstance() {
 				vm.runtimeError("Only instances have properties.")
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
 			instacne := vm.peek(0).AsInstance()
-			var name string
-			if instruction == opcode.OP_GET_PROPERTY {
-				name = vm.readConstant().AsGoString()
-			} else {
-				name = vm.readConstantLong().AsGoString()
-			}
 
 			value, present := instacne.Fields[name]
 			if present {
@@ -195,9 +522,9 @@ func (vm *VM) run() interpretresult.InterpretResult {
 			instance := vm.peek(1).AsInstance()
 			var name string
 			if instruction == opcode.OP_SET_PROPERTY {
-				name = vm.readConstant().AsGoString()
+				name = frame.readConstant().AsGoString()
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				name = frame.readConstantLong().AsGoString()
 			}
 
 			instance.Fields[name] = vm.peek(0)
@@ -206,17 +533,66 @@ func (vm *VM) run() interpretresult.InterpretResult {
 			vm.push(value)
 
 		case opcode.OP_GET_SUPER:
-			name := vm.readConstant().AsGoString()
+			name := frame.readConstant().AsGoString()
+			if !vm.peek(0).IsClass() {
+				vm.runtimeError("Superclass must be a class.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
 			superClass := vm.pop().AsClass()
 
 			if !vm.bindMethod(superClass, name) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
+		case opcode.OP_BUILD_LIST:
+			itemCount := int(frame.readByte())
+			if !vm.allocate(OBJ_SIZE + itemCount*VALUE_SIZE) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			items := make([]value.Value, itemCount)
+			copy(items, vm.Stack[len(vm.Stack)-itemCount:])
+			for i := 0; i < itemCount; i++ {
+				vm.pop()
+			}
+			vm.push(value.NewObjList(items))
+
+		case opcode.OP_BUILD_MAP:
+			entryCount := int(frame.readByte())
+			if !vm.allocate(OBJ_SIZE + 2*entryCount*VALUE_SIZE) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			m := value.NewMap()
+			for i := len(vm.Stack) - 2*entryCount; i < len(vm.Stack); i += 2 {
+				key, ok := vm.hashKey(vm.Stack[i])
+				if !ok {
+					return interpretresult.INTERPRET_RUNTIME_ERROR
+				}
+				m.Set(key, vm.Stack[i], vm.Stack[i+1])
+			}
+			for i := 0; i < 2*entryCount; i++ {
+				vm.pop()
+			}
+			vm.push(value.NewObjMap(m))
+
+		case opcode.OP_INTERPOLATE:
+			if !vm.interpolate(int(frame.readByte())) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+		case opcode.OP_GET_INDEX:
+			if !vm.getIndex() {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+		case opcode.OP_SET_INDEX:
+			if !vm.setIndex() {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
 		case opcode.OP_EQUAL:
 			b := vm.pop()
 			a := vm.pop()
-			vm.push(value.New(valuetype.VAL_BOOL, value.ValuesEqual(a, b)))
+			vm.push(value.BoolValue(value.ValuesEqual(a, b)))
 
 		case opcode.OP_GREATER:
 			if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
@@ -224,8 +600,8 @@ func (vm *VM) run() interpretresult.InterpretResult {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.binaryOP(valuetype.VAL_BOOL, func(a, b value.Value) interface{} {
-				return a.AsNumber() > b.AsNumber()
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.BoolValue(a > b)
 			})
 
 		case opcode.OP_LESS:
@@ -234,30 +610,42 @@ func (vm *VM) run() interpretresult.InterpretResult {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.binaryOP(valuetype.VAL_BOOL, func(a, b value.Value) interface{} {
-				return a.AsNumber() < b.AsNumber()
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.BoolValue(a < b)
 			})
 
 		case opcode.OP_ADD:
 			if vm.peek(0).IsString() && vm.peek(1).IsString() {
-				vm.concatenate()
+				if !vm.concatenate() {
+					return interpretresult.INTERPRET_RUNTIME_ERROR
+				}
 			} else if vm.peek(0).IsNumber() && vm.peek(1).IsNumber() {
-				vm.binaryOP(valuetype.VAL_NUMBER, func(a, b value.Value) interface{} {
-					return a.AsNumber() + b.AsNumber()
+				vm.binaryOP(func(a, b float64) value.Value {
+					return value.NumberValue(a + b)
 				})
 			} else {
 				vm.runtimeError("Operands must be numbers.")
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
+		case opcode.OP_SUBTRACT:
+			if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
+				vm.runtimeError("Operands must be numbers.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.NumberValue(a - b)
+			})
+
 		case opcode.OP_MULTIPLY:
 			if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
 				vm.runtimeError("Operands must be numbers.")
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.binaryOP(valuetype.VAL_NUMBER, func(a, b value.Value) interface{} {
-				return a.AsNumber() * b.AsNumber()
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.NumberValue(a * b)
 			})
 
 		case opcode.OP_DIVIDE:
@@ -266,12 +654,32 @@ func (vm *VM) run() interpretresult.InterpretResult {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.binaryOP(valuetype.VAL_NUMBER, func(a, b value.Value) interface{} {
-				return a.AsNumber() / b.AsNumber()
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.NumberValue(a / b)
+			})
+
+		case opcode.OP_MODULO:
+			if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
+				vm.runtimeError("Operands must be numbers.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.NumberValue(math.Mod(a, b))
+			})
+
+		case opcode.OP_POWER:
+			if !vm.peek(0).IsNumber() || !vm.peek(1).IsNumber() {
+				vm.runtimeError("Operands must be numbers.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+			vm.binaryOP(func(a, b float64) value.Value {
+				return value.NumberValue(math.Pow(a, b))
 			})
 
 		case opcode.OP_NOT:
-			vm.push(value.New(valuetype.VAL_BOOL, isFalsey(vm.pop())))
+			vm.push(value.BoolValue(isFalsey(vm.pop())))
 
 		case opcode.OP_NEGATE:
 			if !vm.peek(0).IsNumber() {
@@ -279,83 +687,190 @@ func (vm *VM) run() interpretresult.InterpretResult {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 
-			vm.push(value.New(valuetype.VAL_NUMBER, -vm.pop().AsNumber()))
+			vm.push(value.NumberValue(-vm.pop().AsNumber()))
 
 		case opcode.OP_PRINT:
-			vm.pop().PrintValue()
-			fmt.Printf("\n")
+			fmt.Fprintf(vm.Stdout, "%s\n", vm.pop().String())
 
 		case opcode.OP_JUMP:
-			offset := vm.readShort()
-			frame.IP = unsafecode.Increment(frame.IP, int(offset))
+			offset := frame.readShort()
+			frame.IP += int(offset)
 
 		case opcode.OP_JUMP_IF_FALSE:
-			offset := vm.readShort()
+			offset := frame.readShort()
 			if isFalsey(vm.peek(0)) {
-				frame.IP = unsafecode.Increment(frame.IP, int(offset))
+				frame.IP += int(offset)
 			}
 
 		case opcode.OP_LOOP:
-			offset := vm.readShort()
-			frame.IP = unsafecode.Decrement(frame.IP, int(offset))
+			offset := frame.readShort()
+			frame.IP -= int(offset)
+
+		case opcode.OP_THROW:
+			vm.throw(vm.pop())
+			return interpretresult.INTERPRET_RUNTIME_ERROR
+
+		case opcode.OP_SETUP_CATCH, opcode.OP_SETUP_FINALLY:
+			offset := frame.readShort()
+			handler := ExceptionHandler{
+				Handler:    frame.IP + int(offset),
+				StackDepth: len(vm.Stack),
+				IsFinally:  instruction == opcode.OP_SETUP_FINALLY,
+			}
+			frame.Handlers = append(frame.Handlers, handler)
+
+		case opcode.OP_POP_HANDLER:
+			frame.Handlers = frame.Handlers[:len(frame.Handlers)-1]
+
+		case opcode.OP_END_FINALLY:
+			completion := vm.pop()
+			pending := vm.pop()
+			if completion.IsNil() {
+				break
+			}
+
+			if completion.AsNumber() == COMPLETION_THROW {
+				vm.rethrow(pending)
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+			if vm.enterFinally(pending) {
+				break
+			}
+			if vm.returnFrom(pending, baseFrame) {
+				return interpretresult.INTERPRET_OK
+			}
+			frame = &vm.Frames[len(vm.Frames)-1]
 
 		case opcode.OP_CALL:
-			argCount := vm.readByte()
+			argCount := frame.readByte()
 			if !vm.callValue(vm.peek(int(argCount)), int(argCount)) {
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
 			frame = &vm.Frames[len(vm.Frames)-1]
 
+		case opcode.OP_CLOSURE, opcode.OP_CLOSURE_LONG:
+			var function *value.ObjFunction
+			if instruction == opcode.OP_CLOSURE {
+				function = frame.readConstant().AsFunction()
+			} else {
+				function = frame.readConstantLong().AsFunction()
+			}
+
+			if !vm.allocate(OBJ_SIZE + function.UpvalueCount*OBJ_SIZE) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			closure := value.NewClosure(function)
+			closure.Module = frame.Closure.Module
+			closure.Globals = frame.Closure.Globals
+			vm.push(value.NewObjClosure(closure))
+			for i := range closure.Upvalues {
+				isLocal := frame.readByte()
+				index := int(frame.readByte())
+				if isLocal == 1 {
+					closure.Upvalues[i] = vm.captureUpvalue(frame.Slots + index)
+				} else {
+					closure.Upvalues[i] = frame.Closure.Upvalues[index]
+				}
+			}
+
+		case opcode.OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(len(vm.Stack) - 1)
+			vm.pop()
+
 		case opcode.OP_INHERIT:
 			superClass := vm.peek(1)
 			if !superClass.IsClass() {
 				vm.runtimeError("Superclass must be a class.")
 				return interpretresult.INTERPRET_RUNTIME_ERROR
 			}
+			if !vm.peek(0).IsClass() {
+				vm.runtimeError("Only classes can inherit.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
 			subClass := vm.peek(0).AsClass()
+			subClass.SuperClass = superClass.AsClass()
 
 			/* Add superClass methods to subClass*/
 			for index, element := range superClass.AsClass().Methods {
 				subClass.Methods[index] = element
 			}
+			for index, element := range superClass.AsClass().NativeMethods {
+				subClass.NativeMethods[index] = element
+			}
 			vm.pop()
 
 		case opcode.OP_METHOD, opcode.OP_METHOD_LONG:
 			var name string
 			if instruction == opcode.OP_METHOD {
-				name = vm.readConstant().AsGoString()
+				name = frame.readConstant().AsGoString()
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				name = frame.readConstantLong().AsGoString()
 			}
 
-			vm.defineMethod(name)
+			if !vm.defineMethod(name) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+
+		case opcode.OP_IMPORT, opcode.OP_IMPORT_LONG:
+			var path string
+			if instruction == opcode.OP_IMPORT {
+				path = frame.readConstant().AsGoString()
+			} else {
+				path = frame.readConstantLong().AsGoString()
+			}
+
+			module, ok := vm.importModule(path)
+			if !ok {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(value.NewObjModule(module))
+
+			// Running the module may have grown vm.Frames.
+			frame = &vm.Frames[len(vm.Frames)-1]
+
+		case opcode.OP_IMPORT_FROM, opcode.OP_IMPORT_FROM_LONG:
+			var name string
+			if instruction == opcode.OP_IMPORT_FROM {
+				name = frame.readConstant().AsGoString()
+			} else {
+				name = frame.readConstantLong().AsGoString()
+			}
+
+			if !vm.peek(0).IsModule() {
+				vm.runtimeError("Only modules have members to import.")
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			module := vm.pop().AsModule()
+			member, present := module.Globals.Get(name)
+			if !present {
+				vm.runtimeError("Module '%s' has no member '%s'.", module.Name, name)
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
+			vm.push(member)
 
 		case opcode.OP_CLASS, opcode.OP_CLASS_LONG:
 			var name string
 			if instruction == opcode.OP_CLASS {
-				name = vm.readConstant().AsGoString()
+				name = frame.readConstant().AsGoString()
 			} else {
-				name = vm.readConstantLong().AsGoString()
+				name = frame.readConstantLong().AsGoString()
 			}
 
+			if !vm.allocate(OBJ_SIZE) {
+				return interpretresult.INTERPRET_RUNTIME_ERROR
+			}
 			vm.push(value.NewObjClass(name))
 
 		case opcode.OP_RETURN:
 			result := vm.pop()
 
-			vm.popFrame()
-			if len(vm.Frames) == 0 {
-				vm.pop()
-				return interpretresult.INTERPRET_OK
+			if vm.enterFinally(result) {
+				break
 			}
-
-			for {
-				if len(vm.Stack) == frame.Slots {
-					break
-				}
-				vm.pop()
+			if vm.returnFrom(result, baseFrame) {
+				return interpretresult.INTERPRET_OK
 			}
-			vm.push(result)
 
 			frame = &vm.Frames[len(vm.Frames)-1]
 
@@ -379,6 +894,78 @@ func (vm *VM) popFrame() {
 	vm.Frames = vm.Frames[:len(vm.Frames)-1]
 }
 
+func (vm *VM) truncateStack(depth int) {
+	for len(vm.Stack) > depth {
+		vm.pop()
+	}
+}
+
+// returnFrom pops the current frame, leaving result in place of the callee
+// and its arguments. It reports whether the frame at baseFrame returned.
+func (vm *VM) returnFrom(result value.Value, baseFrame int) bool {
+	frame := &vm.Frames[len(vm.Frames)-1]
+
+	vm.closeUpvalues(frame.Slots)
+	vm.popFrame()
+	vm.truncateStack(frame.Slots)
+	vm.push(result)
+
+	return len(vm.Frames) == baseFrame
+}
+
+// enterFinally jumps to the innermost finally block of the current frame so
+// it runs before the frame returns result. It reports whether there was one.
+func (vm *VM) enterFinally(result value.Value) bool {
+	frame := &vm.Frames[len(vm.Frames)-1]
+
+	for len(frame.Handlers) > 0 {
+		handler := frame.Handlers[len(frame.Handlers)-1]
+		frame.Handlers = frame.Handlers[:len(frame.Handlers)-1]
+		if !handler.IsFinally {
+			continue
+		}
+
+		vm.closeUpvalues(handler.StackDepth)
+		vm.truncateStack(handler.StackDepth)
+		vm.push(result)
+		vm.push(value.NumberValue(COMPLETION_RETURN))
+		frame.IP = handler.Handler
+		return true
+	}
+
+	return false
+}
+
+// unwind pops frames down to baseFrame until it finds a handler for the
+// pending exception and transfers control to it. It reports whether the
+// exception was caught.
+func (vm *VM) unwind(baseFrame int) bool {
+	for len(vm.Frames) > baseFrame {
+		frame := &vm.Frames[len(vm.Frames)-1]
+
+		if len(frame.Handlers) > 0 && !vm.fatal {
+			handler := frame.Handlers[len(frame.Handlers)-1]
+			frame.Handlers = frame.Handlers[:len(frame.Handlers)-1]
+
+			vm.closeUpvalues(handler.StackDepth)
+			vm.truncateStack(handler.StackDepth)
+			vm.push(vm.exception)
+			if handler.IsFinally {
+				vm.push(value.NumberValue(COMPLETION_THROW))
+				vm.holdThrow(frame, handler.StackDepth)
+			}
+			frame.IP = handler.Handler
+			return true
+		}
+
+		vm.closeUpvalues(frame.Slots)
+		vm.truncateStack(frame.Slots)
+		vm.popFrame()
+	}
+
+	return false
+}
+
 func (vm *VM) shrinkStack() {
 	if cap(vm.Stack) > STACK_INITIAL_SIZE*2 && len(vm.Stack) <= (cap(vm.Stack)/2) {
 		vm.Stack = append([]value.Value(nil), vm.Stack[:len(vm.Stack)]...)
@@ -389,13 +976,19 @@ func (vm *VM) peek(distance int) value.Value {
 	return vm.Stack[len(vm.Stack)-1-distance]
 }
 
-func (vm *VM) call(function *value.ObjFunction, argCount int) bool {
+func (vm *VM) call(closure *value.ObjClosure, argCount int) bool {
+	function := closure.Function
 	if argCount != function.Arity {
 		vm.runtimeError("Expect %d arguments but got %d.", function.Arity, argCount)
 		return false
 	}
 
-	frame := CallFrame{Function: function, IP: &((function.Chunk.GetCode())[0]), Slots: len(vm.Stack) - argCount - 1}
+	if len(vm.Frames) >= vm.Limits.MaxFrames {
+		vm.runtimeError("Stack overflow.")
+		return false
+	}
+
+	frame := CallFrame{Closure: closure, Slots: len(vm.Stack) - argCount - 1, code: function.Chunk.GetCode()}
 	vm.Frames = append(vm.Frames, frame)
 
 	return true
@@ -412,10 +1005,21 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 
 		case objtype.OBJ_CLASS:
 			klass := callee.AsClass()
+			if !vm.allocate(OBJ_SIZE) {
+				return false
+			}
 			vm.Stack[len(vm.Stack)-argCount-1] = value.NewObjInstance(klass)
 			initializer, present := klass.Methods[vm.InitString]
 			if present {
 				return vm.call(initializer, argCount)
+			} else if native, present := klass.NativeMethods[vm.InitString]; present {
+				instance := vm.peek(argCount)
+				if !vm.callNative(native, argCount, true) {
+					return false
+				}
+				vm.pop()
+				vm.push(instance)
+				return true
 			} else if argCount != 0 {
 				vm.runtimeError("Expected 0 arguments but got %d.",
 					argCount)
@@ -423,12 +1027,22 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 			}
 			return true
 
-		case objtype.OBJ_FUNCTION:
-			return vm.call(callee.AsFunction(), argCount)
+		case objtype.OBJ_CLOSURE:
+			return vm.call(callee.AsClosure(), argCount)
 
-		case objtype.OBJ_NATIVE:
-			native := callee.AsNative()
-			result := native.Function(argCount, vm.Stack[len(vm.Stack)-argCount:])
+		case objtype.OBJ_BOUND_BUILTIN:
+			bound := callee.AsBoundBuiltin()
+			if bound.Receiver.IsInstance() {
+				vm.Stack[len(vm.Stack)-argCount-1] = bound.Receiver
+				native := bound.Receiver.AsInstance().Klass.NativeMethods[bound.Name]
+				return vm.callNative(native, argCount, true)
+			}
+
+			method := builtinMethodsOf(bound.Receiver)[bound.Name]
+			result, ok := method(vm, bound.Receiver, vm.Stack[len(vm.Stack)-argCount:])
+			if !ok {
+				return false
+			}
 
 			for i := 0; i < argCount+1; i++ {
 				vm.pop()
@@ -436,8 +1050,10 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 			vm.push(result)
 			return true
 
+		case objtype.OBJ_NATIVE:
+			return vm.callNative(callee.AsNative(), argCount, false)
+
 		default:
-			return false
 			// Non-callable object type.
 
 		}
@@ -447,9 +1063,145 @@ func (vm *VM) callValue(callee value.Value, argCount int) bool {
 	return false
 }
 
+// callNative calls a Go function with the arguments on top of the stack, and
+// the receiver below them for native methods.
+func (vm *VM) callNative(native *value.ObjNative, argCount int, withReceiver bool) bool {
+	if !vm.checkArity(native.Arity, argCount) {
+		return false
+	}
+
+	args := vm.Stack[len(vm.Stack)-argCount:]
+	if withReceiver {
+		args = vm.Stack[len(vm.Stack)-argCount-1:]
+	}
+
+	result, err := native.Function(len(args), args)
+	if err != nil {
+		vm.nativeError(err)
+		return false
+	}
+
+	vm.truncateStack(len(vm.Stack) - argCount - 1)
+	vm.push(result)
+	return true
+}
+
+// nativeError raises err from a native. Errors coming out of a nested Call
+// rethrow the original exception.
+func (vm *VM) nativeError(err error) {
+	if runtimeErr, ok := err.(*RuntimeError); ok {
+		vm.throw(runtimeErr.Value)
+		return
+	}
+	vm.runtimeError("%s", err.Error())
+}
+
+func (vm *VM) captureUpvalue(local int) *value.ObjUpvalue {
+	var prevUpvalue *value.ObjUpvalue
+	upvalue := vm.OpenUpvalues
+	for upvalue != nil && upvalue.Location > local {
+		prevUpvalue = upvalue
+		upvalue = upvalue.Next
+	}
+
+	if upvalue != nil && upvalue.Location == local {
+		return upvalue
+	}
+
+	createdUpvalue := value.NewUpvalue(local)
+	createdUpvalue.Next = upvalue
+
+	if prevUpvalue == nil {
+		vm.OpenUpvalues = createdUpvalue
+	} else {
+		prevUpvalue.Next = createdUpvalue
+	}
+
+	return createdUpvalue
+}
+
+func (vm *VM) closeUpvalues(last int) {
+	for vm.OpenUpvalues != nil && vm.OpenUpvalues.Location >= last {
+		upvalue := vm.OpenUpvalues
+		upvalue.Closed = vm.Stack[upvalue.Location]
+		upvalue.IsClosed = true
+		vm.OpenUpvalues = upvalue.Next
+	}
+}
+
+func builtinMethodsOf(receiver value.Value) map[string]builtinMethod {
+	if receiver.IsList() {
+		return listMethods
+	}
+	if receiver.IsMap() {
+		return mapMethods
+	}
+	return nil
+}
+
+func (vm *VM) getIndex() bool {
+	var result value.Value
+
+	if vm.peek(1).IsList() {
+		list := vm.peek(1).AsList()
+		index, ok := vm.listIndex(list, vm.peek(0), len(list.Items)-1)
+		if !ok {
+			return false
+		}
+		result = list.Items[index]
+	} else if vm.peek(1).IsMap() {
+		key, ok := vm.hashKey(vm.peek(0))
+		if !ok {
+			return false
+		}
+		if result, ok = vm.peek(1).AsMap().Get(key); !ok {
+			result = value.NilValue()
+		}
+	} else {
+		vm.runtimeError("Only lists and maps can be indexed.")
+		return false
+	}
+
+	vm.pop()
+	vm.pop()
+	vm.push(result)
+	return true
+}
+
+func (vm *VM) setIndex() bool {
+	if vm.peek(2).IsList() {
+		list := vm.peek(2).AsList()
+		index, ok := vm.listIndex(list, vm.peek(1), len(list.Items)-1)
+		if !ok {
+			return false
+		}
+		list.Items[index] = vm.peek(0)
+	} else if vm.peek(2).IsMap() {
+		key, ok := vm.hashKey(vm.peek(1))
+		if !ok || !vm.allocate(2*VALUE_SIZE) {
+			return false
+		}
+		vm.peek(2).AsMap().Set(key, vm.peek(1), vm.peek(0))
+	} else {
+		vm.runtimeError("Only lists and maps can be indexed.")
+		return false
+	}
+
+	result := vm.pop()
+	vm.pop()
+	vm.pop()
+	vm.push(result)
+	return true
+}
+
 func (vm *VM) bindMethod(klass *value.ObjClass, name string) bool {
 	method, present := klass.Methods[name]
 	if !present {
+		if _, present := klass.NativeMethods[name]; present {
+			vm.push(value.NewObjBoundBuiltin(vm.pop(), name))
+			return true
+		}
+
 		vm.runtimeError("Undefined property '%s'.", name)
 		return false
 	}
@@ -462,115 +1214,304 @@ func (vm *VM) bindMethod(klass *value.ObjClass, name string) bool {
 	return true
 }
 
-func (vm *VM) defineMethod(name string) {
+func (vm *VM) defineMethod(name string) bool {
 	method := vm.peek(0)
+	if !vm.peek(1).IsClass() || !method.IsClosure() {
+		vm.runtimeError("Only functions can be defined as methods of a class.")
+		return false
+	}
+
 	klass := vm.peek(1).AsClass()
-	klass.Methods[name] = method.AsFunction()
+	klass.Methods[name] = method.AsClosure()
 	vm.pop()
+	return true
 }
 
 func isFalsey(val value.Value) bool {
 	return val.IsNil() || (val.IsBool() && !val.AsBool())
 }
 
-func (vm *VM) concatenate() {
-	b := vm.pop().AsGoString()
-	a := vm.pop().AsGoString()
+func (vm *VM) concatenate() bool {
+	b := vm.peek(0).AsGoString()
+	a := vm.peek(1).AsGoString()
+	if !vm.allocate(OBJ_SIZE + len(a) + len(b)) {
+		return false
+	}
 
+	vm.pop()
+	vm.pop()
 	vm.push(value.NewObjString(a + b))
+	return true
 }
 
-func (vm *VM) readByte() byte {
-	frame := &vm.Frames[len(vm.Frames)-1]
+// interpolate replaces the top partCount values with the string joining
+// them, each formatted the way print formats it.
+func (vm *VM) interpolate(partCount int) bool {
+	var builder strings.Builder
+	for _, part := range vm.Stack[len(vm.Stack)-partCount:] {
+		builder.WriteString(part.String())
+	}
+	if !vm.allocate(OBJ_SIZE + builder.Len()) {
+		return false
+	}
+
+	for i := 0; i < partCount; i++ {
+		vm.pop()
+	}
+	vm.push(value.NewObjString(builder.String()))
+	return true
+}
 
-	returnVal := *(frame.IP)
-	frame.IP = unsafecode.Increment(frame.IP, 1)
+// readByte reads the next byte of frame's code. The readers take the frame
+// the dispatch loop already holds rather than looking it up in vm.Frames.
+func (frame *CallFrame) readByte() byte {
+	returnVal := frame.code[frame.IP]
+	frame.IP++
 
 	return returnVal
 }
 
-func (vm *VM) readShort() uint16 {
-	bytes := make([]byte, 0)
-	for i := 0; i < 4; i++ {
-		if i == 2 || i == 3 {
-			bytes = append(bytes, 0)
-			break
-		}
-		bytes = append(bytes, vm.readByte())
-	}
-	return binary.BigEndian.Uint16(bytes)
-}
+// readShort reads a big-endian 2 byte operand, as used by jumps.
+func (frame *CallFrame) readShort() uint16 {
+	returnVal := uint16(frame.code[frame.IP])<<8 | uint16(frame.code[frame.IP+1])
+	frame.IP += 2
 
-func (vm *VM) readLong() uint32 {
-	bytes := make([]byte, 0)
-	for i := 0; i < 4; i++ {
-		if i == 3 {
-			bytes = append(bytes, 0)
-			break
-		}
-		bytes = append(bytes, vm.readByte())
-	}
-	return binary.LittleEndian.Uint32(bytes)
+	return returnVal
 }
 
-func (vm *VM) readConstant() value.Value {
-	frame := &vm.Frames[len(vm.Frames)-1]
-	return frame.Function.Chunk.GetConstants().Values[vm.readByte()]
+// readLong reads a little-endian 3 byte operand, as used by the _LONG
+// instructions.
+func (frame *CallFrame) readLong() uint32 {
+	returnVal := uint32(frame.code[frame.IP]) | uint32(frame.code[frame.IP+1])<<8 | uint32(frame.code[frame.IP+2])<<16
+	frame.IP += 3
+
+	return returnVal
 }
 
-func (vm *VM) readConstantLong() value.Value {
-	constBytes := make([]byte, 0)
-	for i := 0; i < 4; i++ {
-		if i == 3 {
-			constBytes = append(constBytes, 0)
-			break
-		}
-		constBytes = append(constBytes, vm.readByte())
-	}
+func (frame *CallFrame) readConstant() value.Value {
+	return frame.Closure.Function.Chunk.GetConstants().Values[frame.readByte()]
+}
 
-	var constantAddress uint32 = binary.LittleEndian.Uint32(constBytes)
-	frame := &vm.Frames[len(vm.Frames)-1]
-	return frame.Function.Chunk.GetConstants().Values[constantAddress]
+func (frame *CallFrame) readConstantLong() value.Value {
+	return frame.Closure.Function.Chunk.GetConstants().Values[frame.readLong()]
 }
 
-func (vm *VM) binaryOP(valueType valuetype.ValueType, op func(a, b value.Value) interface{}) {
+func (vm *VM) binaryOP(op func(a, b float64) value.Value) {
 	b := vm.pop()
 	a := vm.pop()
-	vm.push(value.New(valueType, op(a, b)))
+	vm.push(op(a.AsNumber(), b.AsNumber()))
 }
 
 func (vm *VM) resetStack() {
 	vm.Frames = make([]CallFrame, 0, FRAMES_INITIAL_SIZE)
 	vm.Stack = make([]value.Value, 0, STACK_INITIAL_SIZE)
-	vm.Globals = make(map[string]value.Value)
+	vm.OpenUpvalues = nil
 }
 
 func (vm *VM) runtimeError(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, format, args...)
-	fmt.Println()
+	err := value.NewObjInstance(vm.errorClass)
+	err.AsInstance().Fields["message"] = value.NewObjString(fmt.Sprintf(format, args...))
+
+	vm.throw(err)
+}
+
+// throw makes val the pending exception. Error instances get the position
+// and stack trace of the first place they were thrown from.
+func (vm *VM) throw(val value.Value) {
+	vm.exception = val
+
+	isError := vm.isError(val)
+	if isError {
+		if _, present := val.AsInstance().Fields["stack"]; present {
+			// Rethrown, so it is still reported where it was first
+			// thrown.
+			return
+		}
+	}
+
+	vm.exceptionSite = vm.currentSite()
+	vm.exceptionTrace = vm.stackTrace()
+	if !isError {
+		return
+	}
+
+	stack := make([]value.Value, len(vm.exceptionTrace))
+	for i, line := range vm.exceptionTrace {
+		stack[i] = value.NewObjString(line)
+	}
+	fields := val.AsInstance().Fields
+	fields["line"] = value.NumberValue(float64(vm.exceptionSite.line))
+	fields["column"] = value.NumberValue(float64(vm.exceptionSite.column))
+	fields["stack"] = value.NewObjList(stack)
+}
 
+// holdThrow records where the pending exception was thrown, as it is carried
+// through the finally block set up at stackDepth. Records left by finally
+// blocks that were exited without completing are dropped first.
+func (vm *VM) holdThrow(frame *CallFrame, stackDepth int) {
+	for last := len(frame.pending) - 1; last >= 0 && frame.pending[last].stackDepth >= stackDepth; last-- {
+		frame.pending = frame.pending[:last]
+	}
+	frame.pending = append(frame.pending, pendingThrow{
+		stackDepth: stackDepth,
+		site:       vm.exceptionSite,
+		trace:      vm.exceptionTrace,
+	})
+}
+
+// rethrow makes val the pending exception again once the finally block
+// carrying it completes, keeping the site it was first thrown from.
+func (vm *VM) rethrow(val value.Value) {
+	frame := &vm.Frames[len(vm.Frames)-1]
+	last := len(frame.pending) - 1
+	if last < 0 {
+		vm.throw(val)
+		return
+	}
+
+	vm.exception = val
+	vm.exceptionSite = frame.pending[last].site
+	vm.exceptionTrace = frame.pending[last].trace
+	frame.pending = frame.pending[:last]
+}
+
+func (vm *VM) isError(val value.Value) bool {
+	if !val.IsInstance() {
+		return false
+	}
+
+	for klass := val.AsInstance().Klass; klass != nil; klass = klass.SuperClass {
+		if klass == vm.errorClass {
+			return true
+		}
+	}
+	return false
+}
+
+func (vm *VM) frameSite(frame *CallFrame) site {
+	// -1 because the IP is sitting on the next instruction to be
+	// executed.
+	offset := frame.IP - 1
+	if offset < 0 {
+		offset = 0
+	}
+
+	function := frame.Closure.Function
+	line, column := function.Chunk.GetPosition(offset)
+	current := site{source: function.Source, line: line, column: column}
+	if function.Source != nil {
+		current.path = function.Source.Path
+	} else {
+		// Loaded from a compiled file, which keeps no source.
+		current.path = frame.Closure.Module.DisplayPath
+	}
+	return current
+}
+
+func (vm *VM) currentSite() site {
+	if len(vm.Frames) == 0 {
+		return site{}
+	}
+	return vm.frameSite(&vm.Frames[len(vm.Frames)-1])
+}
+
+// stackTrace lists the active frames innermost first. Runs of identical lines,
+// as left by deep recursion, are collapsed into a count.
+func (vm *VM) stackTrace() []string {
+	trace := make([]string, 0, len(vm.Frames))
+	repeated := 0
 	for i := len(vm.Frames) - 1; i >= 0; i-- {
 		frame := &vm.Frames[i]
-		function := frame.Function
-		// -1 because the IP is sitting on the next instruction to be
-		// executed.
-		offset := unsafecode.Diff(frame.IP, &((frame.Function.Chunk.GetCode())[0]))
-		line := (function.Chunk.GetLines())[offset]
-		fmt.Fprintf(os.Stderr, "[line %d] in ", line)
+		function := frame.Closure.Function
+
+		var line string
 		if function.Name == nil {
-			fmt.Fprintf(os.Stderr, "script\n")
+			line = fmt.Sprintf("%s in script", vm.frameSite(frame).location())
 		} else {
-			fmt.Fprintf(os.Stderr, "%s()\n", function.Name.String)
+			line = fmt.Sprintf("%s in %s()", vm.frameSite(frame).location(), function.Name.String)
+		}
+
+		if len(trace) > 0 && trace[len(trace)-1] == line {
+			repeated++
+			continue
+		}
+		if repeated > 0 {
+			trace = append(trace, fmt.Sprintf("[previous line repeated %d more times]", repeated))
+			repeated = 0
 		}
+		trace = append(trace, line)
 	}
+	if repeated > 0 {
+		trace = append(trace, fmt.Sprintf("[previous line repeated %d more times]", repeated))
+	}
+	return trace
+}
 
-	vm.resetStack()
+// newRuntimeError describes the pending exception. Error instances keep the
+// position and stack trace of the place they were first thrown from.
+func (vm *VM) newRuntimeError() *RuntimeError {
+	err := &RuntimeError{
+		Value:   vm.exception,
+		Path:    vm.exceptionSite.path,
+		Line:    vm.exceptionSite.line,
+		Column:  vm.exceptionSite.column,
+		Excerpt: vm.exceptionSite.excerpt(),
+		Trace:   vm.exceptionTrace,
+	}
+
+	if !vm.isError(vm.exception) {
+		err.Message = fmt.Sprintf("Uncaught exception: %s", vm.exception.String())
+		return err
+	}
+
+	fields := vm.exception.AsInstance().Fields
+	if message, present := fields["message"]; present {
+		err.Message = message.String()
+	} else {
+		err.Message = vm.exception.String()
+	}
+
+	if line, present := fields["line"]; present && line.IsNumber() {
+		err.Line = int(line.AsNumber())
+	}
+	if column, present := fields["column"]; present && column.IsNumber() {
+		err.Column = int(column.AsNumber())
+	}
+	if err.Line != vm.exceptionSite.line || err.Column != vm.exceptionSite.column {
+		// Another exception was thrown since this one was, so the
+		// source it came from is unknown.
+		err.Excerpt = ""
+	}
+
+	if stack, present := fields["stack"]; present && stack.IsList() {
+		err.Trace = make([]string, 0, len(stack.AsList().Items))
+		for _, line := range stack.AsList().Items {
+			err.Trace = append(err.Trace, line.String())
+		}
+	}
+	return err
+}
+
+func (vm *VM) reportException() {
+	vm.lastError = vm.newRuntimeError()
+
+	report := vm.lastError.Diagnostic()
+	fmt.Fprintf(vm.Stderr, "%s\n", report.String())
+	if vm.Diagnostics != nil {
+		vm.Diagnostics.Report(report)
+	}
+}
+
+func (vm *VM) compilerOptions(path string) compiler.Options {
+	return compiler.Options{ErrorWriter: vm.Stderr, DebugWriter: vm.Debug, Diagnostics: vm.Diagnostics, NoOptimize: vm.NoOptimize, Path: path}
 }
 
-func (vm *VM) defineNative(name string, function value.NativeFn) {
+// DefineNative makes function callable from scripts under name. Calls with a
+// number of arguments arity doesn't accept fail before reaching it.
+func (vm *VM) DefineNative(name string, arity value.Arity, function value.NativeFn) {
 	vm.push(value.NewObjString(name))
-	vm.push(value.NewObjNative(value.NewNative(function)))
-	vm.Globals[vm.Stack[0].AsGoString()] = vm.Stack[1]
+	vm.push(value.NewObjNative(value.NewNative(name, arity, function)))
+	vm.Builtins[vm.Stack[0].AsGoString()] = vm.Stack[1]
 	vm.pop()
 	vm.pop()
 }
@@ -1,7 +1,21 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"golox-lang/lib/chunk"
+	"golox-lang/lib/chunk/opcode"
+	"golox-lang/lib/compiler"
+	"golox-lang/lib/value"
+	"golox-lang/lib/value/valuetype"
+	"golox-lang/lib/vm/interpretresult"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
 )
 
 func createChunkForTesting(bytes ...byte) *chunk.Chunk {
@@ -11,3 +25,990 @@ func createChunkForTesting(bytes ...byte) *chunk.Chunk {
 	}
 	return c
 }
+
+// interpret runs source in a new VM, returning the VM, the result and what the
+// script printed.
+func interpret(source string) (*VM, interpretresult.InterpretResult, string) {
+	var stdout bytes.Buffer
+	vm := New()
+	vm.Stdout = &stdout
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+
+	result := vm.Interpret(source)
+	return vm, result, stdout.String()
+}
+
+// scriptTest is a script with the output it prints, or the message of the
+// runtime error it ends with when message is set.
+type scriptTest struct {
+	source  string
+	output  string
+	message string
+}
+
+func runScriptTests(t *testing.T, tests []scriptTest) {
+	for _, test := range tests {
+		vm, result, output := interpret(test.source)
+		if test.message != "" {
+			if result != interpretresult.INTERPRET_RUNTIME_ERROR || vm.LastError().Message != test.message {
+				t.Errorf("vm.Interpret(%q) failed, expected runtime error %q, got %v %q", test.source, test.message, result, output)
+			}
+			continue
+		}
+
+		if result != interpretresult.INTERPRET_OK {
+			t.Errorf("vm.Interpret(%q) failed, expected %v, got %v", test.source, interpretresult.INTERPRET_OK, result)
+			continue
+		}
+		if output != test.output {
+			t.Errorf("vm.Interpret(%q) failed, expected output %q, got %q", test.source, test.output, output)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		// a counter keeps its own state between calls
+		{source: `
+fun makeCounter() {
+  var count = 0;
+  fun increment() { count = count + 1; return count; }
+  return increment;
+}
+var a = makeCounter();
+var b = makeCounter();
+print a(); print a(); print b(); print a();`, output: "1\n2\n1\n3\n"},
+
+		// each iteration of a loop body captures a fresh variable
+		{source: `
+var first; var second; var third;
+for (var i = 0; i < 3; i = i + 1) {
+  var j = i;
+  fun get() { return j; }
+  if (i == 0) first = get;
+  if (i == 1) second = get;
+  if (i == 2) third = get;
+}
+print first(); print second(); print third();`, output: "0\n1\n2\n"},
+
+		// an inner closure captures through the closure around it
+		{source: `
+fun outer() {
+  var x = "outer";
+  fun middle() {
+    fun inner() { x = x + "!"; return x; }
+    return inner;
+  }
+  return middle;
+}
+var inner = outer()();
+print inner(); print inner();`, output: "outer!\nouter!!\n"},
+
+		// closures sharing a variable see each other's writes
+		{source: `
+var get; var set;
+fun pair() {
+  var shared = 1;
+  fun g() { return shared; }
+  fun s(v) { shared = v; }
+  get = g; set = s;
+}
+pair();
+set(42);
+print get();`, output: "42\n"},
+
+		// leaving a block closes over the value the variable had last
+		{source: `
+var f;
+{
+  var local = "before";
+  fun show() { print local; }
+  f = show;
+  local = "after";
+}
+f();`, output: "after\n"},
+		{source: `
+var f;
+{
+  var a = 1;
+  {
+    var b = 2;
+    fun sum() { return a + b; }
+    f = sum;
+  }
+  a = 10;
+}
+print f();`, output: "12\n"},
+	})
+}
+
+func TestLists(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{source: `print [];`, output: "[]\n"},
+		{source: `print [1, "two", nil, [3]];`, output: "[1, two, nil, [3]]\n"},
+		{source: `var l = [1, 2, 3]; print l[0]; print l[2];`, output: "1\n3\n"},
+		{source: `var l = [1, 2, 3]; print l[1] = "x"; print l;`, output: "x\n[1, x, 3]\n"},
+		{source: `var l = [[1], [2]]; l[1][0] = 5; print l;`, output: "[[1], [5]]\n"},
+		{source: `var l = [1]; l.push(l); print l; var m = [l, l]; print m;`, output: "[1, [...]]\n[[1, [...]], [1, [...]]]\n"},
+
+		{source: `var l = [1, 2]; print l.push(3); print l; print l.len();`, output: "nil\n[1, 2, 3]\n3\n"},
+		{source: `var l = [1, 2]; print l.pop(); print l;`, output: "2\n[1]\n"},
+		{source: `var l = [1, 3]; l.insert(1, 2); l.insert(3, 4); l.insert(0, 0); print l;`, output: "[0, 1, 2, 3, 4]\n"},
+		{source: `var l = [1, 2, 3]; print l.remove(1); print l;`, output: "2\n[1, 3]\n"},
+		{source: `var l = [1, 2, 3, 4]; print l.slice(1); print l.slice(1, 3); print l.slice(4); print l;`, output: "[2, 3, 4]\n[2, 3]\n[]\n[1, 2, 3, 4]\n"},
+
+		{source: `[1, 2][2];`, message: "List index out of range."},
+		{source: `[1, 2][-1];`, message: "List index out of range."},
+		{source: `[][0] = 1;`, message: "List index out of range."},
+		{source: `[1, 2][0.5];`, message: "List index must be an integer."},
+		{source: `[1, 2]["0"];`, message: "List index must be a number."},
+		{source: `[1, 2]["0"] = 1;`, message: "List index must be a number."},
+		{source: `var x = 1; x[0];`, message: "Only lists and maps can be indexed."},
+		{source: `[].pop();`, message: "Can't pop from an empty list."},
+		{source: `[1].insert(2, 0);`, message: "List index out of range."},
+		{source: `[1].remove(1);`, message: "List index out of range."},
+		{source: `[1, 2].slice(2, 1);`, message: "Slice end must not be before its start."},
+
+		{source: `[].push();`, message: "Expect 1 arguments but got 0."},
+		{source: `[1].pop(1);`, message: "Expect 0 arguments but got 1."},
+		{source: `[].len(1);`, message: "Expect 0 arguments but got 1."},
+		{source: `[].insert(0);`, message: "Expect 2 arguments but got 1."},
+		{source: `[1].remove();`, message: "Expect 1 arguments but got 0."},
+		{source: `[].slice();`, message: "Expect 1 to 2 arguments but got 0."},
+		{source: `[].slice(0, 0, 0);`, message: "Expect 1 to 2 arguments but got 3."},
+	})
+}
+
+func TestMaps(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		{source: `print {};`, output: "{}\n"},
+		{source: `print {"a": 1, 2: true, nil: "n"};`, output: "{a: 1, 2: true, nil: n}\n"},
+		{source: `print {"a": 1, "a": 2};`, output: "{a: 2}\n"},
+		{source: `var m = {"a": 1, 2: "two"}; print m["a"]; print m[2]; print m["missing"];`, output: "1\ntwo\nnil\n"},
+		{source: `var m = {}; print m["a"] = 1; m["b"] = 2; m["a"] = 3; print m;`, output: "1\n{a: 3, b: 2}\n"},
+		{source: `var m = {}; m["k" + "ey"] = 1; print m["key"];`, output: "1\n"},
+		{source: `fun f() {} var m = {}; m[f] = "fn"; print m[f];`, output: "fn\n"},
+		{source: `var m = {}; m["self"] = m; print m; print [m];`, output: "{self: {...}}\n[{self: {...}}]\n"},
+		{source: `var m = {"l": []}; m["l"].push(m); print m;`, output: "{l: [{...}]}\n"},
+
+		{source: `var m = {"a": 1, "b": 2}; print m.keys(); print m.values(); print m.len();`, output: "[a, b]\n[1, 2]\n2\n"},
+		{source: `var m = {"a": 1}; print m.has("a"); print m.has("b");`, output: "true\nfalse\n"},
+		{source: `var m = {"a": 1, "b": 2}; print m.delete("a"); print m.delete("a"); print m; print m.has("a");`, output: "true\nfalse\n{b: 2}\nfalse\n"},
+
+		{source: `var m = {[1]: 1};`, message: "Map keys must be hashable."},
+		{source: `var m = {}; m[[]];`, message: "Map keys must be hashable."},
+		{source: `var m = {}; m[{}] = 1;`, message: "Map keys must be hashable."},
+		{source: `var m = {}; m.has([]);`, message: "Map keys must be hashable."},
+		{source: `var m = {}; m.delete({});`, message: "Map keys must be hashable."},
+
+		{source: `var m = {}; m.keys(1);`, message: "Expect 0 arguments but got 1."},
+		{source: `var m = {}; m.has();`, message: "Expect 1 arguments but got 0."},
+		{source: `var m = {}; m.delete(1, 2);`, message: "Expect 1 arguments but got 2."},
+	})
+}
+
+func writeModule(t *testing.T, dir string, name string, source string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("failed to write module %v: %v", name, err)
+	}
+	return path
+}
+
+// global returns the value of a global variable of the main module.
+func global(vm *VM, name string) value.Value {
+	val, _ := vm.Globals.Get(name)
+	return val
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golox-import")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeModule(t, dir, "counter.lox", "var loads = 0; loads = loads + 1; fun twice(x) { return 2 * x; }")
+	mainPath := writeModule(t, dir, "main.lox", "")
+
+	vm := New()
+	vm.InitVM()
+	source := `
+		import "counter.lox" as c;
+		from "counter.lox" import twice, loads;
+		var result = twice(c.loads + 20);
+	`
+	if result := vm.InterpretFile(source, mainPath); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.InterpretFile(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+
+	if result := global(vm, "result"); !result.IsNumber() || result.AsNumber() != 42 {
+		t.Errorf("vm.InterpretFile(...) failed, expected result to be 42, got %v", result)
+	}
+	if loads := global(vm, "loads"); loads.AsNumber() != 1 {
+		t.Errorf("vm.InterpretFile(...) failed, expected module to run once, ran %v times", loads)
+	}
+	if _, present := vm.Globals.Get("twice"); !present {
+		t.Errorf("vm.InterpretFile(...) failed, expected from-import to define twice")
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golox-import")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeModule(t, dir, "a.lox", `import "b.lox" as b;`)
+	writeModule(t, dir, "b.lox", `import "a.lox" as a;`)
+	mainPath := writeModule(t, dir, "main.lox", "")
+
+	vm := New()
+	vm.InitVM()
+	source := `
+		var message;
+		try { import "a.lox" as a; } catch (e) { message = e.message; }
+	`
+	vm.InterpretFile(source, mainPath)
+
+	want := "Import cycle detected: main.lox -> a.lox -> b.lox -> a.lox."
+	if message := global(vm, "message"); !message.IsString() || message.AsGoString() != want {
+		t.Errorf("vm.InterpretFile(...) failed, expected error %q, got %v", want, message)
+	}
+}
+
+func TestImportStackOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golox-import")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeModule(t, dir, "leaf.lox", `var x = 1;`)
+	mainPath := writeModule(t, dir, "main.lox", "")
+
+	// calling the module's script is the call that overflows
+	vm := New()
+	vm.Limits = Limits{MaxFrames: 2}
+	vm.InitVM()
+	source := `
+		var message;
+		fun load() { try { import "leaf.lox" as leaf; } catch (e) { message = e.message; } }
+		load();
+		import "leaf.lox" as leaf;
+		var x = leaf.x;
+	`
+	if result := vm.InterpretFile(source, mainPath); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.InterpretFile(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+
+	if message := global(vm, "message"); !message.IsString() || message.AsGoString() != "Stack overflow." {
+		t.Errorf("vm.InterpretFile(...) failed, expected error %q, got %v", "Stack overflow.", message)
+	}
+	if x := global(vm, "x"); !x.IsNumber() || x.AsNumber() != 1 {
+		t.Errorf("vm.InterpretFile(...) failed, expected the module to load on the next import, got %v", x)
+	}
+}
+
+func TestCall(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+	source := `
+		fun add(a, b) { return a + b; }
+		class Counter {
+			init(start) { this.count = start; }
+			increment(by) { this.count = this.count + by; return this.count; }
+		}
+		var counter = Counter(10);
+	`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+
+	result, err := vm.Call(global(vm, "add"), value.New(valuetype.VAL_NUMBER, 1.0), value.New(valuetype.VAL_NUMBER, 2.0))
+	if err != nil || result.AsNumber() != 3 {
+		t.Errorf("vm.Call(...) failed, expected 3, got %v (%v)", result, err)
+	}
+
+	result, err = vm.Invoke(global(vm, "counter"), "increment", value.New(valuetype.VAL_NUMBER, 5.0))
+	if err != nil || result.AsNumber() != 15 {
+		t.Errorf("vm.Invoke(...) failed, expected 15, got %v (%v)", result, err)
+	}
+
+	_, err = vm.Call(global(vm, "add"), value.New(valuetype.VAL_NUMBER, 1.0), value.New(valuetype.VAL_NIL, nil))
+	if err == nil || err.Error() != "Operands must be numbers." {
+		t.Errorf("vm.Call(...) failed, expected a runtime error, got %v", err)
+	}
+	if len(vm.Stack) != 0 || len(vm.Frames) != 0 {
+		t.Errorf("vm.Call(...) failed, expected an empty stack after an error, got %v values and %v frames", len(vm.Stack), len(vm.Frames))
+	}
+
+	if _, err = vm.Invoke(global(vm, "counter"), "missing"); err == nil {
+		t.Errorf("vm.Invoke(...) failed, expected an error for an undefined method")
+	}
+}
+
+func TestCallFromNative(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+	vm.DefineNative("apply", value.ExactArity(2), func(argCount int, args []value.Value) (value.Value, error) {
+		return vm.Call(args[0], args[1])
+	})
+
+	source := `
+		var offset = 1;
+		fun inc(x) { return x + offset; }
+		var result = apply(inc, apply(inc, 40));
+	`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+
+	if result := global(vm, "result"); result.AsNumber() != 42 {
+		t.Errorf("vm.Call(...) failed, expected result to be 42, got %v", result)
+	}
+}
+
+type point struct {
+	X, Y   float64
+	Label  string `lox:"label"`
+	hidden int
+}
+
+func (p *point) Move(dx float64, dy float64) {
+	p.X += dx
+	p.Y += dy
+}
+
+func (p point) Sum() float64 {
+	return p.X + p.Y
+}
+
+type bag struct {
+	Items  []string
+	Counts map[string]int
+}
+
+func (b *bag) Add(item string) {
+	b.Items = append(b.Items, item)
+	b.Counts[item]++
+}
+
+func (b *bag) Take(i int) string {
+	return b.Items[i]
+}
+
+func TestBindFunction(t *testing.T) {
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	err := vm.BindFunction("repeat", func(s string, n int) ([]string, error) {
+		if n < 0 {
+			return nil, errors.New("Count must not be negative.")
+		}
+		items := make([]string, n)
+		for i := range items {
+			items[i] = s
+		}
+		return items, nil
+	})
+	if err != nil {
+		t.Fatalf("vm.BindFunction(...) failed, expected no error, got %v", err)
+	}
+
+	if result := vm.Interpret(`var result = repeat("ab", 3);`); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+	var items []string
+	if err := vm.FromValue(global(vm, "result"), &items); err != nil || len(items) != 3 || items[2] != "ab" {
+		t.Errorf("vm.BindFunction(...) failed, expected three copies of ab, got %v (%v)", items, err)
+	}
+
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{`repeat("ab");`, "Expect 2 arguments but got 1."},
+		{`repeat("ab", 1.5);`, "Expect an integer for argument 2 but got number."},
+		{`repeat(1, 1);`, "Expect a string for argument 1 but got number."},
+		{`repeat("ab", -1);`, "Count must not be negative."},
+		{`repeat("ab", 1e30);`, "Number 1e+30 doesn't fit in int."},
+		{`repeat("ab", -1e30);`, "Number -1e+30 doesn't fit in int."},
+		{`repeat("ab", 1/0);`, "Number +Inf doesn't fit in int."},
+		{`repeat("ab", 0/0);`, "Expect an integer for argument 2 but got number."},
+		{`explode();`, "Go function panicked: boom"},
+	}
+	if err := vm.BindFunction("explode", func() { panic("boom") }); err != nil {
+		t.Fatalf("vm.BindFunction(...) failed, expected no error, got %v", err)
+	}
+	for _, test := range tests {
+		vm.Interpret(test.source)
+		if err := vm.LastError(); err == nil || err.Message != test.message {
+			t.Errorf("vm.Interpret(%q) failed, expected error %q, got %v", test.source, test.message, err)
+		}
+	}
+}
+
+func TestFromValueRange(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+
+	var small int8
+	if err := vm.FromValue(value.NumberValue(-128), &small); err != nil || small != -128 {
+		t.Errorf("vm.FromValue(...) failed, expected -128, got %v (%v)", small, err)
+	}
+	if err := vm.FromValue(value.NumberValue(128), &small); err == nil {
+		t.Errorf("vm.FromValue(...) failed, expected 128 not to fit in int8")
+	}
+
+	var large int64
+	if err := vm.FromValue(value.NumberValue(9223372036854775807), &large); err == nil {
+		t.Errorf("vm.FromValue(...) failed, expected 2^63 not to fit in int64")
+	}
+
+	var unsigned uint64
+	if err := vm.FromValue(value.NumberValue(-1), &unsigned); err == nil {
+		t.Errorf("vm.FromValue(...) failed, expected -1 not to fit in uint64")
+	}
+	if err := vm.FromValue(value.NumberValue(18446744073709551615), &unsigned); err == nil {
+		t.Errorf("vm.FromValue(...) failed, expected 2^64 not to fit in uint64")
+	}
+}
+
+func TestToValueCycles(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+
+	type node struct {
+		Name string
+		Next *node
+	}
+	cycle := &node{Name: "a"}
+	cycle.Next = &node{Name: "b", Next: cycle}
+	if _, err := vm.ToValue(cycle); err == nil {
+		t.Errorf("vm.ToValue(...) failed, expected an error for a cyclic struct")
+	}
+
+	items := []interface{}{1, nil}
+	items[1] = items
+	if _, err := vm.ToValue(items); err == nil {
+		t.Errorf("vm.ToValue(...) failed, expected an error for a slice containing itself")
+	}
+
+	m := map[string]interface{}{}
+	m["self"] = m
+	if _, err := vm.ToValue(m); err == nil {
+		t.Errorf("vm.ToValue(...) failed, expected an error for a map containing itself")
+	}
+
+	// values shared without a cycle are converted each time they appear
+	shared := &node{Name: "shared"}
+	val, err := vm.ToValue([]*node{shared, shared})
+	if err != nil || len(val.AsList().Items) != 2 {
+		t.Errorf("vm.ToValue(...) failed, expected a list of two instances, got %v (%v)", val, err)
+	}
+	if len(vm.converting) != 0 {
+		t.Errorf("vm.ToValue(...) failed, expected no values left marked as being converted, got %v", len(vm.converting))
+	}
+}
+
+func TestBindStruct(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+	if err := vm.BindStruct("Point", point{}); err != nil {
+		t.Fatalf("vm.BindStruct(...) failed, expected no error, got %v", err)
+	}
+
+	source := `
+		var p = Point(1, 2, "a");
+		p.Move(10, 20);
+		var sum = p.Sum();
+	`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+
+	if sum := global(vm, "sum"); sum.AsNumber() != 33 {
+		t.Errorf("vm.BindStruct(...) failed, expected sum to be 33, got %v", sum)
+	}
+
+	var p point
+	if err := vm.FromValue(global(vm, "p"), &p); err != nil || p.X != 11 || p.Y != 22 || p.Label != "a" {
+		t.Errorf("vm.FromValue(...) failed, expected {11 22 a}, got %v (%v)", p, err)
+	}
+
+	val, err := vm.ToValue(&point{X: 3})
+	if err != nil || !val.IsInstance() || val.AsInstance().Klass.Name != "Point" {
+		t.Fatalf("vm.ToValue(...) failed, expected a Point instance, got %v (%v)", val, err)
+	}
+	if _, present := val.AsInstance().Fields["hidden"]; present {
+		t.Errorf("vm.ToValue(...) failed, expected unexported fields to be skipped")
+	}
+}
+
+func TestBindStructShared(t *testing.T) {
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	if err := vm.BindStruct("Bag", bag{}); err != nil {
+		t.Fatalf("vm.BindStruct(...) failed, expected no error, got %v", err)
+	}
+
+	// lists and maps read from the instance keep seeing what methods change
+	source := `
+		var b = Bag([], {});
+		var items = b.Items;
+		var counts = b.Counts;
+		b.Add("x");
+		b.Add("x");
+	`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+	if items := global(vm, "items"); items.String() != "[x, x]" {
+		t.Errorf("vm.BindStruct(...) failed, expected items to be [x, x], got %v", items)
+	}
+	if counts := global(vm, "counts"); counts.String() != "{x: 2}" {
+		t.Errorf("vm.BindStruct(...) failed, expected counts to be {x: 2}, got %v", counts)
+	}
+
+	// a panicking method is a runtime error and the VM stays usable
+	if result := vm.Interpret("b.Take(5);"); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+		t.Errorf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_RUNTIME_ERROR, result)
+	}
+	if err := vm.LastError(); err == nil || !strings.HasPrefix(err.Message, "Go function panicked: ") {
+		t.Errorf("vm.Interpret(...) failed, expected a panic error, got %v", err)
+	}
+	if result := vm.Interpret(`var taken = b.Take(1);`); result != interpretresult.INTERPRET_OK || global(vm, "taken").String() != "x" {
+		t.Errorf("vm.Interpret(...) failed, expected taken to be x, got %v", global(vm, "taken"))
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	vm.DefineNative("sum", value.VariadicArity(1), func(argCount int, args []value.Value) (value.Value, error) {
+		total := 0.0
+		for _, arg := range args {
+			if !arg.IsNumber() {
+				return value.Value{}, errors.New("Can only sum numbers.")
+			}
+			total += arg.AsNumber()
+		}
+		return value.New(valuetype.VAL_NUMBER, total), nil
+	})
+
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{"clock(1, 2, 3);", "Expect 0 arguments but got 3."},
+		{"sum();", "Expect at least 1 arguments but got 0."},
+		{"fun f() {\n  sum(1, nil);\n}\nf();", "Can only sum numbers."},
+	}
+	for _, test := range tests {
+		if result := vm.Interpret(test.source); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+			t.Errorf("vm.Interpret(%q) failed, expected %v, got %v", test.source, interpretresult.INTERPRET_RUNTIME_ERROR, result)
+		}
+		if err := vm.LastError(); err == nil || err.Message != test.message {
+			t.Errorf("vm.Interpret(%q) failed, expected error %q, got %v", test.source, test.message, err)
+		}
+	}
+
+	if trace := vm.LastError().Trace; len(trace) != 2 || trace[0] != "<script>:2:13 in f()" {
+		t.Errorf("vm.Interpret(...) failed, expected the trace to start in f(), got %v", trace)
+	}
+
+	if result := vm.Interpret("var total = sum(1, 2, 3);"); result != interpretresult.INTERPRET_OK || global(vm, "total").AsNumber() != 6 {
+		t.Errorf("vm.Interpret(...) failed, expected total to be 6, got %v", global(vm, "total"))
+	}
+}
+
+func TestOperandKinds(t *testing.T) {
+	op := func(code opcode.OpCode) byte { return byte(code) }
+
+	tests := []struct {
+		code    []byte
+		message string
+	}{
+		{[]byte{op(opcode.OP_NIL), op(opcode.OP_IMPORT_FROM), 0, op(opcode.OP_RETURN)}, "Only modules have members to import."},
+		{[]byte{op(opcode.OP_NIL), op(opcode.OP_NIL), op(opcode.OP_METHOD), 0, op(opcode.OP_RETURN)}, "Only functions can be defined as methods of a class."},
+		{[]byte{op(opcode.OP_NIL), op(opcode.OP_NIL), op(opcode.OP_GET_SUPER), 0, op(opcode.OP_RETURN)}, "Superclass must be a class."},
+		{[]byte{op(opcode.OP_CLASS), 0, op(opcode.OP_NIL), op(opcode.OP_INHERIT), op(opcode.OP_RETURN)}, "Only classes can inherit."},
+	}
+
+	for _, test := range tests {
+		c := createChunkForTesting(test.code...)
+		c.AddConstant(value.NewObjString("name"))
+
+		// bytecode loaded from a file is verified, which doesn't check kinds
+		data, err := chunk.Marshal(value.NewFunction(c))
+		if err != nil {
+			t.Fatalf("chunk.Marshal(...) failed, expected no error, got %v", err)
+		}
+		function, err := chunk.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("chunk.Unmarshal(...) failed, expected no error, got %v", err)
+		}
+
+		vm := New()
+		vm.Stderr = ioutil.Discard
+		vm.InitVM()
+		if result := vm.InterpretFunction(function); result != interpretresult.INTERPRET_RUNTIME_ERROR || vm.LastError().Message != test.message {
+			t.Errorf("vm.InterpretFunction(...) failed, expected runtime error %q, got %v", test.message, result)
+		}
+	}
+}
+
+func TestInterpretFunctionArity(t *testing.T) {
+	function := value.NewFunction(createChunkForTesting(byte(opcode.OP_NIL), byte(opcode.OP_RETURN)))
+	function.Arity = 1
+
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	if result := vm.InterpretFunction(function); result != interpretresult.INTERPRET_RUNTIME_ERROR || vm.LastError().Message != "Expect 1 arguments but got 0." {
+		t.Errorf("vm.InterpretFunction(...) failed, expected runtime error %q, got %v", "Expect 1 arguments but got 0.", result)
+	}
+	if result := vm.Interpret("var x = 1;"); result != interpretresult.INTERPRET_OK {
+		t.Errorf("vm.Interpret(...) failed, expected the VM to be reusable, got %v", result)
+	}
+}
+
+func TestCompiledFilePath(t *testing.T) {
+	data, err := chunk.Marshal(compiler.Compile("fun f() {\n  nil();\n}\nf();"))
+	if err != nil {
+		t.Fatalf("chunk.Marshal(...) failed, expected no error, got %v", err)
+	}
+	function, err := chunk.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("chunk.Unmarshal(...) failed, expected no error, got %v", err)
+	}
+
+	// errors name the file the way the user passed it, not its absolute path
+	path := filepath.Join("scripts", "main.loxc")
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	if result := vm.InterpretFunctionFile(function, path); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("vm.InterpretFunctionFile(...) failed, expected %v, got %v", interpretresult.INTERPRET_RUNTIME_ERROR, result)
+	}
+
+	runtimeError := vm.LastError()
+	if runtimeError.Path != path {
+		t.Errorf("vm.InterpretFunctionFile(...) failed, expected the error in %q, got %q", path, runtimeError.Path)
+	}
+	for _, line := range runtimeError.Trace {
+		if !strings.HasPrefix(line, path+":") {
+			t.Errorf("vm.InterpretFunctionFile(...) failed, expected trace lines in %q, got %v", path, runtimeError.Trace)
+			break
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		source string
+		output string
+	}{
+		{"print 10 - 3 - 2;", "5\n"},
+		{"print 7 % 3; print -7 % 3;", "1\n-1\n"},
+		{"print 2 ** 3 ** 2;", "512\n"},
+		{"print -2 ** 2; print 2 ** -1;", "-4\n0.5\n"},
+		{"print 2 * 3 ** 2 % 5;", "3\n"},
+		{"print 0xff + 0b1010 + 0o17 + 1_000;", "1280\n"},
+		{"print 1.5e3; print 25E-1; print 0x1_0000_0000;", "1500\n2.5\n4.294967296e+09\n"},
+	}
+
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		vm := New()
+		vm.Stdout = &stdout
+		vm.InitVM()
+
+		if result := vm.Interpret(test.source); result != interpretresult.INTERPRET_OK {
+			t.Errorf("vm.Interpret(%q) failed, expected %v, got %v", test.source, interpretresult.INTERPRET_OK, result)
+			continue
+		}
+		if stdout.String() != test.output {
+			t.Errorf("vm.Interpret(%q) failed, expected output %q, got %q", test.source, test.output, stdout.String())
+		}
+	}
+
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+	if result := vm.Interpret(`print "a" - "b";`); result != interpretresult.INTERPRET_RUNTIME_ERROR || vm.LastError().Message != "Operands must be numbers." {
+		t.Errorf("vm.Interpret(...) failed, expected subtracting strings to be a runtime error")
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	tests := []struct {
+		source string
+		output string
+	}{
+		{`var n = "n"; print "${n}=${1 + 2}";`, "n=3\n"},
+		{`print "list ${[1, nil, "a"]} map ${ {"k": true}["k"] }";`, "list [1, nil, a] map true\n"},
+		{`class A {} fun f() {} print "${A} ${A()} ${f} ${clock}";`, "A A instance <fn f> <native fn clock>\n"},
+		{`var n = 2; print "outer ${"inner ${n * n}"} \${n}";`, "outer inner 4 ${n}\n"},
+		{`print "${1}" == "1";`, "true\n"},
+	}
+
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		vm := New()
+		vm.Stdout = &stdout
+		vm.InitVM()
+
+		if result := vm.Interpret(test.source); result != interpretresult.INTERPRET_OK {
+			t.Errorf("vm.Interpret(%q) failed, expected %v, got %v", test.source, interpretresult.INTERPRET_OK, result)
+			continue
+		}
+		if stdout.String() != test.output {
+			t.Errorf("vm.Interpret(%q) failed, expected output %q, got %q", test.source, test.output, stdout.String())
+		}
+	}
+}
+
+func TestStringEquality(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := New()
+	vm.Stdout = &stdout
+	vm.InitVM()
+
+	// strings built at run time are equal to literals with the same content
+	source := `var a = "con"; var b = a + "cat"; var c = "${a}cat"; print b == "concat"; print b == c; print b == a;`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK || stdout.String() != "true\ntrue\nfalse\n" {
+		t.Errorf("vm.Interpret(%q) failed, expected output %q, got %v %q", source, "true\ntrue\nfalse\n", result, stdout.String())
+	}
+
+	// and so are strings the host builds, inside other values too
+	stdout.Reset()
+	vm.Globals.Set("hosted", value.NewObjList([]value.Value{value.NewObjString("item")}))
+	if result := vm.Interpret(`print hosted[0] == "item"; print "item" != hosted[0];`); result != interpretresult.INTERPRET_OK || stdout.String() != "true\nfalse\n" {
+		t.Errorf("vm.Interpret(...) failed, expected a host built string to equal a literal, got %v %q", result, stdout.String())
+	}
+
+	// strings compare equal as map keys the same way
+	stdout.Reset()
+	vm.Globals.Set("key", value.NewObjString("k"))
+	if result := vm.Interpret(`var m = {"k": 1}; print m[key]; m[key] = 2; print m.len();`); result != interpretresult.INTERPRET_OK || stdout.String() != "1\n1\n" {
+		t.Errorf("vm.Interpret(...) failed, expected a host built key to find the entry, got %v %q", result, stdout.String())
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	var stdout bytes.Buffer
+	vm := New()
+	vm.Stdout = &stdout
+	vm.Stderr = ioutil.Discard
+	vm.InitVM()
+
+	// functions see globals defined after them, and later scripts see the
+	// globals of earlier ones
+	if result := vm.Interpret("fun show() { print later; } var later = 1;"); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+	}
+	if result := vm.Interpret("later = later + 1; show();"); result != interpretresult.INTERPRET_OK || stdout.String() != "2\n" {
+		t.Errorf("vm.Interpret(...) failed, expected output %q, got %v %q", "2\n", result, stdout.String())
+	}
+
+	tests := []struct {
+		source  string
+		message string
+	}{
+		{"print missing;", "Undefined variable 'missing'."},
+		{"missing = 1;", "Undefined variable 'missing'."},
+		{"fun f() { return early; } f(); var early = 1;", "Undefined variable 'early'."},
+	}
+	for _, test := range tests {
+		if result := vm.Interpret(test.source); result != interpretresult.INTERPRET_RUNTIME_ERROR || vm.LastError().Message != test.message {
+			t.Errorf("vm.Interpret(%q) failed, expected runtime error %q, got %v", test.source, test.message, result)
+		}
+	}
+	if _, present := vm.Globals.Get("missing"); present {
+		t.Errorf("vm.Interpret(...) failed, expected assigning an undefined variable not to define it")
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	var stderr bytes.Buffer
+	vm := New()
+	vm.Stderr = &stderr
+	vm.InitVM()
+
+	source := "var π = 3;\nfun f() {\n\treturn π - \"x\";\n}\nf();"
+	if result := vm.InterpretFile(source, "geometry.lox"); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("vm.InterpretFile(...) failed, expected %v, got %v", interpretresult.INTERPRET_RUNTIME_ERROR, result)
+	}
+	expected := "geometry.lox:3:11: Operands must be numbers.\n    \treturn π - \"x\";\n    \t         ^\n" +
+		"geometry.lox:3:11 in f()\ngeometry.lox:5:3 in script\n"
+	if !bytes.HasSuffix(stderr.Bytes(), []byte(expected)) {
+		t.Errorf("vm.InterpretFile(...) failed, expected stderr to end with %q, got %q", expected, stderr.String())
+	}
+
+	// a rethrown error is reported where it was first thrown
+	source = "try {\n  throw Error(\"first\");\n} catch (e) {\n  throw e;\n}"
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_RUNTIME_ERROR, result)
+	}
+	if err := vm.LastError(); err.Line != 2 || err.Column != 3 || err.Excerpt != "      throw Error(\"first\");\n      ^" {
+		t.Errorf("vm.Interpret(...) failed, expected the error at 2:3 with its excerpt, got %v:%v %q", err.Line, err.Column, err.Excerpt)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		limits  Limits
+		source  string
+		message string
+	}{
+		{Limits{MaxInstructions: 1000}, "while (true) {}", "Instruction limit exceeded."},
+		{Limits{MaxInstructions: 1000}, "try { while (true) {} } catch (e) {} finally { print 1; }", "Instruction limit exceeded."},
+		{Limits{MaxFrames: 100}, "fun f(n) { return f(n + 1); } f(0);", "Stack overflow."},
+		{Limits{MaxHeapBytes: 1 << 16}, "var s = \"x\"; while (true) { s = s + s; }", "Memory limit exceeded."},
+		{Limits{MaxHeapBytes: 1 << 16}, "var l = []; while (true) { l.push(nil); }", "Memory limit exceeded."},
+	}
+
+	for _, test := range tests {
+		vm := New()
+		vm.Stdout = ioutil.Discard
+		vm.Stderr = ioutil.Discard
+		vm.Limits = test.limits
+		vm.InitVM()
+
+		if result := vm.Interpret(test.source); result != interpretresult.INTERPRET_RUNTIME_ERROR {
+			t.Errorf("vm.Interpret(%q) failed, expected %v, got %v", test.source, interpretresult.INTERPRET_RUNTIME_ERROR, result)
+			continue
+		}
+		if err := vm.LastError(); err.Message != test.message {
+			t.Errorf("vm.Interpret(%q) failed, expected error %q, got %q", test.source, test.message, err.Message)
+		}
+
+		// the budgets start over on the next run
+		if result := vm.Interpret("var x = 1;"); result != interpretresult.INTERPRET_OK {
+			t.Errorf("vm.Interpret(...) failed, expected the VM to be reusable after %q", test.source)
+		}
+	}
+}
+
+func TestLimitsInCall(t *testing.T) {
+	vm := New()
+	vm.Stderr = ioutil.Discard
+	vm.Limits = Limits{MaxHeapBytes: 1 << 16}
+	vm.InitVM()
+	vm.DefineNative("attempt", value.ExactArity(1), func(argCount int, args []value.Value) (value.Value, error) {
+		_, err := vm.Call(args[0])
+		return value.BoolValue(err == nil), nil
+	})
+
+	// once the native has handled the failed call, try blocks work again
+	source := `
+		fun fill() { var l = []; while (true) { l.push(nil); } }
+		var filled = attempt(fill);
+		var caught = false;
+		try { throw 1; } catch (e) { caught = true; }
+	`
+	if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+		t.Fatalf("vm.Interpret(...) failed, expected %v, got %v (%v)", interpretresult.INTERPRET_OK, result, vm.LastError())
+	}
+	if filled := global(vm, "filled"); !filled.IsBool() || filled.AsBool() {
+		t.Errorf("vm.Call(...) failed, expected the memory limit to stop fill, got %v", filled)
+	}
+	if caught := global(vm, "caught"); !caught.IsBool() || !caught.AsBool() {
+		t.Errorf("vm.Interpret(...) failed, expected the throw to be caught, got %v", caught)
+	}
+}
+
+func TestInterpretContext(t *testing.T) {
+	vm := New()
+	vm.InitVM()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	source := "fun spin() { while (true) {} } try { spin(); } catch (e) { print e; }"
+	if result := vm.InterpretContext(ctx, source); result != interpretresult.INTERPRET_INTERRUPTED {
+		t.Fatalf("vm.InterpretContext(...) failed, expected %v, got %v", interpretresult.INTERPRET_INTERRUPTED, result)
+	}
+	if len(vm.Frames) != 0 || len(vm.Stack) != 0 {
+		t.Errorf("vm.InterpretContext(...) failed, expected an empty stack, got %v values and %v frames", len(vm.Stack), len(vm.Frames))
+	}
+
+	if result := vm.Interpret("var x = 1;"); result != interpretresult.INTERPRET_OK {
+		t.Errorf("vm.Interpret(...) failed, expected the VM to be reusable after an interruption, got %v", result)
+	}
+}
+
+func benchmarkInterpret(b *testing.B, source string) {
+	vm := New()
+	vm.Stdout = ioutil.Discard
+	vm.InitVM()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if result := vm.Interpret(source); result != interpretresult.INTERPRET_OK {
+			b.Fatalf("vm.Interpret(...) failed, expected %v, got %v", interpretresult.INTERPRET_OK, result)
+		}
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkInterpret(b, "fun fib(n) { if (n < 2) return n; return fib(n - 2) + fib(n - 1); } fib(20);")
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkInterpret(b, "var sum = 0; for (var i = 0; i < 100000; i = i + 1) { sum = sum + i; }")
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	benchmarkInterpret(b, `
+fun run() {
+	var x = 1;
+	for (var i = 0; i < 50000; i = i + 1) {
+		x = (x * 3 + i) / 2;
+		if (x > 1000000) x = x / 1000;
+	}
+	return x;
+}
+run();`)
+}
+
+func TestExceptions(t *testing.T) {
+	runScriptTests(t, []scriptTest{
+		// the thrown value is bound in the catch block
+		{source: `try { throw "x"; } catch (e) { print e; } print "after";`, output: "x\nafter\n"},
+		{source: `var e = "outer"; try { throw 1; } catch (e) { print e; } print e;`, output: "1\nouter\n"},
+
+		// finally runs however the try block is left
+		{source: `try { print 1; } finally { print 2; } print 3;`, output: "1\n2\n3\n"},
+		{source: `fun f() { try { return 1; } finally { print "finally"; } } print f();`, output: "finally\n1\n"},
+		{source: `fun f() { for (var i = 0; i < 5; i = i + 1) { try { if (i == 2) return i; } finally { print i; } } } print f();`, output: "0\n1\n2\n2\n"},
+		{source: `try { try { throw "e"; } finally { print "inner"; } } catch (e) { print e; }`, output: "inner\ne\n"},
+		{source: `try { throw 1; } catch (e) { print "catch"; } finally { print "finally"; }`, output: "catch\nfinally\n"},
+
+		// exceptions unwind through calls and can be thrown again
+		{source: `
+fun a() { throw Error("boom"); }
+fun b() { try { a(); } catch (e) { print "b"; throw e; } }
+try { b(); } catch (e) { print e.message; print e.line; }`, output: "b\nboom\n2\n"},
+
+		// runtime errors are Error instances
+		{source: `try { nil.x; } catch (e) { print e; print e.message; }`, output: "Error instance\nOnly instances have properties.\n"},
+		{source: `class MyError < Error {} try { throw MyError("mine"); } catch (e) { print e.message; }`, output: "mine\n"},
+
+		{source: `try { throw 1; } finally { print "finally"; }`, message: "Uncaught exception: 1"},
+		{source: `fun f() { throw Error("deep"); } f();`, message: "deep"},
+	})
+
+	// an exception carried through a finally block is reported where it was
+	// thrown, even when the block throws and catches one of its own
+	vm, _, _ := interpret("try {\n  throw 1;\n} finally {\n  try { throw 2; } catch (e) {}\n}")
+	if err := vm.LastError(); err.Line != 2 || err.Column != 3 || err.Message != "Uncaught exception: 1" {
+		t.Errorf("vm.Interpret(...) failed, expected exception 1 at 2:3, got %q at %v:%v", err.Message, err.Line, err.Column)
+	}
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"golox-lang/lib/chunk"
+	"golox-lang/lib/compiler"
 	"golox-lang/lib/vm"
 	"golox-lang/lib/vm/interpretresult"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	"os"
 )
@@ -15,10 +19,20 @@ func main() {
 	vm := vm.New()
 	vm.InitVM()
 
-	if len(os.Args) == 1 {
+	// --no-optimize leaves the bytecode as the compiler emits it, which is
+	// easier to follow when debugging.
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "--no-optimize" {
+		vm.NoOptimize = true
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
 		repl(vm)
-	} else if len(os.Args) == 2 {
-		runFile(os.Args[1], vm)
+	} else if args[0] == "compile" {
+		compileFile(args[1:], vm.NoOptimize)
+	} else if len(args) == 1 {
+		runFile(args[0], vm)
 	} else {
 		fmt.Print("Wrong number of arguments\n")
 		os.Exit(64)
@@ -49,9 +63,17 @@ func runFile(path string, vm *vm.VM) {
 		return
 	}
 
-	source := string(fileContent)
-
-	result := vm.Interpret(source)
+	var result interpretresult.InterpretResult
+	if chunk.IsCompiled(fileContent) {
+		function, err := chunk.Unmarshal(fileContent)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(65)
+		}
+		result = vm.InterpretFunctionFile(function, path)
+	} else {
+		result = vm.InterpretFile(string(fileContent), path)
+	}
 
 	if result == interpretresult.INTERPRET_COMPILE_ERROR {
 		os.Exit(65)
@@ -60,3 +82,47 @@ func runFile(path string, vm *vm.VM) {
 		os.Exit(70)
 	}
 }
+
+// compileFile handles `golox [--no-optimize] compile in.lox [-o out.loxc]`,
+// writing the bytecode next to the source when no output is given.
+func compileFile(args []string, noOptimize bool) {
+	var in, out string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			out = args[i+1]
+			i++
+		} else if in == "" {
+			in = args[i]
+		} else {
+			in = ""
+			break
+		}
+	}
+	if in == "" {
+		fmt.Print("Usage: golox [--no-optimize] compile in.lox [-o out.loxc]\n")
+		os.Exit(64)
+	}
+	if out == "" {
+		out = strings.TrimSuffix(in, filepath.Ext(in)) + ".loxc"
+	}
+
+	fileContent, err := ioutil.ReadFile(in)
+	if err != nil {
+		fmt.Println("File reading error", err)
+		os.Exit(74)
+	}
+
+	function, _ := compiler.CompileWithOptions(string(fileContent), compiler.Options{ErrorWriter: os.Stderr, NoOptimize: noOptimize})
+	if function == nil {
+		os.Exit(65)
+	}
+
+	data, err := chunk.Marshal(function)
+	if err == nil {
+		err = ioutil.WriteFile(out, data, 0644)
+	}
+	if err != nil {
+		fmt.Println("File writing error", err)
+		os.Exit(74)
+	}
+}